@@ -0,0 +1,78 @@
+package checkpoint
+
+import (
+	"sync"
+)
+
+// Cursor tracks in-flight lines of a file and commits the offset of the last line
+// such that every line before it was acknowledged. A nil *Cursor ignores all calls.
+type Cursor struct {
+	store   *Store
+	path    string
+	inode   uint64
+	mu      sync.Mutex
+	base    uint64
+	pending []pendingLine
+	stopped bool
+}
+
+type pendingLine struct {
+	end  int64
+	done bool
+}
+
+// Returns a cursor committing positions of the file at path to the store
+func (s *Store) Cursor(path string, inode uint64) *Cursor {
+	if s == nil {
+		return nil
+	}
+	return &Cursor{store: s, path: path, inode: inode}
+}
+
+// Registers an in-flight line ending at the provided offset and returns the function acknowledging it
+func (c *Cursor) Track(end int64) func() {
+	if c == nil {
+		return func() {}
+	}
+	c.mu.Lock()
+	seq := c.base + uint64(len(c.pending))
+	c.pending = append(c.pending, pendingLine{end: end})
+	c.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { c.ack(seq) })
+	}
+}
+
+// Stops committing positions, e.g. once the file was replaced by another one at the same path
+func (c *Cursor) Stop() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopped = true
+}
+
+func (c *Cursor) ack(seq uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopped {
+		return
+	}
+
+	c.pending[seq-c.base].done = true
+
+	// Pop acknowledged lines from the front and commit the furthest contiguous offset
+	committed := int64(-1)
+	i := 0
+	for ; i < len(c.pending) && c.pending[i].done; i++ {
+		committed = c.pending[i].end
+	}
+	if i > 0 {
+		c.pending = c.pending[i:]
+		c.base += uint64(i)
+		c.store.Commit(c.path, c.inode, committed)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package checkpoint
+
+import (
+	"os"
+	"syscall"
+)
+
+// Returns the inode number of a file, or 0 if it cannot be determined
+func Inode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
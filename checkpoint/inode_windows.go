@@ -0,0 +1,10 @@
+package checkpoint
+
+import (
+	"os"
+)
+
+// Inodes are not available on Windows, rotation is then only detected through truncation
+func Inode(info os.FileInfo) uint64 {
+	return 0
+}
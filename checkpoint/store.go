@@ -0,0 +1,192 @@
+package checkpoint
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/dimpogissou/isengard-server/logger"
+)
+
+// Position records how far a file has been read and acknowledged by connectors
+type Position struct {
+	Path   string `json:"path"`
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+// Store persists file positions to a local JSON file so tails can resume after a restart.
+// A nil *Store is valid and disables checkpointing.
+type Store struct {
+	path      string
+	mu        sync.Mutex
+	positions map[string]Position
+	dirty     bool
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// Opens the checkpoint file at path, creating an empty store if it does not exist yet,
+// and starts flushing positions to disk at the provided interval
+func Open(path string, interval time.Duration) (*Store, error) {
+
+	s := Store{
+		path:      path,
+		positions: make(map[string]Position),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		positions := []Position{}
+		if err := json.Unmarshal(data, &positions); err != nil {
+			return nil, fmt.Errorf("Could not parse checkpoint file %s: %s", path, err)
+		}
+		for _, p := range positions {
+			s.positions[p.Path] = p
+		}
+	}
+
+	go s.flushPeriodically(interval)
+
+	return &s, nil
+}
+
+func (s *Store) flushPeriodically(interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			logger.CheckErrAndLog(s.Flush(), "FailedFlushingCheckpoints", fmt.Sprintf("Could not write checkpoint file %s", s.path))
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Returns the offset to resume tailing the file from, and false if the file has no usable checkpoint.
+// A file whose inode is known under another path was renamed and resumes from that position,
+// a file whose inode changed was rotated and restarts from 0, a file shorter than its offset was truncated and restarts from 0.
+func (s *Store) Resume(path string, info os.FileInfo) (int64, bool) {
+	if s == nil {
+		return 0, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inode := Inode(info)
+	pos, found := s.positions[path]
+	if !found || pos.Inode != inode {
+		for _, p := range s.positions {
+			if p.Inode == inode && inode != 0 {
+				pos, found = p, true
+				break
+			}
+		}
+	}
+
+	switch {
+	case !found:
+		return 0, false
+	case pos.Inode != inode:
+		logger.Info(fmt.Sprintf("File %s was rotated since last checkpoint, reading from start", path))
+		return 0, true
+	case pos.Offset > info.Size():
+		logger.Info(fmt.Sprintf("File %s was truncated since last checkpoint, reading from start", path))
+		return 0, true
+	}
+	return pos.Offset, true
+}
+
+// Records the acknowledged offset of a file
+func (s *Store) Commit(path string, inode uint64, offset int64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Drop positions of other paths that pointed to the same file before it was renamed
+	for p, pos := range s.positions {
+		if p != path && pos.Inode == inode && inode != 0 {
+			delete(s.positions, p)
+		}
+	}
+	s.positions[path] = Position{Path: path, Inode: inode, Offset: offset}
+	s.dirty = true
+}
+
+// Writes positions to the checkpoint file if they changed since the last flush
+func (s *Store) Flush() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	positions := make([]Position, 0, len(s.positions))
+	for _, p := range s.positions {
+		positions = append(positions, p)
+	}
+	s.dirty = false
+	s.mu.Unlock()
+
+	// Positions stay dirty if they could not be written, so that the next flush retries
+	err := s.write(positions)
+	if err != nil {
+		s.mu.Lock()
+		s.dirty = true
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// Writes positions to the checkpoint file
+func (s *Store) write(positions []Position) error {
+	data, err := json.Marshal(positions)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file then rename it to never leave a partially written checkpoint
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Stops periodic flushing and writes the latest positions
+func (s *Store) Close() error {
+	if s == nil {
+		return nil
+	}
+	close(s.stop)
+	<-s.done
+	err := s.Flush()
+	logger.CheckErrAndLog(err, "FailedFlushingCheckpoints", fmt.Sprintf("Could not write checkpoint file %s", s.path))
+	return err
+}
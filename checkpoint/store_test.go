@@ -0,0 +1,140 @@
+package checkpoint
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+// Writes content to a file in dir and returns its path and file info
+func writeTestFile(dir string, name string, content string) (string, os.FileInfo) {
+	path := filepath.Join(dir, name)
+	check(ioutil.WriteFile(path, []byte(content), 0644))
+	info, err := os.Stat(path)
+	check(err)
+	return path, info
+}
+
+// Tests the cursor only commits offsets once every previous line was acknowledged
+func TestCursorCommitsContiguousOffsets(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "checkpoints")
+	check(err)
+	defer os.RemoveAll(dir)
+
+	store, err := Open(filepath.Join(dir, "checkpoints.json"), time.Hour)
+	check(err)
+	defer store.Close()
+
+	path, info := writeTestFile(dir, "app.log", "line1\nline2\nline3\n")
+	cursor := store.Cursor(path, Inode(info))
+	ack1, ack2, ack3 := cursor.Track(6), cursor.Track(12), cursor.Track(18)
+
+	cases := []struct {
+		ack  func()
+		want int64
+	}{
+		{ack2, -1}, // Second line acknowledged first, nothing can be committed
+		{ack1, 12}, // First line acknowledged, both lines committed
+		{ack3, 18},
+	}
+	for i, c := range cases {
+		c.ack()
+		got, ok := store.positions[path]
+		if c.want == -1 && ok {
+			t.Errorf("Case %d: unexpected commit at offset %d", i, got.Offset)
+		} else if c.want != -1 && got.Offset != c.want {
+			t.Errorf("Case %d: committed offset %d, want %d", i, got.Offset, c.want)
+		}
+	}
+}
+
+// Tests positions are persisted and resumed correctly for unchanged, truncated, rotated and renamed files
+func TestResume(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "checkpoints")
+	check(err)
+	defer os.RemoveAll(dir)
+	checkpointFile := filepath.Join(dir, "checkpoints.json")
+
+	unchanged, unchangedInfo := writeTestFile(dir, "unchanged.log", "0123456789\n")
+	truncated, truncatedInfo := writeTestFile(dir, "truncated.log", "0123456789\n")
+	rotated, rotatedInfo := writeTestFile(dir, "rotated.log", "0123456789\n")
+	renamed, renamedInfo := writeTestFile(dir, "renamed.log", "0123456789\n")
+
+	store, err := Open(checkpointFile, time.Hour)
+	check(err)
+	store.Commit(unchanged, Inode(unchangedInfo), 5)
+	store.Commit(truncated, Inode(truncatedInfo), 11)
+	store.Commit(rotated, Inode(rotatedInfo), 11)
+	store.Commit(renamed, Inode(renamedInfo), 8)
+	check(store.Close())
+
+	// Truncate, rotate and rename files while the process is "down"
+	check(ioutil.WriteFile(truncated, []byte("01\n"), 0644))
+	check(os.Rename(rotated, rotated+".1"))
+	writeTestFile(dir, "rotated.log", "new content\n")
+	check(os.Rename(renamed, renamed+".1"))
+
+	store, err = Open(checkpointFile, time.Hour)
+	check(err)
+	defer store.Close()
+
+	cases := []struct {
+		path   string
+		want   int64
+		wantOk bool
+	}{
+		{unchanged, 5, true},
+		{truncated, 0, true},
+		{rotated, 0, true},
+		{renamed + ".1", 8, true},
+		{filepath.Join(dir, "unknown.log"), 0, false},
+	}
+	writeTestFile(dir, "unknown.log", "unknown\n")
+	for _, c := range cases {
+		info, err := os.Stat(c.path)
+		check(err)
+		got, ok := store.Resume(c.path, info)
+		if got != c.want || ok != c.wantOk {
+			t.Errorf("Resume(%s) == (%d, %v), want (%d, %v)", c.path, got, ok, c.want, c.wantOk)
+		}
+	}
+}
+
+// Tests positions are written by the next flush after a failed flush
+func TestFlushRetriesFailedWrite(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "checkpoints")
+	check(err)
+	defer os.RemoveAll(dir)
+	checkpointFile := filepath.Join(dir, "checkpoints.json")
+	path, info := writeTestFile(dir, "app.log", "0123456789\n")
+
+	store, err := Open(checkpointFile, time.Hour)
+	check(err)
+	store.Commit(path, Inode(info), 11)
+
+	// A directory in place of the checkpoint file makes the rename fail
+	check(os.Mkdir(checkpointFile, 0755))
+	if err := store.Flush(); err == nil {
+		t.Fatalf("Expected the flush to fail while the checkpoint file is a directory")
+	}
+	check(os.Remove(checkpointFile))
+	check(store.Close())
+
+	store, err = Open(checkpointFile, time.Hour)
+	check(err)
+	defer store.Close()
+	if got, ok := store.Resume(path, info); got != 11 || !ok {
+		t.Errorf("Resume(%s) == (%d, %v), want (11, true)", path, got, ok)
+	}
+}
@@ -0,0 +1,199 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+var supportedFsyncPolicies = []string{"always", "interval", "never"}
+var supportedOverflowPolicies = []string{"block", "drop_newest", "drop_oldest", "spill"}
+
+const defaultQueueSegmentSize = 16 * 1024 * 1024
+const defaultQueueFsyncInterval = time.Second
+const defaultRetryBaseDelay = time.Second
+const defaultRetryMaxDelay = time.Minute
+const defaultBufferSize = 1024
+const defaultSpillMaxSize = 256 * 1024 * 1024
+
+// Delivery configuration shared by all connector types
+type DeliveryConfig struct {
+	Queue      QueueConfig      `yaml:"Queue"`
+	Retry      RetryConfig      `yaml:"Retry"`
+	DeadLetter DeadLetterConfig `yaml:"DeadLetter"`
+	Buffer     BufferConfig     `yaml:"Buffer"`
+}
+
+// In-memory buffer between the publisher and a connector, and the policy applied when it is full:
+// block the publisher, drop the newest or oldest event, or spill events to disk in SpillDirectory.
+// Events are dropped once the spill reaches SpillMaxSize bytes.
+type BufferConfig struct {
+	Size           int    `yaml:"Size"`
+	Overflow       string `yaml:"Overflow"`
+	SpillDirectory string `yaml:"SpillDirectory"`
+	SpillMaxSize   int64  `yaml:"SpillMaxSize"`
+}
+
+// Disk-backed queue configuration, the queue is disabled if Directory is empty
+type QueueConfig struct {
+	Directory     string        `yaml:"Directory"`
+	SegmentSize   int64         `yaml:"SegmentSize"`
+	MaxSize       int64         `yaml:"MaxSize"`
+	Fsync         string        `yaml:"Fsync"`
+	FsyncInterval time.Duration `yaml:"FsyncInterval"`
+}
+
+// Returns the queue configuration with defaults applied to unset fields
+func (config QueueConfig) WithDefaults() QueueConfig {
+	if config.SegmentSize == 0 {
+		config.SegmentSize = defaultQueueSegmentSize
+	}
+	if config.Fsync == "" {
+		config.Fsync = "interval"
+	}
+	if config.FsyncInterval == 0 {
+		config.FsyncInterval = defaultQueueFsyncInterval
+	}
+	return config
+}
+
+// Retry policy of failed sends, MaxAttempts = 0 retries indefinitely.
+// RetryOn holds regexes matched against error messages, all errors are retried if empty.
+type RetryConfig struct {
+	MaxAttempts int           `yaml:"MaxAttempts"`
+	BaseDelay   time.Duration `yaml:"BaseDelay"`
+	MaxDelay    time.Duration `yaml:"MaxDelay"`
+	Jitter      float64       `yaml:"Jitter"`
+	RetryOn     []string      `yaml:"RetryOn"`
+}
+
+// Destination of events that could not be delivered: an NDJSON file or another connector
+type DeadLetterConfig struct {
+	File      string `yaml:"File"`
+	Connector string `yaml:"Connector"`
+}
+
+// Returns the retry configuration with defaults applied to unset delays
+func (config RetryConfig) WithDefaults() RetryConfig {
+	if config.BaseDelay == 0 {
+		config.BaseDelay = defaultRetryBaseDelay
+	}
+	if config.MaxDelay == 0 {
+		config.MaxDelay = defaultRetryMaxDelay
+	}
+	if config.MaxDelay < config.BaseDelay {
+		config.MaxDelay = config.BaseDelay
+	}
+	return config
+}
+
+// Returns the buffer configuration with defaults applied to unset fields
+func (config BufferConfig) WithDefaults() BufferConfig {
+	if config.Size == 0 {
+		config.Size = defaultBufferSize
+	}
+	if config.Overflow == "" {
+		config.Overflow = "block"
+	}
+	if config.SpillMaxSize == 0 {
+		config.SpillMaxSize = defaultSpillMaxSize
+	}
+	return config
+}
+
+// Returns the configuration of the disk-backed spill, split in segments so that sent events free space
+func (config BufferConfig) SpillQueue() QueueConfig {
+	segmentSize := config.SpillMaxSize / 4
+	if segmentSize > defaultQueueSegmentSize {
+		segmentSize = defaultQueueSegmentSize
+	}
+	return QueueConfig{Directory: config.SpillDirectory, SegmentSize: segmentSize, MaxSize: config.SpillMaxSize}
+}
+
+// Compiles the RetryOn regexes
+func (config RetryConfig) RetryOnRegexes() ([]*regexp.Regexp, error) {
+	regexes := []*regexp.Regexp{}
+	for _, pattern := range config.RetryOn {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		regexes = append(regexes, re)
+	}
+	return regexes, nil
+}
+
+func (config DeliveryConfig) validate() error {
+	if err := config.Retry.validate(); err != nil {
+		return err
+	}
+	if err := config.DeadLetter.validate(); err != nil {
+		return err
+	}
+	if err := config.Buffer.validate(); err != nil {
+		return err
+	}
+	return config.Queue.validate()
+}
+
+func (config BufferConfig) validate() error {
+	if config.Size < 0 {
+		return errors.New(fmt.Sprintf("Invalid negative buffer size: %d", config.Size))
+	}
+	if config.SpillMaxSize < 0 {
+		return errors.New(fmt.Sprintf("Invalid negative buffer spill max size: %d", config.SpillMaxSize))
+	}
+	if config.Overflow != "" && !stringInSlice(config.Overflow, supportedOverflowPolicies) {
+		return errors.New(fmt.Sprintf("Invalid buffer overflow policy: %s", config.Overflow))
+	}
+	if config.Overflow == "spill" && config.SpillDirectory == "" {
+		return errors.New("Buffer overflow policy 'spill' requires a SpillDirectory")
+	}
+	return nil
+}
+
+func (config RetryConfig) validate() error {
+	if config.MaxAttempts < 0 || config.BaseDelay < 0 || config.MaxDelay < 0 {
+		return errors.New(fmt.Sprintf("Invalid negative value in retry config: max attempts = %d, base delay = %v, max delay = %v",
+			config.MaxAttempts, config.BaseDelay, config.MaxDelay))
+	}
+	if config.Jitter < 0 || config.Jitter > 1 {
+		return errors.New(fmt.Sprintf("Retry jitter must be between 0 and 1, got %v", config.Jitter))
+	}
+	if _, err := config.RetryOnRegexes(); err != nil {
+		return errors.New(fmt.Sprintf("Invalid retry error pattern: %s", err))
+	}
+	return nil
+}
+
+func (config DeadLetterConfig) validate() error {
+	if config.File != "" && config.Connector != "" {
+		return errors.New(fmt.Sprintf("Dead letter config can only have one of file (%s) or connector (%s)", config.File, config.Connector))
+	}
+	if config.File != "" {
+		if _, err := os.Stat(filepath.Dir(config.File)); os.IsNotExist(err) {
+			return errors.New(fmt.Sprintf("Directory of dead letter file %s does not exist", config.File))
+		}
+	}
+	return nil
+}
+
+func (queue QueueConfig) validate() error {
+	if queue.Directory == "" {
+		return nil
+	}
+	if queue.SegmentSize < 0 || queue.MaxSize < 0 || queue.FsyncInterval < 0 {
+		return errors.New(fmt.Sprintf("Invalid negative value in queue config: segment size = %d, max size = %d, fsync interval = %v",
+			queue.SegmentSize, queue.MaxSize, queue.FsyncInterval))
+	}
+	if queue.MaxSize > 0 && queue.MaxSize < queue.WithDefaults().SegmentSize {
+		return errors.New(fmt.Sprintf("Queue max size %d must be greater than segment size %d", queue.MaxSize, queue.WithDefaults().SegmentSize))
+	}
+	if queue.Fsync != "" && !stringInSlice(queue.Fsync, supportedFsyncPolicies) {
+		return errors.New(fmt.Sprintf("Invalid queue fsync policy: %s", queue.Fsync))
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Selection of the files tailed in the logs directory.
+// Include and Exclude are glob patterns matched against file names, or against paths relative to the logs
+// directory for patterns containing a separator, e.g. '*.log' or 'app/*.log'. Include patterns prefixed with '!'
+// exclude files, e.g. ['*.log', '!*.gz']. All files are included when Include is empty, and excluded files are never
+// tailed. Recursive also tails files in nested directories, including directories created later.
+// MaxFiles caps the number of tailed files, 0 tails any number of files.
+type FilesConfig struct {
+	Include   []string `yaml:"Include"`
+	Exclude   []string `yaml:"Exclude"`
+	Recursive bool     `yaml:"Recursive"`
+	MaxFiles  int      `yaml:"MaxFiles"`
+}
+
+// Returns the include and exclude patterns, with negated include patterns moved to the exclude patterns
+func (config FilesConfig) Patterns() ([]string, []string) {
+	include := []string{}
+	exclude := append([]string{}, config.Exclude...)
+	for _, pattern := range config.Include {
+		if strings.HasPrefix(pattern, "!") {
+			exclude = append(exclude, strings.TrimPrefix(pattern, "!"))
+		} else {
+			include = append(include, pattern)
+		}
+	}
+	return include, exclude
+}
+
+func (config FilesConfig) validate() error {
+	if config.MaxFiles < 0 {
+		return errors.New(fmt.Sprintf("Invalid negative MaxFiles: %d", config.MaxFiles))
+	}
+	include, exclude := config.Patterns()
+	for _, pattern := range append(include, exclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil || pattern == "" {
+			return errors.New(fmt.Sprintf("Invalid file glob pattern: '%s'", pattern))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+const defaultInputName = "default"
+
+// Input configuration, the files tailed in Directory are parsed with LogPattern and its Definitions,
+// or as configured by Parser.
+// Tags are attached to every event of the input, and events are routed to the connectors listed by name in
+// Connectors, or to all connectors when it is empty. Lines failing parsing are handled as configured by Unmatched.
+// Events are transformed by Processors before being published. A file selected by several inputs is tailed by the first one.
+type InputConfig struct {
+	Name        string            `yaml:"Name"`
+	Directory   string            `yaml:"Directory"`
+	Files       FilesConfig       `yaml:"Files"`
+	Parser      ParserConfig      `yaml:"Parser"`
+	LogPattern  string            `yaml:"LogPattern"`
+	Definitions []PatternConfig   `yaml:"Definitions"`
+	Multiline   MultilineConfig   `yaml:"Multiline"`
+	Unmatched   UnmatchedConfig   `yaml:"Unmatched"`
+	Processors  []ProcessorConfig `yaml:"Processors"`
+	Tags        []string          `yaml:"Tags"`
+	Connectors  []string          `yaml:"Connectors"`
+}
+
+// Returns the configured inputs, or a single input built from the top-level Directory and LogPattern if there are none
+func (config YamlConfig) GetInputs() []InputConfig {
+	if len(config.Inputs) > 0 {
+		return config.Inputs
+	}
+	return []InputConfig{InputConfig{
+		Name:        defaultInputName,
+		Directory:   config.Directory,
+		Files:       config.Files,
+		Parser:      config.Parser,
+		LogPattern:  config.LogPattern,
+		Definitions: config.Definitions,
+		Multiline:   config.Multiline,
+		Unmatched:   config.Unmatched,
+		Processors:  config.Processors,
+	}}
+}
+
+// Returns true if events of the input are routed to the named connector
+func (config InputConfig) RoutesTo(connector string) bool {
+	return len(config.Connectors) == 0 || stringInSlice(connector, config.Connectors)
+}
+
+func (config InputConfig) validate(connectors []string) error {
+	// LogPattern is only required by the regex parser
+	regex := config.Parser.WithDefaults().Type == defaultParserType
+	if missingFields(config.Name, config.Directory) || (regex && config.LogPattern == "") {
+		return errors.New(fmt.Sprintf("Missing field(s) in input config: name = %s, directory = %s, logpattern = %s",
+			config.Name, config.Directory, config.LogPattern))
+	}
+	if _, err := os.Stat(config.Directory); os.IsNotExist(err) {
+		return errors.New(fmt.Sprintf("Logs directory %s of input '%s' does not exist", config.Directory, config.Name))
+	}
+	if err := validateDefinitions(config.Definitions); err != nil {
+		return errors.New(fmt.Sprintf("Invalid input config '%s': %s", config.Name, err))
+	}
+	if _, err := BuildInputParser(config); err != nil {
+		return errors.New(fmt.Sprintf("Invalid input config '%s': %s", config.Name, err))
+	}
+	if err := config.Files.validate(); err != nil {
+		return errors.New(fmt.Sprintf("Invalid input config '%s': %s", config.Name, err))
+	}
+	if err := config.Multiline.validate(); err != nil {
+		return errors.New(fmt.Sprintf("Invalid input config '%s': %s", config.Name, err))
+	}
+	if config.Multiline.Enabled && config.Multiline.StartPattern == "" && !regex {
+		return errors.New(fmt.Sprintf("Invalid input config '%s': Multiline start pattern required with parser type '%s'",
+			config.Name, config.Parser.Type))
+	}
+	if err := config.Unmatched.validate(connectors); err != nil {
+		return errors.New(fmt.Sprintf("Invalid input config '%s': %s", config.Name, err))
+	}
+	for i, processor := range config.Processors {
+		if err := processor.validate(); err != nil {
+			return errors.New(fmt.Sprintf("Invalid input config '%s': Invalid processor %d: %s", config.Name, i+1, err))
+		}
+	}
+	for _, connector := range config.Connectors {
+		if !stringInSlice(connector, connectors) {
+			return errors.New(fmt.Sprintf("Unknown connector '%s' in input config '%s'", connector, config.Name))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// JSONParser parses lines holding a JSON object, nested objects being flattened to dotted field names such as
+// http.status. The values of the keys holding the timestamp, level and message are mapped to the timestamp,
+// level and message fields, as parsed by log patterns, and the level is normalised to one of the supported levels.
+type JSONParser struct {
+	keys map[string]string
+}
+
+// Creates a JSON parser mapping the configured keys to the timestamp, level and message fields
+func NewJSONParser(cfg ParserConfig) *JSONParser {
+	cfg = cfg.WithDefaults()
+	return &JSONParser{keys: map[string]string{
+		"timestamp": cfg.TimestampKey,
+		"level":     cfg.LevelKey,
+		"message":   cfg.MessageKey,
+	}}
+}
+
+// Parses a line into its flattened fields, mapping the timestamp, level and message keys.
+// Numbers are kept as written, null values are empty and arrays hold their JSON encoding.
+func (p *JSONParser) Parse(text string) (map[string]string, error) {
+	decoder := json.NewDecoder(bytes.NewReader([]byte(text)))
+	decoder.UseNumber()
+	var object map[string]interface{}
+	if err := decoder.Decode(&object); err != nil {
+		return make(map[string]string), errors.New(fmt.Sprintf("Line is not a JSON object: %s", err))
+	}
+	if object == nil {
+		return make(map[string]string), errors.New("Line is not a JSON object: null")
+	}
+
+	fields := make(map[string]string)
+	flatten("", object, fields)
+	for field, key := range p.keys {
+		if value, ok := fields[key]; ok && key != field {
+			delete(fields, key)
+			fields[field] = value
+		}
+	}
+	if level, ok := fields["level"]; ok {
+		fields["level"] = NormaliseLevel(level)
+	}
+	return fields, nil
+}
+
+// Returns the mapped fields, the other fields of JSON lines are not known in advance
+func (p *JSONParser) Fields() []string {
+	fields := []string{}
+	for field := range p.keys {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func (p *JSONParser) Types() map[string]FieldType {
+	return nil
+}
+
+// Adds the values of a decoded JSON object to fields, prefixing the keys of nested objects with their parent key
+func flatten(prefix string, object map[string]interface{}, fields map[string]string) {
+	for key, value := range object {
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		switch v := value.(type) {
+		case map[string]interface{}:
+			flatten(key, v, fields)
+		case string:
+			fields[key] = v
+		case json.Number:
+			fields[key] = v.String()
+		case bool:
+			fields[key] = fmt.Sprint(v)
+		case nil:
+			fields[key] = ""
+		default:
+			encoded, _ := json.Marshal(v)
+			fields[key] = string(encoded)
+		}
+	}
+}
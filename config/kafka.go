@@ -3,16 +3,121 @@ package config
 import (
 	"errors"
 	"fmt"
+	"net/url"
+	"os"
+	"time"
 )
 
-// Kafka connector configuration
+var supportedKafkaAcks = []string{"none", "one", "all"}
+var supportedKafkaBalancers = []string{"hash", "round_robin", "least_bytes", "field"}
+var supportedKafkaCodecs = []string{"raw", "json", "avro", "protobuf"}
+var supportedKafkaSASLMechanisms = []string{"PLAIN", "SCRAM-SHA-256", "SCRAM-SHA-512"}
+
+const defaultKafkaBatchSize = 100
+const defaultKafkaBatchBytes = 1024 * 1024
+const defaultKafkaBatchTimeout = time.Second
+const defaultKafkaWriteTimeout = 10 * time.Second
+const defaultKafkaKeyTemplate = "{hash}"
+
+// Kafka connector configuration.
+// RequiredAcks is 'none', 'one' or 'all' (default), events are only acknowledged once Kafka confirms their write
+// with the required acks. When Async is set, events are written concurrently and acknowledged from completion
+// callbacks, letting the writer fill batches instead of waiting for each event in turn.
+// Message keys are rendered from KeyTemplate, e.g. '{code}', and default to '{hash}', a stable hash of the event
+// source path and offset. Balancer is 'hash' (default, by key), 'round_robin', 'least_bytes' or 'field', which
+// writes to the partition number held by PartitionField.
+// Brokers lists the 'host:port' bootstrap brokers, Host and Port are used when it is empty.
+// Codec is 'raw' (default, the line text), 'json' (the event with its fields, source, hostname and timestamps),
+// or 'avro' and 'protobuf' which serialise the event with a schema registered in SchemaRegistry.
+// Headers lists the fields written as message headers, which may also be level, source, hostname, offset or hash.
 type KafkaConnectorConfig struct {
-	Name   string   `yaml:"Name"`
-	Type   string   `yaml:"Type"`
-	Host   string   `yaml:"Host"`
-	Port   string   `yaml:"Port"`
-	Topic  string   `yaml:"Topic"`
-	Levels []string `yaml:"Levels"`
+	Name           string                    `yaml:"Name"`
+	Type           string                    `yaml:"Type"`
+	Brokers        []string                  `yaml:"Brokers"`
+	Host           string                    `yaml:"Host"`
+	Port           string                    `yaml:"Port"`
+	Topic          string                    `yaml:"Topic"`
+	Levels         []string                  `yaml:"Levels"`
+	Delivery       DeliveryConfig            `yaml:"Delivery"`
+	Batch          KafkaBatchConfig          `yaml:"Batch"`
+	RequiredAcks   string                    `yaml:"RequiredAcks"`
+	Async          bool                      `yaml:"Async"`
+	WriteTimeout   time.Duration             `yaml:"WriteTimeout"`
+	KeyTemplate    string                    `yaml:"KeyTemplate"`
+	Balancer       string                    `yaml:"Balancer"`
+	PartitionField string                    `yaml:"PartitionField"`
+	TLS            KafkaTLSConfig            `yaml:"TLS"`
+	SASL           KafkaSASLConfig           `yaml:"SASL"`
+	Codec          string                    `yaml:"Codec"`
+	Headers        []string                  `yaml:"Headers"`
+	SchemaRegistry KafkaSchemaRegistryConfig `yaml:"SchemaRegistry"`
+}
+
+// Confluent schema registry configuration for the avro and protobuf codecs.
+// The schema is read from SchemaFile, or derived from the named groups of the inputs routing to the connector when unset.
+// Subject defaults to '<topic>-value'. With AutoRegister the schema is registered if missing,
+// otherwise it must already be registered under the subject.
+type KafkaSchemaRegistryConfig struct {
+	Url          string `yaml:"Url"`
+	Subject      string `yaml:"Subject"`
+	SchemaFile   string `yaml:"SchemaFile"`
+	AutoRegister bool   `yaml:"AutoRegister"`
+	Username     string `yaml:"Username"`
+	Password     string `yaml:"Password"`
+	PasswordFile string `yaml:"PasswordFile"`
+	PasswordEnv  string `yaml:"PasswordEnv"`
+}
+
+// Kafka TLS configuration, CAFile defaults to the system roots and CertFile/KeyFile enable client authentication.
+// InsecureSkipVerify disables server certificate checks and is only meant for development clusters.
+type KafkaTLSConfig struct {
+	Enabled            bool   `yaml:"Enabled"`
+	CAFile             string `yaml:"CAFile"`
+	CertFile           string `yaml:"CertFile"`
+	KeyFile            string `yaml:"KeyFile"`
+	ServerName         string `yaml:"ServerName"`
+	InsecureSkipVerify bool   `yaml:"InsecureSkipVerify"`
+}
+
+// Kafka SASL configuration, Mechanism is 'PLAIN', 'SCRAM-SHA-256' or 'SCRAM-SHA-512'.
+// Credentials are set inline, or read from files or environment variables.
+type KafkaSASLConfig struct {
+	Mechanism    string `yaml:"Mechanism"`
+	Username     string `yaml:"Username"`
+	UsernameFile string `yaml:"UsernameFile"`
+	UsernameEnv  string `yaml:"UsernameEnv"`
+	Password     string `yaml:"Password"`
+	PasswordFile string `yaml:"PasswordFile"`
+	PasswordEnv  string `yaml:"PasswordEnv"`
+}
+
+// Kafka batching configuration of async connectors, a batch is written once it reaches its message count, size or timeout.
+// Sync connectors write each event on its own as Send waits for the write.
+type KafkaBatchConfig struct {
+	Size    int           `yaml:"Size"`
+	Bytes   int64         `yaml:"Bytes"`
+	Timeout time.Duration `yaml:"Timeout"`
+}
+
+// Returns the addresses of the bootstrap brokers
+func (config KafkaConnectorConfig) BrokerAddresses() []string {
+	if len(config.Brokers) > 0 {
+		return config.Brokers
+	}
+	return []string{fmt.Sprintf("%s:%s", config.Host, config.Port)}
+}
+
+// Returns the SASL username and password from their configured source
+func (config KafkaSASLConfig) Credentials() (string, string, error) {
+	username, err := resolveSecret(config.Username, config.UsernameFile, config.UsernameEnv)
+	if err != nil {
+		return "", "", err
+	}
+	password, err := resolveSecret(config.Password, config.PasswordFile, config.PasswordEnv)
+	if err != nil {
+		return "", "", err
+	}
+	return username, password, nil
 }
 
 func (config KafkaConnectorConfig) getName() string {
@@ -27,11 +132,137 @@ func (config KafkaConnectorConfig) getLevels() []string {
 	return config.Levels
 }
 
+func (config KafkaConnectorConfig) getDelivery() DeliveryConfig {
+	return config.Delivery
+}
+
+// Returns the configuration with defaults applied to unset fields
+func (config KafkaConnectorConfig) WithDefaults() KafkaConnectorConfig {
+	if config.Batch.Size == 0 {
+		config.Batch.Size = defaultKafkaBatchSize
+	}
+	if config.Batch.Bytes == 0 {
+		config.Batch.Bytes = defaultKafkaBatchBytes
+	}
+	if config.Batch.Timeout == 0 {
+		config.Batch.Timeout = defaultKafkaBatchTimeout
+	}
+	if config.RequiredAcks == "" {
+		config.RequiredAcks = "all"
+	}
+	if config.WriteTimeout == 0 {
+		config.WriteTimeout = defaultKafkaWriteTimeout
+	}
+	if config.KeyTemplate == "" {
+		config.KeyTemplate = defaultKafkaKeyTemplate
+	}
+	if config.Balancer == "" {
+		config.Balancer = "hash"
+	}
+	if config.Codec == "" {
+		config.Codec = "raw"
+	}
+	if config.SchemaRegistry.Subject == "" {
+		config.SchemaRegistry.Subject = config.Topic + "-value"
+	}
+	return config
+}
+
 func (config KafkaConnectorConfig) validate() error {
-	if missingFields(config.Host, config.Port, config.Topic) {
+	if config.Topic == "" || (len(config.Brokers) == 0 && missingFields(config.Host, config.Port)) {
 		return errors.New(
-			fmt.Sprintf("Missing field(s) in S3 connector config '%s': host = %s, port = %s, topic = %s",
-				config.Name, config.Host, config.Port, config.Topic))
+			fmt.Sprintf("Missing field(s) in Kafka connector config '%s': brokers = %v, host = %s, port = %s, topic = %s",
+				config.Name, config.Brokers, config.Host, config.Port, config.Topic))
+	}
+	if config.Batch.Size < 0 || config.Batch.Bytes < 0 || config.Batch.Timeout < 0 || config.WriteTimeout < 0 {
+		return errors.New(fmt.Sprintf("Invalid negative batch or timeout setting in Kafka connector config '%s': batch size = %d, batch bytes = %d, batch timeout = %v, write timeout = %v",
+			config.Name, config.Batch.Size, config.Batch.Bytes, config.Batch.Timeout, config.WriteTimeout))
+	}
+	if config.RequiredAcks != "" && !stringInSlice(config.RequiredAcks, supportedKafkaAcks) {
+		return errors.New(fmt.Sprintf("Invalid required acks in Kafka connector config '%s': %s", config.Name, config.RequiredAcks))
+	}
+	if _, err := ParseTemplate(config.KeyTemplate); err != nil {
+		return errors.New(fmt.Sprintf("Invalid key template in Kafka connector config '%s': %s", config.Name, err))
+	}
+	if config.Balancer != "" && !stringInSlice(config.Balancer, supportedKafkaBalancers) {
+		return errors.New(fmt.Sprintf("Invalid balancer in Kafka connector config '%s': %s", config.Name, config.Balancer))
+	}
+	if config.Balancer == "field" && config.PartitionField == "" {
+		return errors.New(fmt.Sprintf("Balancer 'field' requires a PartitionField in Kafka connector config '%s'", config.Name))
+	}
+	if config.Codec != "" && !stringInSlice(config.Codec, supportedKafkaCodecs) {
+		return errors.New(fmt.Sprintf("Invalid codec in Kafka connector config '%s': %s", config.Name, config.Codec))
+	}
+	if (config.Codec == "avro" || config.Codec == "protobuf") && config.SchemaRegistry.Url == "" {
+		return errors.New(fmt.Sprintf("Codec '%s' requires a SchemaRegistry Url in Kafka connector config '%s'", config.Codec, config.Name))
+	}
+	if err := config.SchemaRegistry.validate(); err != nil {
+		return errors.New(fmt.Sprintf("Invalid schema registry config in Kafka connector config '%s': %s", config.Name, err))
+	}
+	for _, header := range config.Headers {
+		if header == "" {
+			return errors.New(fmt.Sprintf("Empty header field name in Kafka connector config '%s'", config.Name))
+		}
+	}
+	if err := config.TLS.validate(); err != nil {
+		return errors.New(fmt.Sprintf("Invalid TLS config in Kafka connector config '%s': %s", config.Name, err))
+	}
+	if err := config.SASL.validate(); err != nil {
+		return errors.New(fmt.Sprintf("Invalid SASL config in Kafka connector config '%s': %s", config.Name, err))
+	}
+	return nil
+}
+
+func (config KafkaSchemaRegistryConfig) validate() error {
+	if config.Url != "" {
+		if u, err := url.Parse(config.Url); err != nil || u.Scheme == "" || u.Host == "" {
+			return errors.New(fmt.Sprintf("Invalid url: %s", config.Url))
+		}
+	}
+	if config.SchemaFile != "" {
+		if _, err := os.Stat(config.SchemaFile); err != nil {
+			return errors.New(fmt.Sprintf("Cannot read %s: %s", config.SchemaFile, err))
+		}
+	}
+	if _, err := config.GetPassword(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Returns the schema registry basic auth password from its configured source
+func (config KafkaSchemaRegistryConfig) GetPassword() (string, error) {
+	return resolveSecret(config.Password, config.PasswordFile, config.PasswordEnv)
+}
+
+func (config KafkaTLSConfig) validate() error {
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return errors.New("CertFile and KeyFile must be set together")
+	}
+	for _, file := range []string{config.CAFile, config.CertFile, config.KeyFile} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			return errors.New(fmt.Sprintf("Cannot read %s: %s", file, err))
+		}
+	}
+	return nil
+}
+
+func (config KafkaSASLConfig) validate() error {
+	if config.Mechanism == "" {
+		return nil
+	}
+	if !stringInSlice(config.Mechanism, supportedKafkaSASLMechanisms) {
+		return errors.New(fmt.Sprintf("Invalid SASL mechanism: %s", config.Mechanism))
+	}
+	username, password, err := config.Credentials()
+	if err != nil {
+		return err
+	}
+	if username == "" || password == "" {
+		return errors.New(fmt.Sprintf("Missing username or password for SASL mechanism %s", config.Mechanism))
 	}
 	return nil
 }
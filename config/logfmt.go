@@ -0,0 +1,135 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Keys holding the level of logfmt lines when LevelKey is not configured, in order of precedence
+var logfmtLevelKeys = []string{"level", "lvl", "severity"}
+
+// LogfmtParser parses lines of key=value pairs such as level=info msg="Request served" code=9, values with spaces
+// being double quoted with Go escapes. The timestamp, level and message keys are mapped as by the JSON parser,
+// and the level is normalised to one of the supported levels.
+type LogfmtParser struct {
+	keys      map[string]string
+	levelKeys []string
+}
+
+// Creates a logfmt parser mapping the configured keys, the level is read from the first of level, lvl
+// and severity keys if LevelKey is not configured
+func NewLogfmtParser(cfg ParserConfig) *LogfmtParser {
+	levelKeys := logfmtLevelKeys
+	if cfg.LevelKey != "" {
+		levelKeys = []string{cfg.LevelKey}
+	}
+	cfg = cfg.WithDefaults()
+	return &LogfmtParser{
+		keys:      map[string]string{"timestamp": cfg.TimestampKey, "message": cfg.MessageKey},
+		levelKeys: levelKeys,
+	}
+}
+
+// Parses all the pairs of a line, a key without value holding an empty value.
+// Lines without any key=value pair, such as plain text, fail parsing.
+func (p *LogfmtParser) Parse(text string) (map[string]string, error) {
+	fields, err := parseLogfmt(text)
+	if err != nil {
+		return make(map[string]string), err
+	}
+	for field, key := range p.keys {
+		if value, ok := fields[key]; ok && key != field {
+			delete(fields, key)
+			fields[field] = value
+		}
+	}
+	for _, key := range p.levelKeys {
+		if value, ok := fields[key]; ok {
+			delete(fields, key)
+			fields["level"] = NormaliseLevel(value)
+			break
+		}
+	}
+	return fields, nil
+}
+
+// Returns the mapped fields, the other keys of logfmt lines are not known in advance
+func (p *LogfmtParser) Fields() []string {
+	fields := []string{"level"}
+	for field := range p.keys {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func (p *LogfmtParser) Types() map[string]FieldType {
+	return nil
+}
+
+// Splits a logfmt line into its pairs, returning an error on unterminated quotes or invalid escapes
+func parseLogfmt(text string) (map[string]string, error) {
+	fields := make(map[string]string)
+	pairs := 0
+	i := 0
+	for {
+		for i < len(text) && text[i] <= ' ' {
+			i++
+		}
+		if i == len(text) {
+			break
+		}
+
+		start := i
+		for i < len(text) && text[i] > ' ' && text[i] != '=' && text[i] != '"' {
+			i++
+		}
+		key := text[start:i]
+		if key == "" {
+			return nil, errors.New(fmt.Sprintf("Invalid logfmt line, expected key at position %d", start))
+		}
+		if i == len(text) || text[i] != '=' {
+			if i < len(text) && text[i] == '"' {
+				return nil, errors.New(fmt.Sprintf("Invalid logfmt line, unexpected quote in key at position %d", i))
+			}
+			fields[key] = ""
+			continue
+		}
+		i++
+
+		if i < len(text) && text[i] == '"' {
+			end := i + 1
+			for end < len(text) && text[end] != '"' {
+				if text[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(text) {
+				return nil, errors.New(fmt.Sprintf("Invalid logfmt line, unterminated quoted value of key %s", key))
+			}
+			value, err := strconv.Unquote(text[i : end+1])
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Invalid logfmt line, cannot unquote value of key %s: %s", key, err))
+			}
+			fields[key] = value
+			pairs++
+			i = end + 1
+			continue
+		}
+
+		start = i
+		for i < len(text) && text[i] > ' ' {
+			i++
+		}
+		fields[key] = text[start:i]
+		pairs++
+	}
+	// Lines of bare words, such as plain text or stack traces, are not logfmt
+	if pairs == 0 {
+		return nil, errors.New("Invalid logfmt line, no key=value pair found")
+	}
+	return fields, nil
+}
@@ -0,0 +1,52 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+const defaultMultilineMaxLines = 500
+const defaultMultilineTimeout = time.Second
+
+// Multiline event assembly, e.g. for stack traces. When enabled, a line matching StartPattern starts a new event
+// and the following lines are appended to it as continuation lines, until the next start line, MaxLines lines,
+// or Timeout elapsed without new lines. StartPattern defaults to the LogPattern regex.
+// The assembled lines are joined with newlines and parsed as a single event, patterns must use the (?s) flag
+// for '.' to match across lines.
+type MultilineConfig struct {
+	Enabled      bool          `yaml:"Enabled"`
+	StartPattern string        `yaml:"StartPattern"`
+	MaxLines     int           `yaml:"MaxLines"`
+	Timeout      time.Duration `yaml:"Timeout"`
+}
+
+// Returns the multiline configuration with defaults applied to unset fields
+func (config MultilineConfig) WithDefaults() MultilineConfig {
+	if config.MaxLines == 0 {
+		config.MaxLines = defaultMultilineMaxLines
+	}
+	if config.Timeout == 0 {
+		config.Timeout = defaultMultilineTimeout
+	}
+	return config
+}
+
+// Returns the regex matching lines starting a new event, the log pattern regex if StartPattern is unset
+func (config MultilineConfig) StartRegex(logRegex *regexp.Regexp) (*regexp.Regexp, error) {
+	if config.StartPattern == "" {
+		return logRegex, nil
+	}
+	return regexp.Compile(config.StartPattern)
+}
+
+func (config MultilineConfig) validate() error {
+	if config.MaxLines < 0 || config.Timeout < 0 {
+		return errors.New(fmt.Sprintf("Invalid negative value in multiline config: max lines = %d, timeout = %v", config.MaxLines, config.Timeout))
+	}
+	if _, err := config.StartRegex(nil); err != nil {
+		return errors.New(fmt.Sprintf("Invalid multiline start pattern: %s", err))
+	}
+	return nil
+}
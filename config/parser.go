@@ -0,0 +1,107 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+var supportedParserTypes = []string{"regex", "json", "logfmt"}
+
+const defaultParserType = "regex"
+
+// Parser configuration of an input. The regex parser parses lines with the LogPattern of the input, the json
+// parser decodes lines as JSON objects and the logfmt parser splits lines into key=value pairs.
+// For json and logfmt lines, TimestampKey, LevelKey and MessageKey name the keys holding the timestamp,
+// level and message, or dotted paths to them in nested JSON objects.
+type ParserConfig struct {
+	Type         string `yaml:"Type"`
+	TimestampKey string `yaml:"TimestampKey"`
+	LevelKey     string `yaml:"LevelKey"`
+	MessageKey   string `yaml:"MessageKey"`
+}
+
+// Returns the parser configuration with defaults applied to unset fields
+func (config ParserConfig) WithDefaults() ParserConfig {
+	if config.Type == "" {
+		config.Type = defaultParserType
+	}
+	if config.TimestampKey == "" {
+		config.TimestampKey = "timestamp"
+	}
+	if config.LevelKey == "" {
+		config.LevelKey = "level"
+	}
+	if config.MessageKey == "" {
+		config.MessageKey = "message"
+	}
+	return config
+}
+
+func (config ParserConfig) validate() error {
+	if !stringInSlice(config.WithDefaults().Type, supportedParserTypes) {
+		return errors.New(fmt.Sprintf("Unsupported parser type '%s', expected one of %v", config.Type, supportedParserTypes))
+	}
+	return nil
+}
+
+// Parser parses the text of a line into fields, returning an error if the line cannot be parsed.
+// Fields returns the names of the fields the parser may produce, if known in advance, and Types the types of
+// the fields converted to typed values.
+type Parser interface {
+	Parse(text string) (map[string]string, error)
+	Fields() []string
+	Types() map[string]FieldType
+}
+
+// RegexParser parses lines with a compiled log pattern, each named group of the pattern holding a field
+type RegexParser struct {
+	Regex  *regexp.Regexp
+	names  []string
+	fields []string
+	types  map[string]FieldType
+}
+
+// Creates a parser from a regex, each named group holding the field of the same name
+func NewRegexParser(re *regexp.Regexp) *RegexParser {
+	return newRegexParser(re, nil, nil)
+}
+
+// Creates a parser from a regex, groups maps generated group names to field names, types maps fields to their type
+func newRegexParser(re *regexp.Regexp, groups map[string]string, types map[string]FieldType) *RegexParser {
+	p := RegexParser{Regex: re, types: types}
+	p.names = make([]string, len(re.SubexpNames()))
+	for i, name := range re.SubexpNames() {
+		if field, ok := groups[name]; ok {
+			name = field
+		}
+		p.names[i] = name
+		if name != "" && !stringInSlice(name, p.fields) {
+			p.fields = append(p.fields, name)
+		}
+	}
+	return &p
+}
+
+// Parses a line into its fields, a field captured by several groups holds the first non empty capture
+func (p *RegexParser) Parse(text string) (map[string]string, error) {
+	match := p.Regex.FindStringSubmatch(text)
+	if match == nil {
+		return make(map[string]string), errors.New("No match found in line, returning empty map")
+	}
+	fields := make(map[string]string)
+	for i, name := range p.names {
+		if i > 0 && name != "" && fields[name] == "" {
+			fields[name] = match[i]
+		}
+	}
+	return fields, nil
+}
+
+func (p *RegexParser) Fields() []string {
+	return p.fields
+}
+
+func (p *RegexParser) Types() map[string]FieldType {
+	return p.types
+}
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
-	"regexp"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/dimpogissou/isengard-server/logger"
 	"gopkg.in/yaml.v2"
@@ -14,26 +16,69 @@ import (
 var supportedConnectors = []string{"s3", "rollbar", "kafka"}
 var supportedLevels = []string{"DEBUG", "INFO", "WARNING", "WARN", "ERROR"}
 
+// Level aliases mapped to their canonical level
+var levelAliases = map[string]string{
+	"DBUG":        "DEBUG",
+	"TRCE":        "DEBUG",
+	"TRACE":       "DEBUG",
+	"INF":         "INFO",
+	"INFORMATION": "INFO",
+	"NOTICE":      "INFO",
+	"WAR":         "WARNING",
+	"WARN":        "WARNING",
+	"ER":          "ERROR",
+	"ERR":         "ERROR",
+	"EROR":        "ERROR",
+	"CRI":         "ERROR",
+	"CRIT":        "ERROR",
+	"CRITICAL":    "ERROR",
+	"FATAL":       "ERROR",
+	"SEVERE":      "ERROR",
+	"ALERT":       "ERROR",
+	"EMERG":       "ERROR",
+	"EMERGENCY":   "ERROR",
+}
+
+const defaultCheckpointInterval = 5 * time.Second
+const defaultReportInterval = time.Minute
+
 // YAML configuration structs
 type YamlConfig struct {
-	ConfigName        string                   `yaml:"ConfigName"`
-	Directory         string                   `yaml:"Directory"`
-	LogPattern        string                   `yaml:"LogPattern"`
-	Definitions       []PatternConfig          `yaml:"Definitions"`
-	S3Connectors      []S3ConnectorConfig      `yaml:"S3Connectors"`
-	RollbarConnectors []RollbarConnectorConfig `yaml:"RollbarConnectors"`
-	KafkaConnectors   []KafkaConnectorConfig   `yaml:"KafkaConnectors"`
+	ConfigName         string                   `yaml:"ConfigName"`
+	Inputs             []InputConfig            `yaml:"Inputs"`
+	Directory          string                   `yaml:"Directory"`
+	Files              FilesConfig              `yaml:"Files"`
+	CheckpointFile     string                   `yaml:"CheckpointFile"`
+	CheckpointInterval time.Duration            `yaml:"CheckpointInterval"`
+	ReportInterval     time.Duration            `yaml:"ReportInterval"`
+	Parser             ParserConfig             `yaml:"Parser"`
+	LogPattern         string                   `yaml:"LogPattern"`
+	Definitions        []PatternConfig          `yaml:"Definitions"`
+	Multiline          MultilineConfig          `yaml:"Multiline"`
+	Unmatched          UnmatchedConfig          `yaml:"Unmatched"`
+	Processors         []ProcessorConfig        `yaml:"Processors"`
+	S3Connectors       []S3ConnectorConfig      `yaml:"S3Connectors"`
+	RollbarConnectors  []RollbarConnectorConfig `yaml:"RollbarConnectors"`
+	KafkaConnectors    []KafkaConnectorConfig   `yaml:"KafkaConnectors"`
 }
 
+// Pattern definition, referenced as %{Name} in log patterns and other definitions. Fields capturing the definition,
+// as %{Name:field} or (?P<field>%{Name}), are converted to Type. Timestamps are parsed with a Go Layout
+// or a strftime Format in Timezone, UTC by default, and the timestamp field gives the time of events.
 type PatternConfig struct {
-	Name    string `yaml:"Name"`
-	Pattern string `yaml:"Pattern"`
+	Name     string `yaml:"Name"`
+	Pattern  string `yaml:"Pattern"`
+	Type     string `yaml:"Type"`
+	Layout   string `yaml:"Layout"`
+	Format   string `yaml:"Format"`
+	Timezone string `yaml:"Timezone"`
 }
 
 type ConnectorConfig interface {
 	getName() string
 	getType() string
 	getLevels() []string
+	getDelivery() DeliveryConfig
 	validate() error
 }
 
@@ -57,25 +102,42 @@ func getConnectorsConfigs(cfg YamlConfig) []ConnectorConfig {
 // Runs complete configuration validation steps and returns eventual errors
 func validateConfig(cfg YamlConfig) error {
 
-	// If Directory is nil, try to retrieve from env var, if not then error
-	if cfg.Directory == "" {
-		return errors.New("Did not find logs directory in YAML configuration")
-	}
+	// Without inputs, the top-level Directory and LogPattern define the only input
+	if len(cfg.Inputs) == 0 {
+		// If Directory is nil, try to retrieve from env var, if not then error
+		if cfg.Directory == "" {
+			return errors.New("Did not find logs directory in YAML configuration")
+		}
 
-	// If Directory resolved, check if directory exists, if not then error
-	if _, err := os.Stat(cfg.Directory); os.IsNotExist(err) {
-		return errors.New(fmt.Sprintf("Resolved logs directory %s does not exist, exiting", cfg.Directory))
+		// If Directory resolved, check if directory exists, if not then error
+		if _, err := os.Stat(cfg.Directory); os.IsNotExist(err) {
+			return errors.New(fmt.Sprintf("Resolved logs directory %s does not exist, exiting", cfg.Directory))
+		}
 	}
 
 	// If Name or LogPattern missing, error
 	if cfg.ConfigName == "" {
 		return errors.New("YAML configuration missing required 'ConfigName' key, exiting")
-	} else if cfg.LogPattern == "" {
+	} else if len(cfg.Inputs) == 0 && cfg.LogPattern == "" && cfg.Parser.WithDefaults().Type == defaultParserType {
 		return errors.New("YAML configuration missing required 'LogPattern' key, exiting")
 	}
 
+	// If CheckpointFile provided, check its parent directory exists
+	if cfg.CheckpointFile != "" {
+		if _, err := os.Stat(filepath.Dir(cfg.CheckpointFile)); os.IsNotExist(err) {
+			return errors.New(fmt.Sprintf("Directory of checkpoint file %s does not exist, exiting", cfg.CheckpointFile))
+		}
+	}
+	if cfg.CheckpointInterval < 0 {
+		return errors.New(fmt.Sprintf("Invalid negative CheckpointInterval: %v", cfg.CheckpointInterval))
+	}
+	if cfg.ReportInterval < 0 {
+		return errors.New(fmt.Sprintf("Invalid negative ReportInterval: %v", cfg.ReportInterval))
+	}
+
 	connectorsConfigs := getConnectorsConfigs(cfg)
 
+	names := []string{}
 	for _, connCfg := range connectorsConfigs {
 		// Assert connectors have valid common fields values
 		err := validateConnectorsCommonFields(connCfg)
@@ -87,6 +149,31 @@ func validateConfig(cfg YamlConfig) error {
 		if err != nil {
 			return err
 		}
+		// Assert connector names are unique, they identify connectors queues on disk
+		if stringInSlice(connCfg.getName(), names) {
+			return errors.New(fmt.Sprintf("Duplicate connector name: %s", connCfg.getName()))
+		}
+		names = append(names, connCfg.getName())
+	}
+
+	// Assert inputs are valid, uniquely named and route to existing connectors
+	inputNames := []string{}
+	for _, input := range cfg.GetInputs() {
+		if err := input.validate(names); err != nil {
+			return err
+		}
+		if stringInSlice(input.Name, inputNames) {
+			return errors.New(fmt.Sprintf("Duplicate input name: %s", input.Name))
+		}
+		inputNames = append(inputNames, input.Name)
+	}
+
+	// Assert dead letter connectors reference other existing connectors
+	for _, connCfg := range connectorsConfigs {
+		deadLetter := connCfg.getDelivery().DeadLetter.Connector
+		if deadLetter != "" && (deadLetter == connCfg.getName() || !stringInSlice(deadLetter, names)) {
+			return errors.New(fmt.Sprintf("Invalid dead letter connector '%s' for connector %s", deadLetter, connCfg.getName()))
+		}
 	}
 
 	return nil
@@ -102,7 +189,7 @@ func missingFields(fields ...string) bool {
 	return false
 }
 
-// Validates common fields for all monitors: Name, Type, Levels
+// Validates common fields for all monitors: Name, Type, Levels, Delivery
 func validateConnectorsCommonFields(connector ConnectorConfig) error {
 
 	if missingFields(connector.getName(), connector.getType()) {
@@ -116,6 +203,9 @@ func validateConnectorsCommonFields(connector ConnectorConfig) error {
 			return errors.New(fmt.Sprintf("Invalid value for logging level: %s", level))
 		}
 	}
+	if err := connector.getDelivery().validate(); err != nil {
+		return errors.New(fmt.Sprintf("Invalid delivery config for connector %s: %s", connector.getName(), err))
+	}
 	return nil
 }
 
@@ -139,21 +229,29 @@ func readConfig(path string) YamlConfig {
 	return conf
 }
 
-// Builds Regex specified in configuration
-func BuildRegex(cfg YamlConfig) *regexp.Regexp {
-
-	// Create subPatterns slice from cfg.Definitions
-	subPatterns := make([]interface{}, len(cfg.Definitions))
-	for i, def := range cfg.Definitions {
-		subPatterns[i] = def.Pattern
+// Builds the parser of an input. The regex parser compiles its log pattern in which %{Name} references are
+// replaced by its definitions or grok patterns, and grok captures %{Name:field:type} by named groups
+func BuildInputParser(input InputConfig) (Parser, error) {
+	if err := input.Parser.validate(); err != nil {
+		return nil, err
 	}
+	switch input.Parser.WithDefaults().Type {
+	case "json":
+		return NewJSONParser(input.Parser), nil
+	case "logfmt":
+		return NewLogfmtParser(input.Parser), nil
+	}
+	return compilePattern(input.LogPattern, input.Definitions)
+}
 
-	// Interpolate subpatterns in main pattern, compile regex
-	pattern := fmt.Sprintf(cfg.LogPattern, subPatterns...)
-	regex := regexp.MustCompile(pattern)
-
-	return regex
-
+// Returns the canonical form of a logging level, expanding the aliases and abbreviations written by loggers
+// and matched by %{LOGLEVEL}, such as warn, eror, crit or information
+func NormaliseLevel(level string) string {
+	level = strings.ToUpper(strings.TrimSpace(level))
+	if canonical, ok := levelAliases[level]; ok {
+		return canonical
+	}
+	return level
 }
 
 func stringInSlice(a string, list []string) bool {
@@ -169,6 +267,12 @@ func stringInSlice(a string, list []string) bool {
 func ValidateAndLoadConfig(path *string) YamlConfig {
 
 	cfg := readConfig(*path)
+	if cfg.CheckpointInterval == 0 {
+		cfg.CheckpointInterval = defaultCheckpointInterval
+	}
+	if cfg.ReportInterval == 0 {
+		cfg.ReportInterval = defaultReportInterval
+	}
 	err := validateConfig(cfg)
 	logger.CheckErrAndPanic(err, "FailedValidatingConfigFile", fmt.Sprintf("Configuration file validation failed for %s", *path))
 
@@ -2,7 +2,9 @@ package config
 
 import (
 	"errors"
+	"fmt"
 	"testing"
+	"time"
 )
 
 // Tests that a valid configuration doesn't return any error at validation
@@ -16,22 +18,129 @@ func TestValidS3Config(t *testing.T) {
 	}
 }
 
+// Tests that a configuration with inputs routing to shared connectors doesn't return any error at validation
+func TestValidInputsConfig(t *testing.T) {
+
+	var connectors = []S3ConnectorConfig{S3ConnectorConfig{Name: "archive", Type: "s3", Endpoint: "someEndpoint", KeyPrefix: "prefix", Bucket: "bucket", Region: "region"}}
+	var inputs = []InputConfig{
+		InputConfig{Name: "api", Directory: "./", LogPattern: "something", Tags: []string{"api"}, Connectors: []string{"archive"}},
+		InputConfig{Name: "web", Directory: "./", LogPattern: "something else", Connectors: []string{"archive"}},
+		InputConfig{Name: "worker", Directory: "./", Parser: ParserConfig{Type: "json", LevelKey: "severity"}, Unmatched: UnmatchedConfig{Policy: "connector", Connector: "archive"}},
+	}
+	var validConfig = YamlConfig{ConfigName: "something", Inputs: inputs, S3Connectors: connectors}
+	got := validateConfig(validConfig)
+	if got != nil {
+		t.Errorf("validateConfig(%v) == %v, want %v", validConfig, got, nil)
+	}
+}
+
 // Tests various invalid configuration cases and asserts over the error returned
 func TestInvalidConfig(t *testing.T) {
 
 	var unsupportedTypeConnector = []S3ConnectorConfig{S3ConnectorConfig{Name: "somename", Type: "wrongType", Endpoint: "someEndpoint", KeyPrefix: "prefix", Bucket: "bucket", Region: "region", Levels: []string{"INFO", "WARNING"}}}
 	var unsupportedLevelConnector = []S3ConnectorConfig{S3ConnectorConfig{Name: "somename", Type: "s3", Endpoint: "someEndpoint", KeyPrefix: "prefix", Bucket: "bucket", Region: "region", Levels: []string{"INFO", "INVALID"}}}
+	var invalidQueueConnector = []S3ConnectorConfig{S3ConnectorConfig{Name: "somename", Type: "s3", Endpoint: "someEndpoint", KeyPrefix: "prefix", Bucket: "bucket", Region: "region", Delivery: DeliveryConfig{Queue: QueueConfig{Directory: "./", Fsync: "sometimes"}}}}
+	var invalidJitterConnector = []S3ConnectorConfig{S3ConnectorConfig{Name: "somename", Type: "s3", Endpoint: "someEndpoint", KeyPrefix: "prefix", Bucket: "bucket", Region: "region", Delivery: DeliveryConfig{Retry: RetryConfig{Jitter: 2}}}}
+	var unknownDeadLetterConnector = []S3ConnectorConfig{S3ConnectorConfig{Name: "somename", Type: "s3", Endpoint: "someEndpoint", KeyPrefix: "prefix", Bucket: "bucket", Region: "region", Delivery: DeliveryConfig{DeadLetter: DeadLetterConfig{Connector: "unknown"}}}}
+	var negativeSpillMaxSizeConnector = []S3ConnectorConfig{S3ConnectorConfig{Name: "somename", Type: "s3", Endpoint: "someEndpoint", KeyPrefix: "prefix", Bucket: "bucket", Region: "region", Delivery: DeliveryConfig{Buffer: BufferConfig{Overflow: "spill", SpillDirectory: "./", SpillMaxSize: -1}}}}
+	var spillWithoutDirectoryConnector = []S3ConnectorConfig{S3ConnectorConfig{Name: "somename", Type: "s3", Endpoint: "someEndpoint", KeyPrefix: "prefix", Bucket: "bucket", Region: "region", Delivery: DeliveryConfig{Buffer: BufferConfig{Overflow: "spill"}}}}
+	var invalidBatchFormatConnector = []S3ConnectorConfig{S3ConnectorConfig{Name: "somename", Type: "s3", Endpoint: "someEndpoint", KeyPrefix: "prefix", Bucket: "bucket", Region: "region", Batch: S3BatchConfig{Format: "csv"}}}
+	var overwritingKeyTemplateConnector = []S3ConnectorConfig{S3ConnectorConfig{Name: "somename", Type: "s3", Endpoint: "someEndpoint", KeyTemplate: "app/{level}.log", Bucket: "bucket", Region: "region"}}
+	var perLineKeyTemplateConnector = []S3ConnectorConfig{S3ConnectorConfig{Name: "somename", Type: "s3", Endpoint: "someEndpoint", KeyTemplate: "app/{offset}-{uuid}.log", Bucket: "bucket", Region: "region"}}
+	var invalidKeyTemplateConnector = []S3ConnectorConfig{S3ConnectorConfig{Name: "somename", Type: "s3", Endpoint: "someEndpoint", KeyTemplate: "app/dt={ts}/{uuid}", Bucket: "bucket", Region: "region"}}
+	var kmsKeyWithoutKmsConnector = []S3ConnectorConfig{S3ConnectorConfig{Name: "somename", Type: "s3", Endpoint: "someEndpoint", KeyPrefix: "prefix", Bucket: "bucket", Region: "region", Object: S3ObjectConfig{ServerSideEncryption: "AES256", KMSKeyId: "key"}}}
+	var invalidACLConnector = []S3ConnectorConfig{S3ConnectorConfig{Name: "somename", Type: "s3", Endpoint: "someEndpoint", KeyPrefix: "prefix", Bucket: "bucket", Region: "region", Object: S3ObjectConfig{ACL: "public"}}}
+	var missingTokenRollbarConnector = []RollbarConnectorConfig{RollbarConnectorConfig{Name: "somename", Type: "rollbar", AccessTokenEnv: "ISENGARD_TEST_UNSET_TOKEN"}}
+	var invalidFallbackLevelRollbarConnector = []RollbarConnectorConfig{RollbarConnectorConfig{Name: "somename", Type: "rollbar", AccessToken: "token", FallbackLevel: "WARN"}}
+	var invalidUrlRollbarConnector = []RollbarConnectorConfig{RollbarConnectorConfig{Name: "somename", Type: "rollbar", Url: "www.rollbar.com/something", AccessToken: "token"}}
+	var invalidAcksKafkaConnector = []KafkaConnectorConfig{KafkaConnectorConfig{Name: "somename", Type: "kafka", Host: "host", Port: "9092", Topic: "topic", RequiredAcks: "most"}}
+	var fieldBalancerWithoutFieldKafkaConnector = []KafkaConnectorConfig{KafkaConnectorConfig{Name: "somename", Type: "kafka", Host: "host", Port: "9092", Topic: "topic", Balancer: "field"}}
+	var missingPasswordKafkaConnector = []KafkaConnectorConfig{KafkaConnectorConfig{Name: "somename", Type: "kafka", Brokers: []string{"broker:9092"}, Topic: "topic", SASL: KafkaSASLConfig{Mechanism: "SCRAM-SHA-512", Username: "user"}}}
+	var certWithoutKeyKafkaConnector = []KafkaConnectorConfig{KafkaConnectorConfig{Name: "somename", Type: "kafka", Brokers: []string{"broker:9092"}, Topic: "topic", TLS: KafkaTLSConfig{Enabled: true, CertFile: "cert.pem"}}}
+	var invalidCodecKafkaConnector = []KafkaConnectorConfig{KafkaConnectorConfig{Name: "somename", Type: "kafka", Brokers: []string{"broker:9092"}, Topic: "topic", Codec: "xml"}}
+	var avroWithoutRegistryKafkaConnector = []KafkaConnectorConfig{KafkaConnectorConfig{Name: "somename", Type: "kafka", Brokers: []string{"broker:9092"}, Topic: "topic", Codec: "avro"}}
+	var unknownConnectorInputs = []InputConfig{InputConfig{Name: "api", Directory: "./", LogPattern: "something", Connectors: []string{"missing"}}}
+	var duplicateNameInputs = []InputConfig{InputConfig{Name: "api", Directory: "./", LogPattern: "something"}, InputConfig{Name: "api", Directory: "./", LogPattern: "something"}}
+	var unknownDefinitionInputs = []InputConfig{InputConfig{Name: "api", Directory: "./", LogPattern: "^(?P<level>%{Level})", Definitions: []PatternConfig{{Name: "Level", Pattern: "%{Severity}"}}}}
+	var definitionCycleInputs = []InputConfig{InputConfig{Name: "api", Directory: "./", LogPattern: "^%{A}", Definitions: []PatternConfig{{Name: "A", Pattern: "a%{B}"}, {Name: "B", Pattern: "b%{A}"}}}}
+	var invalidDefinitionInputs = []InputConfig{InputConfig{Name: "api", Directory: "./", LogPattern: "^%{Date} %{Message}", Definitions: []PatternConfig{{Name: "Date", Pattern: "%{YEAR}-\\d{2"}, {Name: "Message", Pattern: "(.*"}}}}
+	var duplicateDefinitionInputs = []InputConfig{InputConfig{Name: "api", Directory: "./", LogPattern: "^%{Date}", Definitions: []PatternConfig{{Name: "Date", Pattern: "\\d+"}, {Name: "Date", Pattern: "\\w+"}}}}
+	var unsupportedTypeInputs = []InputConfig{InputConfig{Name: "api", Directory: "./", LogPattern: "^%{NUMBER:code:long}"}}
+	var unsupportedParserInputs = []InputConfig{InputConfig{Name: "api", Directory: "./", Parser: ParserConfig{Type: "xml"}}}
+	var jsonMultilineInputs = []InputConfig{InputConfig{Name: "api", Directory: "./", Parser: ParserConfig{Type: "json"}, Multiline: MultilineConfig{Enabled: true}}}
+	var unsupportedDefinitionTypeInputs = []InputConfig{InputConfig{Name: "api", Directory: "./", LogPattern: "^%{Date:date}", Definitions: []PatternConfig{{Name: "Date", Pattern: "\\S+", Type: "date"}}}}
+	var layoutWithoutTimestampInputs = []InputConfig{InputConfig{Name: "api", Directory: "./", LogPattern: "^%{Code:code}", Definitions: []PatternConfig{{Name: "Code", Pattern: "\\d+", Type: "int", Layout: "2006"}}}}
+	var invalidFormatInputs = []InputConfig{InputConfig{Name: "api", Directory: "./", LogPattern: "^%{Date:date}", Definitions: []PatternConfig{{Name: "Date", Pattern: "\\S+", Type: "timestamp", Format: "%Y-%m-%Q"}}}}
+	var invalidTimezoneInputs = []InputConfig{InputConfig{Name: "api", Directory: "./", LogPattern: "^%{Date:date}", Definitions: []PatternConfig{{Name: "Date", Pattern: "\\S+", Type: "timestamp", Timezone: "Mars/Olympus"}}}}
+	var unsupportedUnmatchedInputs = []InputConfig{InputConfig{Name: "api", Directory: "./", LogPattern: "something", Unmatched: UnmatchedConfig{Policy: "retry"}}}
+	var missingUnmatchedConnectorInputs = []InputConfig{InputConfig{Name: "api", Directory: "./", LogPattern: "something", Unmatched: UnmatchedConfig{Policy: "connector"}}}
+	var unusedUnmatchedFileInputs = []InputConfig{InputConfig{Name: "api", Directory: "./", LogPattern: "something", Unmatched: UnmatchedConfig{Policy: "drop", File: "./unmatched.ndjson"}}}
+	var unknownUnmatchedConnectorInputs = []InputConfig{InputConfig{Name: "api", Directory: "./", LogPattern: "something", Unmatched: UnmatchedConfig{Policy: "connector", Connector: "missing"}}}
+	var invalidUnmatchedFileInputs = []InputConfig{InputConfig{Name: "api", Directory: "./", LogPattern: "something", Unmatched: UnmatchedConfig{Policy: "file", File: "./non_existing_directory_123/unmatched.ndjson"}}}
+	var multipleActionsProcessorInputs = []InputConfig{InputConfig{Name: "api", Directory: "./", LogPattern: "something", Processors: []ProcessorConfig{{Tags: []string{"api"}}, {Drop: []string{"pid"}, Hostname: "host"}}}}
+	var missingCopyFieldInputs = []InputConfig{InputConfig{Name: "api", Directory: "./", LogPattern: "something", Processors: []ProcessorConfig{{Copy: &CopyConfig{From: "message"}}}}}
+	var invalidCopyPatternInputs = []InputConfig{InputConfig{Name: "api", Directory: "./", LogPattern: "something", Processors: []ProcessorConfig{{Copy: &CopyConfig{From: "message", To: "short", Pattern: "(.{0,20}"}}}}}
+	var emptyRenameInputs = []InputConfig{InputConfig{Name: "api", Directory: "./", LogPattern: "something", Processors: []ProcessorConfig{{Rename: map[string]string{"msg": ""}}}}}
+	var duplicateNameConnectors = []S3ConnectorConfig{S3ConnectorConfig{Name: "somename", Type: "s3", Endpoint: "someEndpoint", KeyPrefix: "prefix", Bucket: "bucket", Region: "region"}, S3ConnectorConfig{Name: "somename", Type: "s3", Endpoint: "someEndpoint", KeyPrefix: "prefix", Bucket: "bucket", Region: "region"}}
 
 	cases := []struct {
 		in   YamlConfig
 		want error
 	}{
-		{YamlConfig{Directory: ""}, errors.New("Did not find logs directory in YAML configuration")},                                                                                     // Config with empty directory
-		{YamlConfig{Directory: "./non_existing_directory_123"}, errors.New("Resolved logs directory ./non_existing_directory_123 does not exist, exiting")},                              // Non existing directory
-		{YamlConfig{Directory: "./", ConfigName: ""}, errors.New("YAML configuration missing required 'ConfigName' key, exiting")},                                                       // Missing ConfigName
-		{YamlConfig{Directory: "./", ConfigName: "something", LogPattern: ""}, errors.New("YAML configuration missing required 'LogPattern' key, exiting")},                              // Missing LogPattern
-		{YamlConfig{Directory: "./", ConfigName: "something", LogPattern: "something", S3Connectors: unsupportedTypeConnector}, errors.New("Invalid connector type: wrongType")},         // Unsupported Connector Type
-		{YamlConfig{Directory: "./", ConfigName: "something", LogPattern: "something", S3Connectors: unsupportedLevelConnector}, errors.New("Invalid value for logging level: INVALID")}, // Unsupported Connector Level
+		{YamlConfig{Directory: ""}, errors.New("Did not find logs directory in YAML configuration")},                                                                                                                                                          // Config with empty directory
+		{YamlConfig{Directory: "./non_existing_directory_123"}, errors.New("Resolved logs directory ./non_existing_directory_123 does not exist, exiting")},                                                                                                   // Non existing directory
+		{YamlConfig{Directory: "./", ConfigName: ""}, errors.New("YAML configuration missing required 'ConfigName' key, exiting")},                                                                                                                            // Missing ConfigName
+		{YamlConfig{Directory: "./", ConfigName: "something", LogPattern: ""}, errors.New("YAML configuration missing required 'LogPattern' key, exiting")},                                                                                                   // Missing LogPattern
+		{YamlConfig{Directory: "./", ConfigName: "something", LogPattern: "something", S3Connectors: unsupportedTypeConnector}, errors.New("Invalid connector type: wrongType")},                                                                              // Unsupported Connector Type
+		{YamlConfig{Directory: "./", ConfigName: "something", LogPattern: "something", S3Connectors: unsupportedLevelConnector}, errors.New("Invalid value for logging level: INVALID")},                                                                      // Unsupported Connector Level
+		{YamlConfig{Directory: "./", ConfigName: "something", LogPattern: "something", S3Connectors: invalidQueueConnector}, errors.New("Invalid delivery config for connector somename: Invalid queue fsync policy: sometimes")},                             // Unsupported queue fsync policy
+		{YamlConfig{Directory: "./", ConfigName: "something", LogPattern: "something", S3Connectors: invalidJitterConnector}, errors.New("Invalid delivery config for connector somename: Retry jitter must be between 0 and 1, got 2")},                      // Out of range retry jitter
+		{YamlConfig{Directory: "./", ConfigName: "something", LogPattern: "something", S3Connectors: unknownDeadLetterConnector}, errors.New("Invalid dead letter connector 'unknown' for connector somename")},                                               // Unknown dead letter connector
+		{YamlConfig{Directory: "./", ConfigName: "something", LogPattern: "something", S3Connectors: spillWithoutDirectoryConnector}, errors.New("Invalid delivery config for connector somename: Buffer overflow policy 'spill' requires a SpillDirectory")}, // Spill without directory
+		{YamlConfig{Directory: "./", ConfigName: "something", LogPattern: "something", S3Connectors: negativeSpillMaxSizeConnector}, errors.New("Invalid delivery config for connector somename: Invalid negative buffer spill max size: -1")},                // Negative spill max size
+		{YamlConfig{Directory: "./", ConfigName: "something", LogPattern: "something", ReportInterval: -1}, errors.New("Invalid negative ReportInterval: -1ns")},                                                                                              // Negative report interval
+		{YamlConfig{Directory: "./", ConfigName: "something", LogPattern: "something", S3Connectors: invalidBatchFormatConnector}, errors.New("Invalid batch format in S3 connector config 'somename': csv")},
+		{YamlConfig{Directory: "./", ConfigName: "something", LogPattern: "something", S3Connectors: invalidKeyTemplateConnector}, errors.New("Invalid key template in S3 connector config 'somename': Placeholder '{ts}' requires a time layout in template 'app/dt={ts}/{uuid}'")},
+		{YamlConfig{Directory: "./", ConfigName: "something", LogPattern: "something", S3Connectors: overwritingKeyTemplateConnector}, errors.New("Key template in S3 connector config 'somename' requires a {uuid} or {now} placeholder: app/{level}.log")},
+		{YamlConfig{Directory: "./", ConfigName: "something", LogPattern: "something", S3Connectors: perLineKeyTemplateConnector}, errors.New("Key template in S3 connector config 'somename' cannot use the per-line {offset} and {hash} placeholders: app/{offset}-{uuid}.log")},
+		{YamlConfig{Directory: "./", ConfigName: "something", LogPattern: "something", S3Connectors: kmsKeyWithoutKmsConnector}, errors.New("Invalid object settings in S3 connector config 'somename': KMSKeyId requires server side encryption 'aws:kms'")},
+		{YamlConfig{Directory: "./", ConfigName: "something", LogPattern: "something", S3Connectors: invalidACLConnector}, errors.New("Invalid object settings in S3 connector config 'somename': Invalid ACL: public")},
+		{YamlConfig{Directory: "./", ConfigName: "something", LogPattern: "something", RollbarConnectors: missingTokenRollbarConnector}, errors.New("Missing access token in Rollbar connector config 'somename': set AccessToken or the ISENGARD_TEST_UNSET_TOKEN environment variable")},
+		{YamlConfig{Directory: "./", ConfigName: "something", LogPattern: "something", RollbarConnectors: invalidUrlRollbarConnector}, errors.New("Invalid url in Rollbar connector config 'somename': www.rollbar.com/something")},
+		{YamlConfig{Directory: "./", ConfigName: "something", LogPattern: "something", RollbarConnectors: invalidFallbackLevelRollbarConnector}, errors.New("Invalid fallback level in Rollbar connector config 'somename': WARN")},
+		{YamlConfig{Directory: "./", ConfigName: "something", LogPattern: "something", KafkaConnectors: invalidAcksKafkaConnector}, errors.New("Invalid required acks in Kafka connector config 'somename': most")},
+		{YamlConfig{Directory: "./", ConfigName: "something", LogPattern: "something", KafkaConnectors: fieldBalancerWithoutFieldKafkaConnector}, errors.New("Balancer 'field' requires a PartitionField in Kafka connector config 'somename'")},
+		{YamlConfig{Directory: "./", ConfigName: "something", LogPattern: "something", KafkaConnectors: missingPasswordKafkaConnector}, errors.New("Invalid SASL config in Kafka connector config 'somename': Missing username or password for SASL mechanism SCRAM-SHA-512")},
+		{YamlConfig{Directory: "./", ConfigName: "something", LogPattern: "something", KafkaConnectors: certWithoutKeyKafkaConnector}, errors.New("Invalid TLS config in Kafka connector config 'somename': CertFile and KeyFile must be set together")},
+		{YamlConfig{Directory: "./", ConfigName: "something", LogPattern: "something", KafkaConnectors: invalidCodecKafkaConnector}, errors.New("Invalid codec in Kafka connector config 'somename': xml")},
+		{YamlConfig{Directory: "./", ConfigName: "something", LogPattern: "something", KafkaConnectors: avroWithoutRegistryKafkaConnector}, errors.New("Codec 'avro' requires a SchemaRegistry Url in Kafka connector config 'somename'")},
+		{YamlConfig{Directory: "./", ConfigName: "something", LogPattern: "something", Files: FilesConfig{Include: []string{"*.log", "![a-"}}}, errors.New("Invalid input config 'default': Invalid file glob pattern: '[a-'")},
+		{YamlConfig{Directory: "./", ConfigName: "something", LogPattern: "something", Multiline: MultilineConfig{Enabled: true, StartPattern: "^[("}}, errors.New("Invalid input config 'default': Invalid multiline start pattern: error parsing regexp: missing closing ]: `[(`")},
+		{YamlConfig{ConfigName: "something", Inputs: []InputConfig{InputConfig{Name: "api", Directory: "./"}}}, errors.New("Missing field(s) in input config: name = api, directory = ./, logpattern = ")},
+		{YamlConfig{ConfigName: "something", Inputs: unknownConnectorInputs}, errors.New("Unknown connector 'missing' in input config 'api'")},
+		{YamlConfig{ConfigName: "something", Inputs: duplicateNameInputs}, errors.New("Duplicate input name: api")},
+		{YamlConfig{ConfigName: "something", Inputs: unknownDefinitionInputs}, errors.New("Invalid input config 'api': Unknown pattern definition 'Severity' referenced in definition 'Level'")},
+		{YamlConfig{ConfigName: "something", Inputs: definitionCycleInputs}, errors.New("Invalid input config 'api': Pattern definition cycle: A -> B -> A")},
+		{YamlConfig{ConfigName: "something", Inputs: invalidDefinitionInputs}, errors.New("Invalid input config 'api': Invalid pattern definition 'Message': error parsing regexp: missing closing ): `(.*`")},
+		{YamlConfig{ConfigName: "something", Inputs: duplicateDefinitionInputs}, errors.New("Invalid input config 'api': Duplicate pattern definition name: Date")},
+		{YamlConfig{ConfigName: "something", Inputs: unsupportedTypeInputs}, errors.New("Invalid input config 'api': Unsupported type 'long' for field 'code', expected one of [int float bool duration timestamp]")},
+		{YamlConfig{ConfigName: "something", Inputs: unsupportedParserInputs}, errors.New("Invalid input config 'api': Unsupported parser type 'xml', expected one of [regex json logfmt]")},
+		{YamlConfig{ConfigName: "something", Inputs: jsonMultilineInputs}, errors.New("Invalid input config 'api': Multiline start pattern required with parser type 'json'")},
+		{YamlConfig{ConfigName: "something", Inputs: unsupportedDefinitionTypeInputs}, errors.New("Invalid input config 'api': Unsupported type 'date' of pattern definition 'Date', expected one of [int float bool duration timestamp]")},
+		{YamlConfig{ConfigName: "something", Inputs: layoutWithoutTimestampInputs}, errors.New("Invalid input config 'api': Layout, format and timezone of pattern definition 'Code' require the timestamp type")},
+		{YamlConfig{ConfigName: "something", Inputs: invalidFormatInputs}, errors.New("Invalid input config 'api': Invalid format of pattern definition 'Date': Unsupported strftime directive '%Q' in '%Y-%m-%Q'")},
+		{YamlConfig{ConfigName: "something", Inputs: invalidTimezoneInputs}, errors.New("Invalid input config 'api': Invalid timezone of pattern definition 'Date': unknown time zone Mars/Olympus")},
+		{YamlConfig{ConfigName: "something", Inputs: unsupportedUnmatchedInputs}, errors.New("Invalid input config 'api': Unsupported unmatched policy 'retry', expected one of [forward drop connector file]")},
+		{YamlConfig{ConfigName: "something", Inputs: missingUnmatchedConnectorInputs}, errors.New("Invalid input config 'api': Missing connector for unmatched policy 'connector'")},
+		{YamlConfig{ConfigName: "something", Inputs: unusedUnmatchedFileInputs}, errors.New("Invalid input config 'api': Unmatched connector () or file (./unmatched.ndjson) not used by unmatched policy 'drop'")},
+		{YamlConfig{ConfigName: "something", Inputs: unknownUnmatchedConnectorInputs}, errors.New("Invalid input config 'api': Unknown unmatched connector 'missing'")},
+		{YamlConfig{ConfigName: "something", Inputs: invalidUnmatchedFileInputs}, errors.New("Invalid input config 'api': Directory of unmatched file ./non_existing_directory_123/unmatched.ndjson does not exist")},
+		{YamlConfig{ConfigName: "something", Inputs: multipleActionsProcessorInputs}, errors.New("Invalid input config 'api': Invalid processor 2: Processor must have exactly one of Rename, Drop, Add, Tags, Hostname, Source, Basename or Copy, found 2")},
+		{YamlConfig{ConfigName: "something", Inputs: missingCopyFieldInputs}, errors.New("Invalid input config 'api': Invalid processor 1: Missing field(s) in copy processor: from = message, to = ")},
+		{YamlConfig{ConfigName: "something", Inputs: invalidCopyPatternInputs}, errors.New("Invalid input config 'api': Invalid processor 1: Invalid copy processor pattern: error parsing regexp: missing closing ): `(.{0,20}`")},
+		{YamlConfig{ConfigName: "something", Inputs: emptyRenameInputs}, errors.New("Invalid input config 'api': Invalid processor 1: Invalid empty field name in rename processor: 'msg' to ''")},
+		{YamlConfig{Directory: "./", ConfigName: "something", LogPattern: "(unclosed"}, errors.New("Invalid input config 'default': Invalid log pattern '(unclosed': error parsing regexp: missing closing ): `(unclosed`")},
+		{YamlConfig{Directory: "./", ConfigName: "something", LogPattern: "something", S3Connectors: duplicateNameConnectors}, errors.New("Duplicate connector name: somename")}, // Duplicate connector names
 	}
 	for _, c := range cases {
 		got := validateConfig(c.in)
@@ -40,3 +149,220 @@ func TestInvalidConfig(t *testing.T) {
 		}
 	}
 }
+
+// Asserts named references are replaced by definitions regardless of their order, nested definitions and library patterns
+func TestBuildInputParser(t *testing.T) {
+
+	definitions := []PatternConfig{
+		{Name: "Message", Pattern: ".*"},
+		{Name: "Date", Pattern: "\\d{4}-\\d{2}-\\d{2}"},
+		{Name: "Timestamp", Pattern: "%{Date} \\d{2}:\\d{2}"},
+		{Name: "Level", Pattern: "ERROR|INFO"},
+	}
+	cases := []struct {
+		pattern string
+		line    string
+		want    string
+	}{
+		{"^\\[(?P<timestamp>%{Timestamp})\\]\\[(?P<level>%{Level})\\] (?P<message>%{Message})", "[2020-10-07 20:56][ERROR] Failed", "map[level:ERROR message:Failed timestamp:2020-10-07 20:56]"},
+		{"^(?P<client>%{IPORHOST}) (?P<method>%{HTTPMETHOD}) (?P<path>%{URIPATHPARAM}) (?P<status>%{INT})", "10.0.0.1 GET /health?full=1 200", "map[client:10.0.0.1 method:GET path:/health?full=1 status:200]"},
+		{"^(?P<timestamp>%{TIMESTAMP_ISO8601}) (?P<level>%{LOGLEVEL})", "2020-10-07T20:56:47.375Z warn", "map[level:warn timestamp:2020-10-07T20:56:47.375Z]"},
+		{"^(?P<date>%s) (?P<level>%s)", "2020-10-07 ERROR", "map[date:2020-10-07 level:ERROR]"},
+	}
+	legacyDefinitions := []PatternConfig{{Name: "Date", Pattern: "\\d{4}-\\d{2}-\\d{2}"}, {Name: "Level", Pattern: "ERROR|INFO"}}
+	for i, c := range cases {
+		input := InputConfig{LogPattern: c.pattern, Definitions: definitions}
+		if i == len(cases)-1 {
+			input.Definitions = legacyDefinitions
+		}
+		parser, err := BuildInputParser(input)
+		if err != nil {
+			t.Fatalf("BuildInputParser(%s) failed: %v", c.pattern, err)
+		}
+		fields, err := parser.Parse(c.line)
+		if got := fmt.Sprint(fields); err != nil || got != c.want {
+			t.Errorf("Parse(%s) with %s == %s, %v, want %s", c.line, c.pattern, got, err, c.want)
+		}
+	}
+}
+
+// Asserts every grok pattern compiles and standard grok expressions parse lines into their captures and typed values
+func TestGrokPatterns(t *testing.T) {
+
+	for name := range grokPatterns {
+		if _, err := compilePattern("%{"+name+"}", nil); err != nil {
+			t.Errorf("Grok pattern %s does not compile: %v", name, err)
+		}
+	}
+
+	cases := []struct {
+		pattern    string
+		line       string
+		wantFields string
+		wantValues string
+	}{
+		{"%{TIMESTAMP_ISO8601:timestamp} %{LOGLEVEL:level} \\[%{DATA:thread}\\] %{GREEDYDATA:message}", "2020-10-07T20:56:47+02:00 WARN [main] Disk almost full",
+			"map[level:WARN message:Disk almost full thread:main timestamp:2020-10-07T20:56:47+02:00]", "map[]"},
+		{"%{COMBINEDAPACHELOG}", `127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08"`,
+			`map[agent:"Mozilla/4.08" auth:frank bytes:2326 clientip:127.0.0.1 httpversion:1.0 ident:- rawrequest: referrer:"http://www.example.com/start.html" request:/apache_pb.gif response:200 timestamp:10/Oct/2000:13:55:36 -0700 verb:GET]`, "map[]"},
+		{"^%{IP:[client][ip]} %{NUMBER:code:int} %{NUMBER:latency:float} (?<user>\\w+)", "2001:db8::1 404 0.25 alice",
+			"map[client.ip:2001:db8::1 code:404 latency:0.25 user:alice]", "map[code:404 latency:0.25]"},
+		{"^%{WORD:status:int}", "failed", "map[status:failed]", "map[]"},
+	}
+	for _, c := range cases {
+		parser, err := BuildInputParser(InputConfig{LogPattern: c.pattern})
+		if err != nil {
+			t.Fatalf("BuildInputParser(%s) failed: %v", c.pattern, err)
+		}
+		fields, err := parser.Parse(c.line)
+		if got := fmt.Sprint(fields); err != nil || got != c.wantFields {
+			t.Errorf("Parse(%s) with %s == %s, %v, want %s", c.line, c.pattern, got, err, c.wantFields)
+		}
+		values, _ := ConvertFields(fields, parser.Types())
+		if got := fmt.Sprint(values); got != c.wantValues && !(len(values) == 0 && c.wantValues == "map[]") {
+			t.Errorf("ConvertFields(%v) with %s == %s, want %s", fields, c.pattern, got, c.wantValues)
+		}
+	}
+}
+
+// Asserts JSON lines are flattened to dotted fields with the timestamp, level and message keys mapped
+func TestJSONParser(t *testing.T) {
+
+	parser, err := BuildInputParser(InputConfig{Parser: ParserConfig{Type: "json", TimestampKey: "@timestamp", LevelKey: "log.level", MessageKey: "msg"}})
+	if err != nil {
+		t.Fatalf("BuildInputParser failed: %v", err)
+	}
+
+	cases := []struct {
+		line    string
+		want    string
+		wantErr bool
+	}{
+		{`{"@timestamp":"2020-10-07T20:56:47Z","log":{"level":"warn","logger":"main"},"msg":"Disk almost full"}`,
+			"map[level:WARNING log.logger:main message:Disk almost full timestamp:2020-10-07T20:56:47Z]", false},
+		{`{"log":{"level":"err"},"msg":"Connection refused"}`, "map[level:ERROR message:Connection refused]", false},
+		{`{"log":{"level":"Information"},"msg":"Started"}`, "map[level:INFO message:Started]", false},
+		{`{"msg":"done","http":{"status":200,"latency":0.25,"ok":true,"error":null},"ids":[1,2]}`,
+			"map[http.error: http.latency:0.25 http.ok:true http.status:200 ids:[1,2] message:done]", false},
+		{`[WARN] Not JSON`, "map[]", true},
+		{`null`, "map[]", true},
+	}
+	for _, c := range cases {
+		fields, err := parser.Parse(c.line)
+		if got := fmt.Sprint(fields); got != c.want || (err != nil) != c.wantErr {
+			t.Errorf("Parse(%s) == %s, %v, want %s", c.line, got, err, c.want)
+		}
+	}
+	if got := fmt.Sprint(parser.Fields()); got != "[level message timestamp]" {
+		t.Errorf("Fields() == %s, want [level message timestamp]", got)
+	}
+}
+
+// Asserts logfmt lines are split into their pairs, with quoted values unescaped and the level normalised
+func TestLogfmtParser(t *testing.T) {
+
+	parser, err := BuildInputParser(InputConfig{Parser: ParserConfig{Type: "logfmt", TimestampKey: "ts", MessageKey: "msg"}})
+	if err != nil {
+		t.Fatalf("BuildInputParser failed: %v", err)
+	}
+
+	cases := []struct {
+		line    string
+		want    string
+		wantErr bool
+	}{
+		{`ts=2020-10-07T20:56:47Z level=info msg="Request served" code=9`, "map[code:9 level:INFO message:Request served timestamp:2020-10-07T20:56:47Z]", false},
+		{`lvl=eror msg="quoted \"path\"\tC:\\logs" empty= flag`, `map[empty: flag: level:ERROR message:quoted "path"` + "\t" + `C:\logs]`, false},
+		{`severity=warn url=/health?full=1 msg=`, "map[level:WARNING message: url:/health?full=1]", false},
+		{`level=dbug msg="unterminated`, "map[]", true},
+		{`msg="bad escape \q"`, "map[]", true},
+		{`="no key"`, "map[]", true},
+		{`   `, "map[]", true},
+		{`Connection refused while reaching the upstream`, "map[]", true},
+		{`	at com.example.Handler.serve(Handler.java:42)`, "map[]", true},
+	}
+	for _, c := range cases {
+		fields, err := parser.Parse(c.line)
+		if got := fmt.Sprint(fields); got != c.want || (err != nil) != c.wantErr {
+			t.Errorf("Parse(%s) == %s, %v, want %s", c.line, got, err, c.want)
+		}
+	}
+
+	parser, _ = BuildInputParser(InputConfig{Parser: ParserConfig{Type: "logfmt", LevelKey: "priority"}})
+	if fields, _ := parser.Parse("level=debug priority=warning"); fields["level"] != "WARNING" {
+		t.Errorf("Unexpected level with configured LevelKey, got %v", fields)
+	}
+}
+
+// Asserts fields capturing typed definitions are converted, and conversion failures reported per field
+func TestFieldTypes(t *testing.T) {
+
+	definitions := []PatternConfig{
+		{Name: "Date", Pattern: "[^\\]]+", Type: "timestamp", Format: "%d/%b/%Y:%H:%M:%S", Timezone: "America/New_York"},
+		{Name: "Local", Pattern: "\\S+ \\S+", Type: "timestamp", Layout: "2006-01-02 15:04:05.000"},
+		{Name: "Flag", Pattern: "\\w+", Type: "bool"},
+		{Name: "Elapsed", Pattern: "\\S+", Type: "duration"},
+		{Name: "Code", Pattern: "\\w+", Type: "int"},
+	}
+	parser, err := BuildInputParser(InputConfig{
+		LogPattern:  "^\\[(?P<timestamp>%{Date})\\] %{Local:local} %{Flag:cached} %{Elapsed:elapsed} %{Code:code} %{NUMBER:raw:float}",
+		Definitions: definitions,
+	})
+	if err != nil {
+		t.Fatalf("BuildInputParser failed: %v", err)
+	}
+
+	fields, _ := parser.Parse("[10/Oct/2000:13:55:36] 2000-10-10 17:55:36.250 true 1m30s 200 0.5")
+	values, errs := ConvertFields(fields, parser.Types())
+	newYork, _ := time.LoadLocation("America/New_York")
+	want := map[string]interface{}{
+		"timestamp": time.Date(2000, 10, 10, 13, 55, 36, 0, newYork),
+		"local":     time.Date(2000, 10, 10, 17, 55, 36, 250000000, time.UTC),
+		"cached":    true,
+		"elapsed":   90 * time.Second,
+		"code":      int64(200),
+		"raw":       0.5,
+	}
+	if len(errs) > 0 || len(values) != len(want) {
+		t.Fatalf("ConvertFields(%v) == %v, %v, want %v", fields, values, errs, want)
+	}
+	for name, value := range want {
+		if ts, ok := value.(time.Time); ok {
+			if got, _ := values[name].(time.Time); !got.Equal(ts) {
+				t.Errorf("Unexpected %s value, got %v, want %v", name, values[name], ts)
+			}
+		} else if values[name] != value {
+			t.Errorf("Unexpected %s value, got %v, want %v", name, values[name], value)
+		}
+	}
+
+	fields, _ = parser.Parse("[10/Oct/2000:13:55:36] 2000-10-10 17:55:36.250 maybe 1m30s ok 0.5")
+	values, errs = ConvertFields(fields, parser.Types())
+	if len(errs) != 2 || values["cached"] != nil || values["code"] != nil || values["elapsed"] != 90*time.Second {
+		t.Errorf("Unexpected conversion of invalid fields, got %v and errors %v", values, errs)
+	}
+}
+
+// Asserts levels matched by %{LOGLEVEL} and written by common loggers are normalised to the supported levels
+func TestNormaliseLevel(t *testing.T) {
+
+	parser, err := BuildInputParser(InputConfig{LogPattern: "^%{LOGLEVEL:level} "})
+	if err != nil {
+		t.Fatalf("BuildInputParser failed: %v", err)
+	}
+	cases := map[string]string{
+		"debug": "DEBUG", "TRACE": "DEBUG",
+		"Information": "INFO", "notice": "INFO", "info": "INFO",
+		"warn": "WARNING", "Warning": "WARNING",
+		"err": "ERROR", "EROR": "ERROR", "crit": "ERROR", "fatal": "ERROR", "EMERGENCY": "ERROR",
+	}
+	for level, want := range cases {
+		fields, err := parser.Parse(level + " Something happened")
+		if err != nil {
+			t.Fatalf("Parse failed for level %s: %v", level, err)
+		}
+		if got := NormaliseLevel(fields["level"]); got != want {
+			t.Errorf("NormaliseLevel(%s) == %s, want %s", level, got, want)
+		}
+	}
+}
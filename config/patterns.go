@@ -0,0 +1,160 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Matches %{Name} references to pattern definitions, and grok captures %{Name:field} and %{Name:field:type}
+var placeholderRegex = regexp.MustCompile(`%\{(\w+)(?::([^:{}]*))?(?::([^:{}]*))?\}`)
+var definitionNameRegex = regexp.MustCompile(`^\w+$`)
+
+// Matches grok field names, either dotted such as client.ip or nested such as [client][ip]
+var grokFieldRegex = regexp.MustCompile(`^(?:[\w@-]+(?:\.[\w@-]+)*|(?:\[[\w@-]+\])+)$`)
+
+// Matches Oniguruma named groups (?<name>...), written (?P<name>...) in Go regexps
+var onigurumaGroupRegex = regexp.MustCompile(`\(\?<([A-Za-z_]\w*)>`)
+
+// Matches named groups capturing a single reference, such as (?P<timestamp>%{Date})
+var namedReferenceRegex = regexp.MustCompile(`\(\?P<(\w+)>%\{(\w+)\}\)`)
+
+// Expands references in a log pattern, collecting the field names and types of grok captures.
+// Grok captures are compiled to generated group names, so that field names are not restricted to group name syntax.
+// Fields capturing a definition with a type are converted to its type, unless the capture has its own type.
+type patternExpander struct {
+	defs     map[string]string
+	defTypes map[string]*FieldType
+	fields   map[string]string
+	types    map[string]FieldType
+}
+
+func newPatternExpander(definitions []PatternConfig) (*patternExpander, error) {
+	defs := map[string]string{}
+	for name, pattern := range grokPatterns {
+		defs[name] = pattern
+	}
+	defTypes := map[string]*FieldType{}
+	for _, def := range definitions {
+		defs[def.Name] = def.Pattern
+		fieldType, err := def.fieldType()
+		if err != nil {
+			return nil, err
+		}
+		defTypes[def.Name] = fieldType
+	}
+	return &patternExpander{defs: defs, defTypes: defTypes, fields: map[string]string{}, types: map[string]FieldType{}}, nil
+}
+
+// Replaces the references of a pattern by the referenced definitions, expanded recursively.
+// References are wrapped in non-capturing groups, so that alternations do not leak into the referencing pattern,
+// and grok captures in named groups. path holds the definitions being expanded, to report reference cycles.
+func (x *patternExpander) expand(pattern string, path []string) (string, error) {
+	var err error
+	pattern = onigurumaGroupRegex.ReplaceAllString(pattern, "(?P<$1>")
+	for _, match := range namedReferenceRegex.FindAllStringSubmatch(pattern, -1) {
+		if fieldType := x.defTypes[match[2]]; fieldType != nil {
+			x.types[match[1]] = *fieldType
+		}
+	}
+	expanded := placeholderRegex.ReplaceAllStringFunc(pattern, func(ref string) string {
+		if err != nil {
+			return ref
+		}
+		match := placeholderRegex.FindStringSubmatch(ref)
+		name, field, typ := match[1], match[2], match[3]
+		definition, ok := x.defs[name]
+		if !ok {
+			referrer := "log pattern"
+			if len(path) > 0 {
+				referrer = fmt.Sprintf("definition '%s'", path[len(path)-1])
+			}
+			err = errors.New(fmt.Sprintf("Unknown pattern definition '%s' referenced in %s", name, referrer))
+			return ref
+		}
+		if stringInSlice(name, path) {
+			err = errors.New(fmt.Sprintf("Pattern definition cycle: %s -> %s", strings.Join(path, " -> "), name))
+			return ref
+		}
+		var sub string
+		if sub, err = x.expand(definition, append(append([]string{}, path...), name)); err != nil {
+			return ref
+		}
+		if field == "" {
+			if typ != "" {
+				err = errors.New(fmt.Sprintf("Missing field name for type '%s' in %s", typ, ref))
+			}
+			return "(?:" + sub + ")"
+		}
+
+		if !grokFieldRegex.MatchString(field) {
+			err = errors.New(fmt.Sprintf("Invalid field name '%s' in %s", field, ref))
+			return ref
+		}
+		field = strings.Replace(strings.Trim(field, "[]"), "][", ".", -1)
+		if typ != "" {
+			if !stringInSlice(typ, supportedFieldTypes) {
+				err = errors.New(fmt.Sprintf("Unsupported type '%s' for field '%s', expected one of %v", typ, field, supportedFieldTypes))
+				return ref
+			}
+			x.types[field] = FieldType{Name: typ}
+		} else if fieldType := x.defTypes[name]; fieldType != nil {
+			x.types[field] = *fieldType
+		}
+		group := fmt.Sprintf("_grok%d", len(x.fields))
+		x.fields[group] = field
+		return fmt.Sprintf("(?P<%s>%s)", group, sub)
+	})
+	return expanded, err
+}
+
+// Compiles a log pattern with its definitions. A pattern without references but with positional %s verbs
+// is interpolated with the definitions in list order, as in earlier configuration files.
+// Errors tell which definition is invalid, if any.
+func compilePattern(logPattern string, definitions []PatternConfig) (*RegexParser, error) {
+
+	if !placeholderRegex.MatchString(logPattern) && strings.Contains(logPattern, "%s") {
+		subPatterns := make([]interface{}, len(definitions))
+		for i, def := range definitions {
+			subPatterns[i] = def.Pattern
+		}
+		logPattern = fmt.Sprintf(logPattern, subPatterns...)
+	}
+
+	expander, err := newPatternExpander(definitions)
+	if err != nil {
+		return nil, err
+	}
+	pattern, err := expander.expand(logPattern, nil)
+	if err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile(pattern)
+	if err == nil {
+		return newRegexParser(re, expander.fields, expander.types), nil
+	}
+
+	// Look for a definition causing the error to report it, with its own references replaced by empty groups
+	for _, def := range definitions {
+		stub := placeholderRegex.ReplaceAllString(onigurumaGroupRegex.ReplaceAllString(def.Pattern, "(?P<$1>"), "(?:)")
+		if _, defErr := regexp.Compile(stub); defErr != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid pattern definition '%s': %s", def.Name, defErr))
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("Invalid log pattern '%s': %s", logPattern, err))
+}
+
+func validateDefinitions(definitions []PatternConfig) error {
+	names := []string{}
+	for _, def := range definitions {
+		if !definitionNameRegex.MatchString(def.Name) {
+			return errors.New(fmt.Sprintf("Invalid pattern definition name: '%s'", def.Name))
+		}
+		if stringInSlice(def.Name, names) {
+			return errors.New(fmt.Sprintf("Duplicate pattern definition name: %s", def.Name))
+		}
+		names = append(names, def.Name)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// Processor of the events of an input, processors run in order after parsing and before publishing.
+// Each processor has a single action: Rename renames fields, Drop removes fields, Add adds static fields,
+// Tags adds static tags, Hostname, Source and Basename add the host name, the source path and the file name of
+// the source to the named field, and Copy copies a field to another.
+type ProcessorConfig struct {
+	Rename   map[string]string `yaml:"Rename"`
+	Drop     []string          `yaml:"Drop"`
+	Add      map[string]string `yaml:"Add"`
+	Tags     []string          `yaml:"Tags"`
+	Hostname string            `yaml:"Hostname"`
+	Source   string            `yaml:"Source"`
+	Basename string            `yaml:"Basename"`
+	Copy     *CopyConfig       `yaml:"Copy"`
+}
+
+// Copies field From to field To, replacing the matches of Pattern by Replacement if Pattern is set.
+// Replacement may reference groups of Pattern as $1 or ${name}.
+type CopyConfig struct {
+	From        string `yaml:"From"`
+	To          string `yaml:"To"`
+	Pattern     string `yaml:"Pattern"`
+	Replacement string `yaml:"Replacement"`
+}
+
+func (config ProcessorConfig) validate() error {
+	actions := 0
+	for _, set := range []bool{len(config.Rename) > 0, len(config.Drop) > 0, len(config.Add) > 0, len(config.Tags) > 0,
+		config.Hostname != "", config.Source != "", config.Basename != "", config.Copy != nil} {
+		if set {
+			actions++
+		}
+	}
+	if actions != 1 {
+		return errors.New(fmt.Sprintf("Processor must have exactly one of Rename, Drop, Add, Tags, Hostname, Source, Basename or Copy, found %d", actions))
+	}
+	for from, to := range config.Rename {
+		if from == "" || to == "" {
+			return errors.New(fmt.Sprintf("Invalid empty field name in rename processor: '%s' to '%s'", from, to))
+		}
+	}
+	for name := range config.Add {
+		if name == "" {
+			return errors.New("Invalid empty field name in add processor")
+		}
+	}
+	if config.Copy != nil {
+		if missingFields(config.Copy.From, config.Copy.To) {
+			return errors.New(fmt.Sprintf("Missing field(s) in copy processor: from = %s, to = %s", config.Copy.From, config.Copy.To))
+		}
+		if _, err := regexp.Compile(config.Copy.Pattern); err != nil {
+			return errors.New(fmt.Sprintf("Invalid copy processor pattern: %s", err))
+		}
+	}
+	return nil
+}
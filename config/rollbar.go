@@ -1,11 +1,38 @@
 package config
 
-// Rollbar connector configuration
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+)
+
+const defaultRollbarUrl = "https://api.rollbar.com/api/1/item/"
+const defaultRollbarAccessTokenEnv = "ROLLBAR_ACCESS_TOKEN"
+const defaultRollbarFingerprintField = "code"
+const defaultRollbarTimeout = 10 * time.Second
+const defaultRollbarFallbackLevel = "info"
+
+var supportedRollbarLevels = []string{"debug", "info", "warning", "error", "critical"}
+
+// Rollbar connector configuration. The access token is read from AccessToken or else from the
+// AccessTokenEnv environment variable, ROLLBAR_ACCESS_TOKEN by default.
+// Items are grouped by the value of FingerprintField, the 'code' field by default.
+// Events without a known level are reported at FallbackLevel, 'info' by default.
 type RollbarConnectorConfig struct {
-	Name   string   `yaml:"Name"`
-	Type   string   `yaml:"Type"`
-	Url    string   `yaml:"Url"`
-	Levels []string `yaml:"Levels"`
+	Name             string         `yaml:"Name"`
+	Type             string         `yaml:"Type"`
+	Url              string         `yaml:"Url"`
+	AccessToken      string         `yaml:"AccessToken"`
+	AccessTokenEnv   string         `yaml:"AccessTokenEnv"`
+	Environment      string         `yaml:"Environment"`
+	CodeVersion      string         `yaml:"CodeVersion"`
+	FingerprintField string         `yaml:"FingerprintField"`
+	FallbackLevel    string         `yaml:"FallbackLevel"`
+	Timeout          time.Duration  `yaml:"Timeout"`
+	Levels           []string       `yaml:"Levels"`
+	Delivery         DeliveryConfig `yaml:"Delivery"`
 }
 
 func (config RollbarConnectorConfig) getName() string {
@@ -20,6 +47,53 @@ func (config RollbarConnectorConfig) getLevels() []string {
 	return config.Levels
 }
 
+func (config RollbarConnectorConfig) getDelivery() DeliveryConfig {
+	return config.Delivery
+}
+
+// Returns the configuration with defaults applied to unset fields
+func (config RollbarConnectorConfig) WithDefaults() RollbarConnectorConfig {
+	if config.Url == "" {
+		config.Url = defaultRollbarUrl
+	}
+	if config.AccessTokenEnv == "" {
+		config.AccessTokenEnv = defaultRollbarAccessTokenEnv
+	}
+	if config.FingerprintField == "" {
+		config.FingerprintField = defaultRollbarFingerprintField
+	}
+	if config.Timeout == 0 {
+		config.Timeout = defaultRollbarTimeout
+	}
+	if config.FallbackLevel == "" {
+		config.FallbackLevel = defaultRollbarFallbackLevel
+	}
+	return config
+}
+
+// Returns the configured access token, or the one from the environment
+func (config RollbarConnectorConfig) Token() string {
+	if config.AccessToken != "" {
+		return config.AccessToken
+	}
+	return os.Getenv(config.WithDefaults().AccessTokenEnv)
+}
+
 func (config RollbarConnectorConfig) validate() error {
+	if config.Url != "" {
+		if u, err := url.Parse(config.Url); err != nil || u.Scheme == "" || u.Host == "" {
+			return errors.New(fmt.Sprintf("Invalid url in Rollbar connector config '%s': %s", config.Name, config.Url))
+		}
+	}
+	if config.Token() == "" {
+		return errors.New(fmt.Sprintf("Missing access token in Rollbar connector config '%s': set AccessToken or the %s environment variable",
+			config.Name, config.WithDefaults().AccessTokenEnv))
+	}
+	if config.Timeout < 0 {
+		return errors.New(fmt.Sprintf("Invalid negative timeout in Rollbar connector config '%s': %v", config.Name, config.Timeout))
+	}
+	if config.FallbackLevel != "" && !stringInSlice(config.FallbackLevel, supportedRollbarLevels) {
+		return errors.New(fmt.Sprintf("Invalid fallback level in Rollbar connector config '%s': %s", config.Name, config.FallbackLevel))
+	}
 	return nil
 }
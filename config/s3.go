@@ -3,17 +3,62 @@ package config
 import (
 	"errors"
 	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
 )
 
+var supportedS3Formats = []string{"raw", "ndjson"}
+var supportedS3Compressions = []string{"none", "gzip", "zstd"}
+
+const defaultS3BatchMaxBytes = 5 * 1024 * 1024
+const defaultS3BatchMaxLines = 10000
+const defaultS3BatchMaxAge = time.Minute
+const defaultS3ACL = s3.ObjectCannedACLPrivate
+
+// S3 limits on object tags and user metadata
+const maxS3Tags = 10
+const maxS3TagKeyLength = 128
+const maxS3TagValueLength = 256
+const maxS3MetadataSize = 2048
+
 // S3 connector configuration
 type S3ConnectorConfig struct {
-	Name      string   `yaml:"Name"`
-	Endpoint  string   `yaml:"Endpoint"`
-	KeyPrefix string   `yaml:"KeyPrefix"`
-	Bucket    string   `yaml:"Bucket"`
-	Region    string   `yaml:"Region"`
-	Type      string   `yaml:"Type"`
-	Levels    []string `yaml:"Levels"`
+	Name        string         `yaml:"Name"`
+	Endpoint    string         `yaml:"Endpoint"`
+	KeyPrefix   string         `yaml:"KeyPrefix"`
+	KeyTemplate string         `yaml:"KeyTemplate"`
+	Bucket      string         `yaml:"Bucket"`
+	Region      string         `yaml:"Region"`
+	Type        string         `yaml:"Type"`
+	Levels      []string       `yaml:"Levels"`
+	Delivery    DeliveryConfig `yaml:"Delivery"`
+	Batch       S3BatchConfig  `yaml:"Batch"`
+	Object      S3ObjectConfig `yaml:"Object"`
+}
+
+// S3 batching configuration, a batch is written as one object once it reaches any of its limits.
+// Format is 'raw' (one line of text per event) or 'ndjson' (one JSON event per line),
+// Compression is 'none', 'gzip' or 'zstd'.
+type S3BatchConfig struct {
+	MaxBytes    int64         `yaml:"MaxBytes"`
+	MaxLines    int           `yaml:"MaxLines"`
+	MaxAge      time.Duration `yaml:"MaxAge"`
+	Format      string        `yaml:"Format"`
+	Compression string        `yaml:"Compression"`
+}
+
+// S3 object settings. ACL defaults to 'private', ServerSideEncryption is 'AES256' (SSE-S3) or 'aws:kms' (SSE-KMS,
+// with an optional KMSKeyId). ContentType and ContentEncoding default to the batch format and compression.
+type S3ObjectConfig struct {
+	ACL                  string            `yaml:"ACL"`
+	StorageClass         string            `yaml:"StorageClass"`
+	ServerSideEncryption string            `yaml:"ServerSideEncryption"`
+	KMSKeyId             string            `yaml:"KMSKeyId"`
+	ContentType          string            `yaml:"ContentType"`
+	ContentEncoding      string            `yaml:"ContentEncoding"`
+	Metadata             map[string]string `yaml:"Metadata"`
+	Tags                 map[string]string `yaml:"Tags"`
 }
 
 func (config S3ConnectorConfig) getName() string {
@@ -28,11 +73,136 @@ func (config S3ConnectorConfig) getLevels() []string {
 	return config.Levels
 }
 
+func (config S3ConnectorConfig) getDelivery() DeliveryConfig {
+	return config.Delivery
+}
+
+// Returns the batch configuration with defaults applied to unset fields
+func (config S3BatchConfig) WithDefaults() S3BatchConfig {
+	if config.MaxBytes == 0 {
+		config.MaxBytes = defaultS3BatchMaxBytes
+	}
+	if config.MaxLines == 0 {
+		config.MaxLines = defaultS3BatchMaxLines
+	}
+	if config.MaxAge == 0 {
+		config.MaxAge = defaultS3BatchMaxAge
+	}
+	if config.Format == "" {
+		config.Format = "raw"
+	}
+	if config.Compression == "" {
+		config.Compression = "none"
+	}
+	return config
+}
+
+// Returns the object settings with defaults derived from the batch format and compression applied to unset fields
+func (config S3ConnectorConfig) ObjectWithDefaults() S3ObjectConfig {
+	object := config.Object
+	batch := config.Batch.WithDefaults()
+	if object.ACL == "" {
+		object.ACL = defaultS3ACL
+	}
+	if object.ContentType == "" {
+		object.ContentType = "text/plain"
+		if batch.Format == "ndjson" {
+			object.ContentType = "application/x-ndjson"
+		}
+	}
+	if object.ContentEncoding == "" && batch.Compression != "none" {
+		object.ContentEncoding = batch.Compression
+	}
+	return object
+}
+
+// Returns the object key template, defaulting to timestamped keys under KeyPrefix when KeyTemplate is unset.
+// Placeholders are {ts:layout} (event time), {now:layout} (write time), {level}, {source} (file name),
+// {hostname}, {uuid} and any regex field such as {code}. Templates require {uuid} or {now} so that each batch gets its own key.
+func (config S3ConnectorConfig) ObjectKeyTemplate() string {
+	if config.KeyTemplate != "" {
+		return config.KeyTemplate
+	}
+	key := config.KeyPrefix + "/{now:2006-01-02T15-04-05}-{uuid}"
+	batch := config.Batch.WithDefaults()
+	if batch.Format == "ndjson" {
+		key += ".ndjson"
+	}
+	switch batch.Compression {
+	case "gzip":
+		key += ".gz"
+	case "zstd":
+		key += ".zst"
+	}
+	return key
+}
+
 func (config S3ConnectorConfig) validate() error {
-	if missingFields(config.Endpoint, config.KeyPrefix, config.Bucket, config.Region) {
+	if missingFields(config.Endpoint, config.Bucket, config.Region) || (config.KeyPrefix == "" && config.KeyTemplate == "") {
 		return errors.New(
-			fmt.Sprintf("Missing field(s) in S3 connector config '%s': endpoint = %s, keyprefix = %s, bucket = %s, region = %s",
-				config.Name, config.Endpoint, config.KeyPrefix, config.Bucket, config.Region))
+			fmt.Sprintf("Missing field(s) in S3 connector config '%s': endpoint = %s, keyprefix = %s, keytemplate = %s, bucket = %s, region = %s",
+				config.Name, config.Endpoint, config.KeyPrefix, config.KeyTemplate, config.Bucket, config.Region))
+	}
+	keyTemplate, err := ParseTemplate(config.ObjectKeyTemplate())
+	if err != nil {
+		return errors.New(fmt.Sprintf("Invalid key template in S3 connector config '%s': %s", config.Name, err))
+	}
+	// Batches of a partition would overwrite each other without a per-object placeholder,
+	// and per-line placeholders would make every line its own partition
+	if !keyTemplate.Uses("uuid", "now") {
+		return errors.New(fmt.Sprintf("Key template in S3 connector config '%s' requires a {uuid} or {now} placeholder: %s", config.Name, config.KeyTemplate))
+	}
+	if keyTemplate.Uses("offset", "hash") {
+		return errors.New(fmt.Sprintf("Key template in S3 connector config '%s' cannot use the per-line {offset} and {hash} placeholders: %s", config.Name, config.KeyTemplate))
+	}
+	batch := config.Batch
+	if batch.MaxBytes < 0 || batch.MaxLines < 0 || batch.MaxAge < 0 {
+		return errors.New(fmt.Sprintf("Invalid negative batch limit in S3 connector config '%s': max bytes = %d, max lines = %d, max age = %v",
+			config.Name, batch.MaxBytes, batch.MaxLines, batch.MaxAge))
+	}
+	if batch.Format != "" && !stringInSlice(batch.Format, supportedS3Formats) {
+		return errors.New(fmt.Sprintf("Invalid batch format in S3 connector config '%s': %s", config.Name, batch.Format))
+	}
+	if batch.Compression != "" && !stringInSlice(batch.Compression, supportedS3Compressions) {
+		return errors.New(fmt.Sprintf("Invalid batch compression in S3 connector config '%s': %s", config.Name, batch.Compression))
+	}
+	if err := config.Object.validate(); err != nil {
+		return errors.New(fmt.Sprintf("Invalid object settings in S3 connector config '%s': %s", config.Name, err))
+	}
+	return nil
+}
+
+func (object S3ObjectConfig) validate() error {
+	if object.ACL != "" && !stringInSlice(object.ACL, s3.ObjectCannedACL_Values()) {
+		return errors.New(fmt.Sprintf("Invalid ACL: %s", object.ACL))
+	}
+	if object.StorageClass != "" && !stringInSlice(object.StorageClass, s3.StorageClass_Values()) {
+		return errors.New(fmt.Sprintf("Invalid storage class: %s", object.StorageClass))
+	}
+	if object.ServerSideEncryption != "" && !stringInSlice(object.ServerSideEncryption, s3.ServerSideEncryption_Values()) {
+		return errors.New(fmt.Sprintf("Invalid server side encryption: %s", object.ServerSideEncryption))
+	}
+	if object.KMSKeyId != "" && object.ServerSideEncryption != s3.ServerSideEncryptionAwsKms {
+		return errors.New(fmt.Sprintf("KMSKeyId requires server side encryption '%s'", s3.ServerSideEncryptionAwsKms))
+	}
+	metadataSize := 0
+	for key, value := range object.Metadata {
+		if key == "" {
+			return errors.New("Empty metadata key")
+		}
+		metadataSize += len(key) + len(value)
+	}
+	if metadataSize > maxS3MetadataSize {
+		return errors.New(fmt.Sprintf("Metadata size %d exceeds the %d bytes limit", metadataSize, maxS3MetadataSize))
+	}
+	if len(object.Tags) > maxS3Tags {
+		return errors.New(fmt.Sprintf("Too many tags: %d, at most %d allowed", len(object.Tags), maxS3Tags))
+	}
+	for key, value := range object.Tags {
+		if key == "" || len(key) > maxS3TagKeyLength || len(value) > maxS3TagValueLength {
+			return errors.New(fmt.Sprintf("Invalid tag %s=%s, keys must have 1 to %d characters and values at most %d",
+				key, value, maxS3TagKeyLength, maxS3TagValueLength))
+		}
 	}
 	return nil
 }
@@ -0,0 +1,28 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Resolves a secret set inline, read from a file or from an environment variable, in that order of precedence.
+// Surrounding whitespace is trimmed from file contents.
+func resolveSecret(value string, file string, env string) (string, error) {
+	if value != "" {
+		return value, nil
+	}
+	if file != "" {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("Cannot read secret file %s: %s", file, err))
+		}
+		return strings.TrimSpace(string(content)), nil
+	}
+	if env != "" {
+		return os.Getenv(env), nil
+	}
+	return "", nil
+}
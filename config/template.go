@@ -0,0 +1,81 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Placeholders taking a Go time layout argument, e.g. {ts:2006-01-02}
+var layoutPlaceholders = []string{"ts", "now"}
+
+// Template is a parsed key template, made of literal text and {name} or {name:arg} placeholders
+type Template []TemplatePart
+
+// TemplatePart is either literal text or a placeholder with an optional argument
+type TemplatePart struct {
+	Literal string
+	Name    string
+	Arg     string
+}
+
+// Parses a key template such as 'app/{level}/dt={ts:2006-01-02}/{uuid}.ndjson.gz'
+func ParseTemplate(text string) (Template, error) {
+
+	template := Template{}
+	rest := text
+	for rest != "" {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			template = append(template, TemplatePart{Literal: rest})
+			break
+		}
+		if start > 0 {
+			template = append(template, TemplatePart{Literal: rest[:start]})
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return nil, errors.New(fmt.Sprintf("Unclosed placeholder in template '%s'", text))
+		}
+		placeholder := rest[start+1 : start+end]
+		name, arg := placeholder, ""
+		if i := strings.IndexByte(placeholder, ':'); i >= 0 {
+			name, arg = placeholder[:i], placeholder[i+1:]
+		}
+		if name == "" || strings.ContainsAny(name, "{/") {
+			return nil, errors.New(fmt.Sprintf("Invalid placeholder '{%s}' in template '%s'", placeholder, text))
+		}
+		if stringInSlice(name, layoutPlaceholders) && arg == "" {
+			return nil, errors.New(fmt.Sprintf("Placeholder '{%s}' requires a time layout in template '%s'", name, text))
+		}
+		if !stringInSlice(name, layoutPlaceholders) && arg != "" {
+			return nil, errors.New(fmt.Sprintf("Placeholder '{%s}' does not take an argument in template '%s'", name, text))
+		}
+		template = append(template, TemplatePart{Name: name, Arg: arg})
+		rest = rest[start+end+1:]
+	}
+	return template, nil
+}
+
+// Renders the template, calling value for each placeholder
+func (t Template) Render(value func(name, arg string) string) string {
+	var b strings.Builder
+	for _, part := range t {
+		if part.Name == "" {
+			b.WriteString(part.Literal)
+		} else {
+			b.WriteString(value(part.Name, part.Arg))
+		}
+	}
+	return b.String()
+}
+
+// Returns true if the template has a placeholder with one of the names
+func (t Template) Uses(names ...string) bool {
+	for _, part := range t {
+		if part.Name != "" && stringInSlice(part.Name, names) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,155 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Types fields can be converted to, declared by pattern definitions or grok captures such as %{NUMBER:code:int}
+var supportedFieldTypes = []string{"int", "float", "bool", "duration", "timestamp"}
+
+// Layouts tried when interpreting a timestamp without a configured layout
+var timestampLayouts = []string{
+	"2006-01-02 15:04:05.999999999 MST",
+	"2006-01-02 15:04:05.999999999",
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+}
+
+// Go layouts of strftime directives
+var strftimeDirectives = map[byte]string{
+	'Y': "2006", 'y': "06", 'm': "01", 'b': "Jan", 'h': "Jan", 'B': "January", 'd': "02", 'e': "_2", 'j': "002",
+	'a': "Mon", 'A': "Monday", 'H': "15", 'I': "03", 'M': "04", 'S': "05", 'p': "PM", 'f': "000000", 'L': "000",
+	'z': "-0700", 'Z': "MST", 'T': "15:04:05", 'F': "2006-01-02", 'D': "01/02/06", '%': "%",
+}
+
+// Type of a field, timestamps being parsed with Layout in Location, or with the known layouts if Layout is empty
+type FieldType struct {
+	Name     string
+	Layout   string
+	Location *time.Location
+}
+
+// Returns the type of the fields capturing a definition, nil if the definition has no type
+func (def PatternConfig) fieldType() (*FieldType, error) {
+	if def.Type == "" {
+		if def.Layout != "" || def.Format != "" || def.Timezone != "" {
+			return nil, errors.New(fmt.Sprintf("Layout, format and timezone of pattern definition '%s' require the timestamp type", def.Name))
+		}
+		return nil, nil
+	}
+	if !stringInSlice(def.Type, supportedFieldTypes) {
+		return nil, errors.New(fmt.Sprintf("Unsupported type '%s' of pattern definition '%s', expected one of %v", def.Type, def.Name, supportedFieldTypes))
+	}
+	if def.Type != "timestamp" {
+		if def.Layout != "" || def.Format != "" || def.Timezone != "" {
+			return nil, errors.New(fmt.Sprintf("Layout, format and timezone of pattern definition '%s' require the timestamp type", def.Name))
+		}
+		return &FieldType{Name: def.Type}, nil
+	}
+
+	fieldType := FieldType{Name: def.Type, Layout: def.Layout, Location: time.UTC}
+	if def.Layout != "" && def.Format != "" {
+		return nil, errors.New(fmt.Sprintf("Pattern definition '%s' has both a layout and a format", def.Name))
+	}
+	if def.Format != "" {
+		layout, err := strftimeLayout(def.Format)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid format of pattern definition '%s': %s", def.Name, err))
+		}
+		fieldType.Layout = layout
+	}
+	if def.Timezone != "" {
+		location, err := time.LoadLocation(def.Timezone)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid timezone of pattern definition '%s': %s", def.Name, err))
+		}
+		fieldType.Location = location
+	}
+	return &fieldType, nil
+}
+
+// Converts a strftime format such as %Y-%m-%d %H:%M:%S to a Go layout
+func strftimeLayout(format string) (string, error) {
+	var layout strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			layout.WriteByte(format[i])
+			continue
+		}
+		if i+1 == len(format) {
+			return "", errors.New(fmt.Sprintf("Truncated strftime directive at the end of '%s'", format))
+		}
+		i++
+		directive, ok := strftimeDirectives[format[i]]
+		if !ok {
+			return "", errors.New(fmt.Sprintf("Unsupported strftime directive '%%%c' in '%s'", format[i], format))
+		}
+		layout.WriteString(directive)
+	}
+	return layout.String(), nil
+}
+
+// Parses a timestamp with the known layouts, as UTC unless it holds a timezone
+func ParseTimestamp(value string) (time.Time, bool) {
+	ts, err := parseTimestamp(value, "", time.UTC)
+	return ts, err == nil
+}
+
+func parseTimestamp(value string, layout string, location *time.Location) (time.Time, error) {
+	if layout != "" {
+		return time.ParseInLocation(layout, value, location)
+	}
+	for _, layout := range timestampLayouts {
+		if ts, err := time.ParseInLocation(layout, value, location); err == nil {
+			return ts, nil
+		}
+	}
+	return time.Time{}, errors.New(fmt.Sprintf("no known layout matching '%s'", value))
+}
+
+// Converts the fields with a type to typed values, returning an error for each field which could not be converted
+func ConvertFields(fields map[string]string, types map[string]FieldType) (map[string]interface{}, []error) {
+	if len(types) == 0 {
+		return nil, nil
+	}
+	values := make(map[string]interface{})
+	errs := []error{}
+	for name, typ := range types {
+		text, ok := fields[name]
+		if !ok || text == "" {
+			continue
+		}
+		value, err := convertField(text, typ)
+		if err != nil {
+			errs = append(errs, errors.New(fmt.Sprintf("Cannot convert field %s to %s: %s", name, typ.Name, err)))
+			continue
+		}
+		values[name] = value
+	}
+	return values, errs
+}
+
+// Converts the text of a field to a value of a type
+func convertField(text string, typ FieldType) (interface{}, error) {
+	switch typ.Name {
+	case "int":
+		return strconv.ParseInt(text, 10, 64)
+	case "float":
+		return strconv.ParseFloat(text, 64)
+	case "bool":
+		return strconv.ParseBool(text)
+	case "duration":
+		return time.ParseDuration(text)
+	case "timestamp":
+		location := typ.Location
+		if location == nil {
+			location = time.UTC
+		}
+		return parseTimestamp(text, typ.Layout, location)
+	}
+	return text, nil
+}
@@ -0,0 +1,54 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+var supportedUnmatchedPolicies = []string{"forward", "drop", "connector", "file"}
+
+const defaultUnmatchedPolicy = "forward"
+
+// Tag of events built from lines which could not be parsed
+const ParseErrorTag = "_parse_error"
+
+// Handling of lines failing parsing. The forward policy publishes them to the input connectors tagged with
+// ParseErrorTag, the drop policy skips them, the connector policy routes them to Connector only, whatever its levels,
+// and the file policy appends them to File as dead letter records.
+type UnmatchedConfig struct {
+	Policy    string `yaml:"Policy"`
+	Connector string `yaml:"Connector"`
+	File      string `yaml:"File"`
+}
+
+// Returns the unmatched lines configuration with defaults applied to unset fields
+func (config UnmatchedConfig) WithDefaults() UnmatchedConfig {
+	if config.Policy == "" {
+		config.Policy = defaultUnmatchedPolicy
+	}
+	return config
+}
+
+func (config UnmatchedConfig) validate(connectors []string) error {
+	policy := config.WithDefaults().Policy
+	if !stringInSlice(policy, supportedUnmatchedPolicies) {
+		return errors.New(fmt.Sprintf("Unsupported unmatched policy '%s', expected one of %v", config.Policy, supportedUnmatchedPolicies))
+	}
+	if (policy == "connector" && config.Connector == "") || (policy == "file" && config.File == "") {
+		return errors.New(fmt.Sprintf("Missing %s for unmatched policy '%s'", policy, policy))
+	}
+	if (policy != "connector" && config.Connector != "") || (policy != "file" && config.File != "") {
+		return errors.New(fmt.Sprintf("Unmatched connector (%s) or file (%s) not used by unmatched policy '%s'", config.Connector, config.File, policy))
+	}
+	if config.Connector != "" && !stringInSlice(config.Connector, connectors) {
+		return errors.New(fmt.Sprintf("Unknown unmatched connector '%s'", config.Connector))
+	}
+	if config.File != "" {
+		if _, err := os.Stat(filepath.Dir(config.File)); os.IsNotExist(err) {
+			return errors.New(fmt.Sprintf("Directory of unmatched file %s does not exist", config.File))
+		}
+	}
+	return nil
+}
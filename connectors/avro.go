@@ -0,0 +1,210 @@
+package connectors
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dimpogissou/isengard-server/events"
+	"github.com/linkedin/goavro/v2"
+)
+
+// Avro record schema events are serialised with
+type avroSchema struct {
+	codec   *goavro.Codec
+	fields  []avroField
+	sources map[string]string // Parsed field of each schema field, see schemaFieldNames
+}
+
+type avroField struct {
+	name     string
+	typ      interface{}
+	optional bool
+}
+
+// Derives an Avro record schema from the event properties and the schema field names of the parsed fields,
+// parsed fields being optional strings
+func deriveAvroSchema(names []string) string {
+	timestamp := map[string]string{"type": "long", "logicalType": "timestamp-millis"}
+	schemaFields := []map[string]interface{}{
+		{"name": "text", "type": "string"},
+		{"name": "source", "type": "string"},
+		{"name": "offset", "type": "long"},
+		{"name": "timestamp", "type": timestamp},
+		{"name": "ingestTime", "type": timestamp},
+		{"name": "hostname", "type": "string"},
+		{"name": "tags", "type": map[string]string{"type": "array", "items": "string"}},
+	}
+	for _, name := range names {
+		schemaFields = append(schemaFields, map[string]interface{}{"name": name, "type": []string{"null", "string"}, "default": nil})
+	}
+	schema, _ := json.Marshal(map[string]interface{}{"type": "record", "name": "Event", "namespace": "isengard", "fields": schemaFields})
+	return string(schema)
+}
+
+// Parses an Avro record schema
+func newAvroSchema(text string) (*avroSchema, error) {
+
+	codec, err := goavro.NewCodec(text)
+	if err != nil {
+		return nil, err
+	}
+	var spec struct {
+		Type   interface{} `json:"type"`
+		Fields []struct {
+			Name    string           `json:"name"`
+			Type    interface{}      `json:"type"`
+			Default *json.RawMessage `json:"default"`
+		} `json:"fields"`
+	}
+	if err := json.Unmarshal([]byte(text), &spec); err != nil {
+		return nil, err
+	}
+	if spec.Type != "record" {
+		return nil, errors.New(fmt.Sprintf("Avro schema must be a record, got %v", spec.Type))
+	}
+	schema := &avroSchema{codec: codec}
+	for _, f := range spec.Fields {
+		schema.fields = append(schema.fields, avroField{name: f.Name, typ: f.Type, optional: f.Default != nil})
+	}
+	return schema, nil
+}
+
+// Serialises an event as an Avro record, each schema field taking the event value of the same name
+func (s *avroSchema) serialize(e *events.Event) ([]byte, error) {
+	record := map[string]interface{}{}
+	for _, f := range s.fields {
+		value := eventSchemaValue(e, f.name, s.sources)
+		if value == nil && f.optional {
+			continue
+		}
+		native, err := avroNative(f.typ, value)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid value for Avro field %s: %s", f.name, err))
+		}
+		record[f.name] = native
+	}
+	return s.codec.BinaryFromNative(nil, record)
+}
+
+// Returns the name identifying an Avro type in a union
+func avroTypeName(t interface{}) string {
+	switch v := t.(type) {
+	case string:
+		return v
+	case map[string]interface{}:
+		if name, ok := v["name"].(string); ok {
+			if namespace, ok := v["namespace"].(string); ok && namespace != "" {
+				return namespace + "." + name
+			}
+			return name
+		}
+		if logicalType, ok := v["logicalType"].(string); ok {
+			return fmt.Sprintf("%v.%s", v["type"], logicalType)
+		}
+		return avroTypeName(v["type"])
+	}
+	return ""
+}
+
+// Converts an event value to the goavro native value of an Avro type
+func avroNative(t interface{}, value interface{}) (interface{}, error) {
+
+	switch v := t.(type) {
+	case []interface{}:
+		if value == nil {
+			for _, branch := range v {
+				if branch == "null" {
+					return nil, nil
+				}
+			}
+			return nil, errors.New("missing value")
+		}
+		for _, branch := range v {
+			if branch == "null" {
+				continue
+			}
+			if native, err := avroNative(branch, value); err == nil {
+				return goavro.Union(avroTypeName(branch), native), nil
+			}
+		}
+		return nil, errors.New(fmt.Sprintf("%v does not match any type of union %v", value, v))
+	case map[string]interface{}:
+		if value == nil {
+			return nil, errors.New("missing value")
+		}
+		switch v["logicalType"] {
+		case "timestamp-millis", "timestamp-micros":
+			if ts, ok := value.(time.Time); ok {
+				return ts, nil
+			}
+			if s, ok := value.(string); ok {
+				return time.Parse(time.RFC3339Nano, s)
+			}
+			return nil, errors.New(fmt.Sprintf("Cannot convert %v to a timestamp", value))
+		}
+		switch v["type"] {
+		case "array":
+			items, err := schemaStrings(value)
+			if err != nil {
+				return nil, err
+			}
+			natives := make([]interface{}, 0, len(items))
+			for _, item := range items {
+				native, err := avroNative(v["items"], item)
+				if err != nil {
+					return nil, err
+				}
+				natives = append(natives, native)
+			}
+			return natives, nil
+		case "map":
+			fields, ok := value.(map[string]string)
+			if !ok {
+				return nil, errors.New(fmt.Sprintf("Cannot convert %v to a map", value))
+			}
+			natives := map[string]interface{}{}
+			for name, field := range fields {
+				native, err := avroNative(v["values"], field)
+				if err != nil {
+					return nil, err
+				}
+				natives[name] = native
+			}
+			return natives, nil
+		case "enum":
+			return schemaString(value)
+		case "record", "fixed":
+			return nil, errors.New(fmt.Sprintf("Unsupported Avro type %v", v["type"]))
+		}
+		return avroNative(v["type"], value)
+	case string:
+		if value == nil {
+			if v == "null" {
+				return nil, nil
+			}
+			return nil, errors.New("missing value")
+		}
+		switch v {
+		case "boolean":
+			return schemaBool(value)
+		case "int":
+			i, err := schemaInt(value)
+			return int32(i), err
+		case "long":
+			return schemaInt(value)
+		case "float":
+			f, err := schemaFloat(value)
+			return float32(f), err
+		case "double":
+			return schemaFloat(value)
+		case "string":
+			return schemaString(value)
+		case "bytes":
+			s, err := schemaString(value)
+			return []byte(s), err
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("Unsupported Avro type %v", t))
+}
@@ -0,0 +1,290 @@
+package connectors
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dimpogissou/isengard-server/config"
+	"github.com/dimpogissou/isengard-server/events"
+)
+
+// Event properties available to schemas besides the parsed fields, see eventSchemaValue
+var eventSchemaProperties = []string{"text", "source", "offset", "timestamp", "ingestTime", "hostname", "tags"}
+
+var invalidSchemaNameRe = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// JSON payload of an event, i.e. its JSON encoding with the normalised level and the host it was read on.
+// Fields with a type hold their typed value rather than their text.
+type jsonPayload struct {
+	*events.Event
+	Fields   map[string]interface{} `json:"fields"`
+	Values   map[string]interface{} `json:"values,omitempty"`
+	Level    string                 `json:"level,omitempty"`
+	Hostname string                 `json:"hostname"`
+}
+
+// Encodes an event into a message payload with the configured codec, the line text by default
+func encodePayload(codec string, e *events.Event) ([]byte, error) {
+	if codec == "json" {
+		fields := make(map[string]interface{}, len(e.Fields))
+		for name, value := range e.Fields {
+			fields[name] = value
+		}
+		for name, value := range e.Values {
+			fields[name] = value
+		}
+		return json.Marshal(jsonPayload{Event: e, Fields: fields, Level: e.Level(), Hostname: hostname})
+	}
+	return []byte(e.Text), nil
+}
+
+// payloadEncoder serialises events into message payloads
+type payloadEncoder interface {
+	encode(e *events.Event) ([]byte, error)
+}
+
+// Encoder of the schemaless raw and json codecs
+type plainEncoder string
+
+func (codec plainEncoder) encode(e *events.Event) ([]byte, error) {
+	return encodePayload(string(codec), e)
+}
+
+// Encoder serialising events with a schema from the registry, in the Confluent wire format:
+// a zero magic byte, the big endian schema ID, an optional prefix such as Protobuf message indexes, then the payload.
+// The schema ID is resolved on first use so that an unavailable registry fails sends rather than startup.
+type registryEncoder struct {
+	registry     *schemaRegistry
+	subject      string
+	autoRegister bool
+	schema       registrySchema
+	prefix       []byte
+	serialize    func(e *events.Event) ([]byte, error)
+
+	mu sync.Mutex
+	id int32
+}
+
+// Returns the schema ID, registering or looking up the schema the first time
+func (r *registryEncoder) schemaID() (int32, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.id != 0 {
+		return r.id, nil
+	}
+	var id int32
+	var err error
+	if r.autoRegister {
+		id, err = r.registry.register(r.subject, r.schema)
+	} else {
+		id, err = r.registry.lookup(r.subject, r.schema)
+	}
+	if err != nil {
+		return 0, err
+	}
+	r.id = id
+	return id, nil
+}
+
+func (r *registryEncoder) encode(e *events.Event) ([]byte, error) {
+	id, err := r.schemaID()
+	if err != nil {
+		return nil, err
+	}
+	payload, err := r.serialize(e)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 5, 5+len(r.prefix)+len(payload))
+	binary.BigEndian.PutUint32(buf[1:], uint32(id))
+	buf = append(buf, r.prefix...)
+	return append(buf, payload...), nil
+}
+
+// Creates the payload encoder of the configured codec.
+// Schemas are read from the configured file, or derived from the provided parsed field names.
+// Returns an error if parsed fields map to the same schema field.
+func newPayloadEncoder(cfg config.KafkaConnectorConfig, fields []string) (payloadEncoder, error) {
+
+	if cfg.Codec != "avro" && cfg.Codec != "protobuf" {
+		return plainEncoder(cfg.Codec), nil
+	}
+	registry, err := newSchemaRegistry(cfg.SchemaRegistry)
+	if err != nil {
+		return nil, err
+	}
+	schemaText := ""
+	if cfg.SchemaRegistry.SchemaFile != "" {
+		content, err := ioutil.ReadFile(cfg.SchemaRegistry.SchemaFile)
+		if err != nil {
+			return nil, err
+		}
+		schemaText = string(content)
+	}
+
+	names, sources, err := schemaFieldNames(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	encoder := &registryEncoder{registry: registry, subject: cfg.SchemaRegistry.Subject, autoRegister: cfg.SchemaRegistry.AutoRegister}
+	if cfg.Codec == "avro" {
+		if schemaText == "" {
+			schemaText = deriveAvroSchema(names)
+		}
+		schema, err := newAvroSchema(schemaText)
+		if err != nil {
+			return nil, err
+		}
+		schema.sources = sources
+		encoder.schema = registrySchema{Schema: schemaText}
+		encoder.serialize = schema.serialize
+	} else {
+		var schema *protoSchema
+		if schemaText == "" {
+			schema = deriveProtoSchema(names)
+			schemaText = schema.String()
+		} else if schema, err = parseProtoSchema(schemaText); err != nil {
+			return nil, err
+		}
+		schema.sources = sources
+		encoder.schema = registrySchema{Schema: schemaText, SchemaType: "PROTOBUF"}
+		// Message indexes of the first message of the schema, written as a single zero
+		encoder.prefix = []byte{0}
+		encoder.serialize = schema.serialize
+	}
+	return encoder, nil
+}
+
+// Returns the schema field names of the parsed fields, skipping those shadowed by event properties,
+// and the parsed field of each name. Characters not allowed in Avro and Protobuf names, e.g. in client.ip
+// or [http][verb], are replaced by underscores, and fields whose names collide once replaced are rejected.
+func schemaFieldNames(fields []string) ([]string, map[string]string, error) {
+	names := []string{}
+	sources := map[string]string{}
+	for _, field := range fields {
+		name := schemaFieldName(field)
+		if name == "" || stringInSlice(name, eventSchemaProperties) || (name[0] >= '0' && name[0] <= '9') {
+			continue
+		}
+		if source, ok := sources[name]; ok {
+			if source != field {
+				return nil, nil, errors.New(fmt.Sprintf("Parsed fields '%s' and '%s' both map to schema field '%s'", source, field, name))
+			}
+			continue
+		}
+		sources[name] = field
+		names = append(names, name)
+	}
+	return names, sources, nil
+}
+
+// Returns the schema field name of a parsed field, replacing characters outside of [A-Za-z0-9_] by underscores
+func schemaFieldName(field string) string {
+	return invalidSchemaNameRe.ReplaceAllString(field, "_")
+}
+
+// Returns the value of a schema field for an event: an event property, the normalised level or the parsed field
+// sources maps the schema field to. Returns nil when the event has no such value.
+func eventSchemaValue(e *events.Event, name string, sources map[string]string) interface{} {
+	switch name {
+	case "text":
+		return e.Text
+	case "source":
+		return e.Source
+	case "offset":
+		return e.Offset
+	case "timestamp":
+		return e.Timestamp
+	case "ingestTime":
+		return e.IngestTime
+	case "hostname":
+		return hostname
+	case "tags":
+		return e.Tags
+	case "level":
+		if level := e.Level(); level != "" {
+			return level
+		}
+		return nil
+	}
+	if field, ok := sources[name]; ok {
+		name = field
+	}
+	if value, ok := e.Fields[name]; ok {
+		return value
+	}
+	return nil
+}
+
+// Converts a schema value to a string
+func schemaString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	}
+	return "", errors.New(fmt.Sprintf("Cannot convert %v to a string", value))
+}
+
+// Converts a schema value to an integer, times being converted to Unix milliseconds
+func schemaInt(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case int64:
+		return v, nil
+	case time.Time:
+		return v.UnixNano() / int64(time.Millisecond), nil
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	}
+	return 0, errors.New(fmt.Sprintf("Cannot convert %v to an integer", value))
+}
+
+// Converts a schema value to a float
+func schemaFloat(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	}
+	return 0, errors.New(fmt.Sprintf("Cannot convert %v to a float", value))
+}
+
+// Converts a schema value to a boolean
+func schemaBool(value interface{}) (bool, error) {
+	if v, ok := value.(string); ok {
+		return strconv.ParseBool(v)
+	}
+	return false, errors.New(fmt.Sprintf("Cannot convert %v to a boolean", value))
+}
+
+// Converts a schema value to a list of strings
+func schemaStrings(value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case []string:
+		return v, nil
+	case string:
+		return []string{v}, nil
+	}
+	return nil, errors.New(fmt.Sprintf("Cannot convert %v to a list of strings", value))
+}
+
+func stringInSlice(a string, list []string) bool {
+	for _, b := range list {
+		if b == a {
+			return true
+		}
+	}
+	return false
+}
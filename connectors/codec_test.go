@@ -0,0 +1,198 @@
+package connectors
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dimpogissou/isengard-server/config"
+	"github.com/dimpogissou/isengard-server/events"
+	"github.com/linkedin/goavro/v2"
+)
+
+// Schema registry stand-in, registering schemas under ID 7 and recording requests
+type fakeSchemaRegistry struct {
+	mu       sync.Mutex
+	schemas  map[string]registrySchema
+	requests []string
+}
+
+func (f *fakeSchemaRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.URL.Path)
+
+	var schema registrySchema
+	json.NewDecoder(r.Body).Decode(&schema)
+	subject := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/subjects/"), "/versions")
+	if strings.HasSuffix(r.URL.Path, "/versions") {
+		f.schemas[subject] = schema
+	} else if _, ok := f.schemas[subject]; !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error_code": 40403, "message": "Schema not found"}`))
+		return
+	}
+	w.Write([]byte(`{"id": 7}`))
+}
+
+// Creates a payload encoder using a schema registry stand-in
+func newTestRegistryEncoder(t *testing.T, cfg config.KafkaConnectorConfig, fields []string) (payloadEncoder, *fakeSchemaRegistry) {
+	registry := &fakeSchemaRegistry{schemas: map[string]registrySchema{}}
+	server := httptest.NewServer(registry)
+	t.Cleanup(server.Close)
+	cfg.Topic = "test-topic"
+	cfg.SchemaRegistry.Url = server.URL
+	encoder, err := newPayloadEncoder(cfg.WithDefaults(), fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoder, registry
+}
+
+// Returns a test event with parsed fields
+func testSchemaEvent() *events.Event {
+	ts := time.Date(2020, 10, 7, 20, 56, 47, 0, time.UTC)
+	return &events.Event{
+		Text:       "[2020-10-07 20:56:47][WARN][009] Disk almost full",
+		Source:     "/var/log/app.log",
+		Offset:     42,
+		Timestamp:  ts,
+		IngestTime: ts,
+		Fields:     map[string]string{"timestamp": "2020-10-07 20:56:47", "level": "WARN", "code": "009", "status": "200", "latency": "0.5"},
+	}
+}
+
+// Asserts events are serialised with a derived Avro schema registered once, in the Confluent wire format
+func TestAvroCodec(t *testing.T) {
+
+	encoder, registry := newTestRegistryEncoder(t, config.KafkaConnectorConfig{Codec: "avro", SchemaRegistry: config.KafkaSchemaRegistryConfig{AutoRegister: true}}, []string{"", "timestamp", "level", "code", "message"})
+	var payload []byte
+	for i := 0; i < 2; i++ {
+		var err error
+		if payload, err = encoder.encode(testSchemaEvent()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(registry.requests) != 1 || registry.requests[0] != "/subjects/test-topic-value/versions" {
+		t.Errorf("Expected the schema to be registered once under the topic value subject, got requests %v", registry.requests)
+	}
+	if !bytes.Equal(payload[:5], []byte{0, 0, 0, 0, 7}) {
+		t.Fatalf("Unexpected wire format header %v", payload[:5])
+	}
+
+	codec, err := goavro.NewCodec(registry.schemas["test-topic-value"].Schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	native, _, err := codec.NativeFromBinary(payload[5:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := native.(map[string]interface{})
+	if record["offset"] != int64(42) || record["hostname"] != hostname || !record["timestamp"].(time.Time).Equal(testSchemaEvent().Timestamp) {
+		t.Errorf("Unexpected Avro event properties %v", record)
+	}
+	if record["level"].(map[string]interface{})["string"] != "WARNING" || record["code"].(map[string]interface{})["string"] != "009" || record["message"] != nil {
+		t.Errorf("Unexpected Avro event fields %v", record)
+	}
+}
+
+// Asserts a missing schema is reported as an encoding error when schemas are not registered automatically
+func TestAvroCodecUnregisteredSchema(t *testing.T) {
+
+	encoder, _ := newTestRegistryEncoder(t, config.KafkaConnectorConfig{Codec: "avro"}, []string{"code"})
+	_, err := encoder.encode(testSchemaEvent())
+	if err == nil || !strings.Contains(err.Error(), "Schema not found") {
+		t.Errorf("Expected schema not found error, got %v", err)
+	}
+}
+
+// Asserts events are serialised with a Protobuf schema file, with the message index after the schema ID
+func TestProtobufCodec(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "schemas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	schemaFile := filepath.Join(dir, "event.proto")
+	schemaText := `syntax = "proto3";
+
+// Log event
+message Event {
+  string code = 1;
+  int32 status = 2;
+  double latency = 3 [deprecated = true];
+  repeated string tags = 4;
+}
+`
+	ioutil.WriteFile(schemaFile, []byte(schemaText), 0600)
+
+	encoder, registry := newTestRegistryEncoder(t, config.KafkaConnectorConfig{Codec: "protobuf", SchemaRegistry: config.KafkaSchemaRegistryConfig{AutoRegister: true, SchemaFile: schemaFile}}, nil)
+	payload, err := encoder.encode(testSchemaEvent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schema := registry.schemas["test-topic-value"]; schema.SchemaType != "PROTOBUF" || schema.Schema != schemaText {
+		t.Errorf("Unexpected registered schema %+v", schema)
+	}
+
+	want := []byte{0, 0, 0, 0, 7, 0, 0x0a, 3, '0', '0', '9', 0x10, 0xc8, 0x01, 0x19}
+	latency := make([]byte, 8)
+	binary.LittleEndian.PutUint64(latency, math.Float64bits(0.5))
+	want = append(want, latency...)
+	if !bytes.Equal(payload, want) {
+		t.Errorf("Unexpected Protobuf payload %v, want %v", payload, want)
+	}
+
+	if _, err := parseProtoSchema("message Event { map<string, string> fields = 1; }"); err == nil {
+		t.Errorf("Expected non scalar Protobuf fields to be rejected")
+	}
+}
+
+// Asserts parsed field names invalid in schemas are derived as valid names and still take their field values
+func TestCodecSchemaFieldNames(t *testing.T) {
+
+	fields := []string{"client.ip", "[http][verb]", "@version", "user-agent", "client.ip"}
+	names, _, err := schemaFieldNames(fields)
+	if err != nil || strings.Join(names, ",") != "client_ip,_http__verb_,_version,user_agent" {
+		t.Errorf("Unexpected schema field names %v, %v", names, err)
+	}
+	if _, err := newPayloadEncoder(config.KafkaConnectorConfig{Codec: "avro"}.WithDefaults(), []string{"a.b", "a-b"}); err == nil || err.Error() != "Parsed fields 'a.b' and 'a-b' both map to schema field 'a_b'" {
+		t.Errorf("Expected parsed fields mapping to the same schema field to be rejected, got %v", err)
+	}
+
+	encoder, registry := newTestRegistryEncoder(t, config.KafkaConnectorConfig{Codec: "avro", SchemaRegistry: config.KafkaSchemaRegistryConfig{AutoRegister: true}}, fields)
+	e := testSchemaEvent()
+	e.Fields = map[string]string{"client.ip": "10.0.0.1", "[http][verb]": "GET"}
+	payload, err := encoder.encode(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec, err := goavro.NewCodec(registry.schemas["test-topic-value"].Schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	native, _, err := codec.NativeFromBinary(payload[5:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := native.(map[string]interface{})
+	if record["client_ip"].(map[string]interface{})["string"] != "10.0.0.1" || record["_http__verb_"].(map[string]interface{})["string"] != "GET" {
+		t.Errorf("Unexpected Avro event fields %v", record)
+	}
+
+	if _, err := parseProtoSchema(deriveProtoSchema(names).String()); err != nil {
+		t.Errorf("Expected the derived Protobuf schema to be valid, got %v", err)
+	}
+}
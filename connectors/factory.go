@@ -1,16 +1,33 @@
 package connectors
 
 import (
+	"time"
+
 	"github.com/dimpogissou/isengard-server/config"
-	"github.com/hpcloud/tail"
+	"github.com/dimpogissou/isengard-server/events"
 )
 
 type ConnectorInterface interface {
 	GetName() string
-	Send(line *tail.Line) error
+	GetLevels() []string
+	GetDelivery() config.DeliveryConfig
+	Send(e *events.Event) error
 	Close() error
 }
 
+// AsyncConnector is implemented by connectors acknowledging events after SendAsync returns, e.g. once a batch is written.
+// done must be called exactly once per event, with the delivery error if any.
+// MaxPending returns how many events the connector may hold before completing them, e.g. its batch size.
+type AsyncConnector interface {
+	SendAsync(e *events.Event, done func(error))
+	MaxPending() int
+}
+
+// RetryAfter is implemented by send errors telling how long to wait before retrying, e.g. rate limit responses
+type RetryAfter interface {
+	RetryAfter() time.Duration
+}
+
 // Create all connectors
 func CreateConnectors(cfg config.YamlConfig) []ConnectorInterface {
 
@@ -18,17 +35,27 @@ func CreateConnectors(cfg config.YamlConfig) []ConnectorInterface {
 
 	for _, connCfg := range cfg.S3Connectors {
 		session, client := SetupS3Client(connCfg)
-		conns = append(conns, S3Connector{cfg: connCfg, session: session, client: client})
+		conns = append(conns, NewS3Connector(connCfg, session, client))
 	}
 
 	for _, connCfg := range cfg.RollbarConnectors {
-		conns = append(conns, RollbarConnector{cfg: connCfg})
+		conns = append(conns, NewRollbarConnector(connCfg))
 	}
 
 	for _, connCfg := range cfg.KafkaConnectors {
-		writer := SetupKafkaConnection(connCfg.Host, connCfg.Port, connCfg.Topic)
-		conns = append(conns, KafkaConnector{cfg: connCfg, writer: writer})
+		conns = append(conns, NewKafkaConnector(connCfg, inputFieldNames(cfg, connCfg.Name)))
 	}
 
 	return conns
 }
+
+// Returns the names of the fields parsed by the inputs routing events to a connector
+func inputFieldNames(cfg config.YamlConfig, connector string) []string {
+	fields := []string{}
+	for _, input := range cfg.GetInputs() {
+		if parser, err := config.BuildInputParser(input); err == nil && input.RoutesTo(connector) {
+			fields = append(fields, parser.Fields()...)
+		}
+	}
+	return fields
+}
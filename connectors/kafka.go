@@ -2,24 +2,135 @@ package connectors
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"strconv"
+	"sync"
 
 	"github.com/dimpogissou/isengard-server/config"
+	"github.com/dimpogissou/isengard-server/events"
 	"github.com/dimpogissou/isengard-server/logger"
-	"github.com/hpcloud/tail"
-	uuid "github.com/nu7hatch/gouuid"
 	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
 )
 
-func SetupKafkaConnection(host string, port string, topic string) *kafka.Writer {
+// Kafka required acks by configured name
+var kafkaRequiredAcks = map[string]kafka.RequiredAcks{
+	"none": kafka.RequireNone,
+	"one":  kafka.RequireOne,
+	"all":  kafka.RequireAll,
+}
+
+// Balancer writing messages to the partition set on them from the partition field,
+// falling back to hashing their key when the event has no valid partition number
+type fieldBalancer struct {
+	fallback kafka.Hash
+}
+
+func (b *fieldBalancer) Balance(msg kafka.Message, partitions ...int) int {
+	if msg.Partition < 0 {
+		return b.fallback.Balance(msg, partitions...)
+	}
+	return partitions[msg.Partition%len(partitions)]
+}
 
-	writer := kafka.NewWriter(kafka.WriterConfig{
-		Brokers:  []string{fmt.Sprintf("%s:%s", host, port)},
-		Topic:    topic,
-		Balancer: &kafka.LeastBytes{},
-	})
+// Returns the configured Kafka balancer
+func kafkaBalancer(name string) kafka.Balancer {
+	switch name {
+	case "round_robin":
+		return &kafka.RoundRobin{}
+	case "least_bytes":
+		return &kafka.LeastBytes{}
+	case "field":
+		return &fieldBalancer{}
+	}
+	return &kafka.Hash{}
+}
 
-	return writer
+// Builds the TLS configuration of the Kafka connection, nil when TLS is disabled
+func kafkaTLSConfig(cfg config.KafkaTLSConfig) (*tls.Config, error) {
+
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{ServerName: cfg.ServerName, InsecureSkipVerify: cfg.InsecureSkipVerify}
+	if cfg.CAFile != "" {
+		ca, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New(fmt.Sprintf("No PEM certificate found in CA file %s", cfg.CAFile))
+		}
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// Builds the SASL mechanism of the Kafka connection, nil when SASL is disabled
+func kafkaSASLMechanism(cfg config.KafkaSASLConfig) (sasl.Mechanism, error) {
+
+	if cfg.Mechanism == "" {
+		return nil, nil
+	}
+	username, password, err := cfg.Credentials()
+	if err != nil {
+		return nil, err
+	}
+	switch cfg.Mechanism {
+	case "PLAIN":
+		return plain.Mechanism{Username: username, Password: password}, nil
+	case "SCRAM-SHA-256":
+		return scram.Mechanism(scram.SHA256, username, password)
+	case "SCRAM-SHA-512":
+		return scram.Mechanism(scram.SHA512, username, password)
+	}
+	return nil, errors.New(fmt.Sprintf("Unsupported SASL mechanism: %s", cfg.Mechanism))
+}
+
+// Creates a Kafka writer batching messages as configured, connecting with TLS and SASL when enabled
+func SetupKafkaConnection(cfg config.KafkaConnectorConfig) (*kafka.Writer, error) {
+
+	cfg = cfg.WithDefaults()
+	tlsConfig, err := kafkaTLSConfig(cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+	mechanism, err := kafkaSASLMechanism(cfg.SASL)
+	if err != nil {
+		return nil, err
+	}
+	writer := &kafka.Writer{
+		Addr:         kafka.TCP(cfg.BrokerAddresses()...),
+		Topic:        cfg.Topic,
+		Balancer:     kafkaBalancer(cfg.Balancer),
+		BatchSize:    cfg.Batch.Size,
+		BatchBytes:   cfg.Batch.Bytes,
+		BatchTimeout: cfg.Batch.Timeout,
+		WriteTimeout: cfg.WriteTimeout,
+		RequiredAcks: kafkaRequiredAcks[cfg.RequiredAcks],
+	}
+	// A sync write holds a single message and would otherwise wait for the batch timeout
+	if !cfg.Async {
+		writer.BatchSize = 1
+	}
+	if tlsConfig != nil || mechanism != nil {
+		writer.Transport = &kafka.Transport{TLS: tlsConfig, SASL: mechanism}
+	}
+
+	return writer, nil
 }
 
 func CloseKafkaConnection(writer *kafka.Writer) error {
@@ -32,46 +143,176 @@ func CloseKafkaConnection(writer *kafka.Writer) error {
 	return nil
 }
 
-func (c KafkaConnector) writeKafkaMessages(key string, message string) error {
+// Writes messages, returning once Kafka confirmed the write of their batch with the required acks
+func (c KafkaConnector) writeKafkaMessages(msgs ...kafka.Message) error {
 
-	err := c.writer.WriteMessages(context.Background(),
-		kafka.Message{
-			Key:   []byte(key),
-			Value: []byte(message),
-		})
+	ctx, cancel := context.WithTimeout(context.Background(), c.cfg.Batch.Timeout+c.cfg.WriteTimeout)
+	defer cancel()
+	err := c.writer.WriteMessages(ctx, msgs...)
 	if err != nil {
 		return err
 	}
-	logger.Info(fmt.Sprintf("Successfully published message to Kafka at key [%s] -> %s", key, message))
+	logger.Debug(fmt.Sprintf("Successfully published %d message(s) to Kafka topic %s", len(msgs), c.cfg.Topic))
 	return nil
 }
 
+// KafkaConnector writes events to a Kafka topic, one event at a time
 type KafkaConnector struct {
-	cfg    config.KafkaConnectorConfig
-	writer *kafka.Writer
+	cfg         config.KafkaConnectorConfig
+	writer      *kafka.Writer
+	keyTemplate config.Template
+	encoder     payloadEncoder
+}
+
+// Kafka connector writing events with an asynchronous writer batching them,
+// each event being acknowledged once the writer completes the write of its batch
+type asyncKafkaConnector struct {
+	KafkaConnector
+	pending *kafkaPending
+}
+
+// Completion callbacks of the messages being written, by message
+type kafkaPending struct {
+	mu    sync.Mutex
+	dones map[*byte]func(error)
+}
+
+// Returns the address of the backing array of a message value, identifying the message in writer completions
+// as their values reference the original byte slices. Values must have a capacity of at least 1.
+func kafkaMessageID(msg kafka.Message) *byte {
+	return &msg.Value[:1][0]
+}
+
+func (p *kafkaPending) add(msg kafka.Message, done func(error)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dones[kafkaMessageID(msg)] = done
+}
+
+func (p *kafkaPending) remove(msg kafka.Message) func(error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	done := p.dones[kafkaMessageID(msg)]
+	delete(p.dones, kafkaMessageID(msg))
+	return done
+}
+
+// Writer completion calling the callbacks of the written messages
+func (p *kafkaPending) complete(messages []kafka.Message, err error) {
+	if err != nil {
+		logger.Error("KafkaPublishMessageError", err.Error())
+	}
+	for _, msg := range messages {
+		if done := p.remove(msg); done != nil {
+			done(err)
+		}
+	}
+}
+
+// Creates a Kafka connector, asynchronous if configured so. fields are the names of the parsed fields,
+// from which the schema is derived for the avro and protobuf codecs when no schema file is configured.
+// Panics on an invalid key template, or when TLS, SASL or schema settings cannot be loaded.
+func NewKafkaConnector(cfg config.KafkaConnectorConfig, fields []string) ConnectorInterface {
+	cfg = cfg.WithDefaults()
+	keyTemplate, err := config.ParseTemplate(cfg.KeyTemplate)
+	if err != nil {
+		panic(fmt.Sprintf("Invalid key template for Kafka connector %s: %v", cfg.Name, err))
+	}
+	writer, err := SetupKafkaConnection(cfg)
+	if err != nil {
+		panic(fmt.Sprintf("Failed setting up Kafka connection for connector %s: %v", cfg.Name, err))
+	}
+	encoder, err := newPayloadEncoder(cfg, fields)
+	if err != nil {
+		panic(fmt.Sprintf("Failed loading %s codec for Kafka connector %s: %v", cfg.Codec, cfg.Name, err))
+	}
+	conn := KafkaConnector{cfg: cfg, writer: writer, keyTemplate: keyTemplate, encoder: encoder}
+	if cfg.Async {
+		pending := &kafkaPending{dones: map[*byte]func(error){}}
+		writer.Async = true
+		writer.Completion = pending.complete
+		return asyncKafkaConnector{KafkaConnector: conn, pending: pending}
+	}
+	return conn
 }
 
 func (c KafkaConnector) GetName() string {
 	return c.cfg.Name
 }
 
+func (c KafkaConnector) GetLevels() []string {
+	return c.cfg.Levels
+}
+
+func (c KafkaConnector) GetDelivery() config.DeliveryConfig {
+	return c.cfg.Delivery
+}
+
 func (c KafkaConnector) Close() error {
 	err := CloseKafkaConnection(c.writer)
 	return err
 }
 
-func (c KafkaConnector) Send(line *tail.Line) error {
-	logger.Debug(fmt.Sprintf("Sending line to Kafka --> %v", line.Text))
-	uuid, err := uuid.NewV4()
+// Builds the Kafka message of an event, keyed from the key template and encoded with the configured codec.
+// With the field balancer, the message partition is read from the partition field.
+func (c KafkaConnector) buildMessage(e *events.Event) (kafka.Message, error) {
+	value, err := c.encoder.encode(e)
+	if err != nil {
+		return kafka.Message{}, err
+	}
+	msg := kafka.Message{Value: value}
+	for _, name := range c.cfg.Headers {
+		if value, ok := eventTemplateValue(e, name, ""); ok {
+			msg.Headers = append(msg.Headers, kafka.Header{Key: name, Value: []byte(value)})
+		}
+	}
+	if key := renderEventTemplate(c.keyTemplate, e, ""); key != "" {
+		msg.Key = []byte(key)
+	}
+	if c.cfg.Balancer == "field" {
+		partition, err := strconv.Atoi(e.Field(c.cfg.PartitionField))
+		if err != nil || partition < 0 {
+			partition = -1
+		}
+		msg.Partition = partition
+	}
+	return msg, nil
+}
+
+func (c KafkaConnector) Send(e *events.Event) error {
+	logger.Debug(fmt.Sprintf("Sending line to Kafka --> %v", e.Text))
+	msg, err := c.buildMessage(e)
 	if err != nil {
-		logger.Error("CreateUuidError", err.Error())
 		return err
 	}
-	// TODO -> Optimize string write since this operation is repeated for each log line
-	err = c.writeKafkaMessages(fmt.Sprintf("%v", uuid), line.Text)
+	err = c.writeKafkaMessages(msg)
 	if err != nil {
 		logger.Error("KafkaPublishMessageError", err.Error())
 		return err
 	}
 	return nil
 }
+
+// Hands the event to the writer, done is called once Kafka confirmed the write of its batch
+func (c asyncKafkaConnector) SendAsync(e *events.Event, done func(error)) {
+	logger.Debug(fmt.Sprintf("Sending line to Kafka --> %v", e.Text))
+	msg, err := c.buildMessage(e)
+	if err != nil {
+		done(err)
+		return
+	}
+	if len(msg.Value) == 0 {
+		msg.Value = make([]byte, 0, 1)
+	}
+	c.pending.add(msg, done)
+	if err := c.writer.WriteMessages(context.Background(), msg); err != nil {
+		if done := c.pending.remove(msg); done != nil {
+			done(err)
+		}
+	}
+}
+
+// Returns the number of events awaiting completion, enough to fill a batch
+func (c asyncKafkaConnector) MaxPending() int {
+	return c.cfg.Batch.Size
+}
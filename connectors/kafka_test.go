@@ -2,14 +2,32 @@ package connectors
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/dimpogissou/isengard-server/config"
+	"github.com/dimpogissou/isengard-server/events"
 	"github.com/dimpogissou/isengard-server/logger"
-	"github.com/hpcloud/tail"
 	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/protocol"
+	metadataAPI "github.com/segmentio/kafka-go/protocol/metadata"
+	produceAPI "github.com/segmentio/kafka-go/protocol/produce"
+	"github.com/segmentio/kafka-go/sasl/plain"
 )
 
 // reads Kafka topic messages to assert they were correctly published
@@ -79,12 +97,10 @@ func TestWriteToKafkaTopic(t *testing.T) {
 		Topic:  topic,
 	}
 
-	connector := KafkaConnector{cfg: cfg, writer: SetupKafkaConnection(cfg.Host, cfg.Port, cfg.Topic)}
+	connector := NewKafkaConnector(cfg, nil)
 	defer connector.Close()
 
-	line := tail.Line{Text: testMessage}
-
-	connector.Send(&line)
+	connector.Send(&events.Event{Text: testMessage})
 
 	msg := readFromTopic(cfg.Host, cfg.Port, cfg.Topic, partition)
 
@@ -93,3 +109,317 @@ func TestWriteToKafkaTopic(t *testing.T) {
 	}
 
 }
+
+// Message produced to the Kafka stand-in
+type producedMessage struct {
+	partition int32
+	acks      int16
+	key       string
+	value     string
+	headers   map[string]string
+}
+
+// Kafka transport stand-in answering metadata and produce requests, recording produced batches
+type fakeKafkaTransport struct {
+	mu         sync.Mutex
+	partitions int
+	errorCode  int16
+	batches    [][]producedMessage
+}
+
+func (f *fakeKafkaTransport) RoundTrip(ctx context.Context, addr net.Addr, req protocol.Message) (protocol.Message, error) {
+	switch r := req.(type) {
+	case *metadataAPI.Request:
+		topic := metadataAPI.ResponseTopic{Name: r.TopicNames[0]}
+		for i := 0; i < f.partitions; i++ {
+			topic.Partitions = append(topic.Partitions, metadataAPI.ResponsePartition{PartitionIndex: int32(i)})
+		}
+		return &metadataAPI.Response{Topics: []metadataAPI.ResponseTopic{topic}}, nil
+	case *produceAPI.Request:
+		topic := r.Topics[0]
+		partition := topic.Partitions[0]
+		batch := []producedMessage{}
+		for {
+			record, err := partition.RecordSet.Records.ReadRecord()
+			if err != nil {
+				break
+			}
+			msg := producedMessage{partition: partition.Partition, acks: r.Acks, headers: map[string]string{}}
+			if record.Key != nil {
+				key, _ := ioutil.ReadAll(record.Key)
+				msg.key = string(key)
+			}
+			if record.Value != nil {
+				value, _ := ioutil.ReadAll(record.Value)
+				msg.value = string(value)
+			}
+			for _, header := range record.Headers {
+				msg.headers[header.Key] = string(header.Value)
+			}
+			batch = append(batch, msg)
+		}
+		f.mu.Lock()
+		f.batches = append(f.batches, batch)
+		f.mu.Unlock()
+		return &produceAPI.Response{Topics: []produceAPI.ResponseTopic{{
+			Topic:      topic.Topic,
+			Partitions: []produceAPI.ResponsePartition{{Partition: partition.Partition, ErrorCode: f.errorCode}},
+		}}}, nil
+	}
+	return nil, errors.New(fmt.Sprintf("Unexpected Kafka request %T", req))
+}
+
+// Returns the batches produced so far
+func (f *fakeKafkaTransport) produced() [][]producedMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]producedMessage{}, f.batches...)
+}
+
+// Creates a Kafka connector writing to the transport stand-in
+func newTestKafkaConnector(cfg config.KafkaConnectorConfig, transport *fakeKafkaTransport) ConnectorInterface {
+	cfg.Name, cfg.Host, cfg.Port, cfg.Topic = "testKafkaConnector", "localhost", "9092", "test-topic"
+	conn := NewKafkaConnector(cfg, nil)
+	switch c := conn.(type) {
+	case KafkaConnector:
+		c.writer.Transport = transport
+	case asyncKafkaConnector:
+		c.writer.Transport = transport
+	}
+	return conn
+}
+
+// Asserts async writes are batched together and each event completed once Kafka confirmed its batch
+func TestKafkaAsyncBatching(t *testing.T) {
+
+	transport := &fakeKafkaTransport{partitions: 1}
+	conn := newTestKafkaConnector(config.KafkaConnectorConfig{Async: true, Batch: config.KafkaBatchConfig{Size: 3, Timeout: time.Hour}}, transport)
+	defer conn.Close()
+	async, ok := conn.(AsyncConnector)
+	if !ok {
+		t.Fatalf("Async Kafka connector should implement AsyncConnector")
+	}
+
+	done := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		async.SendAsync(&events.Event{Text: fmt.Sprintf("line-%d", i)}, func(err error) { done <- err })
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Unexpected write error: %v", err)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("Event not completed after its batch was full")
+		}
+	}
+
+	batches := transport.produced()
+	if len(batches) != 1 || len(batches[0]) != 3 {
+		t.Fatalf("Expected a single batch of 3 messages, got %v", batches)
+	}
+	if batches[0][0].acks != int16(kafka.RequireAll) {
+		t.Errorf("Expected messages written with all acks by default, got %d", batches[0][0].acks)
+	}
+}
+
+// Asserts async writes report the write failure of their batch to their callback
+func TestKafkaAsyncErrors(t *testing.T) {
+
+	transport := &fakeKafkaTransport{partitions: 1, errorCode: int16(kafka.MessageSizeTooLarge)}
+	conn := newTestKafkaConnector(config.KafkaConnectorConfig{Async: true, Batch: config.KafkaBatchConfig{Timeout: time.Millisecond}, WriteTimeout: time.Second}, transport)
+	defer conn.Close()
+
+	done := make(chan error, 1)
+	conn.(AsyncConnector).SendAsync(&events.Event{Text: "line"}, func(err error) { done <- err })
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("Expected the event to fail when Kafka rejects the write")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Event not completed after its write failed")
+	}
+}
+
+// Asserts sync sends report write failures and honour the configured acks
+func TestKafkaSendErrors(t *testing.T) {
+
+	transport := &fakeKafkaTransport{partitions: 1, errorCode: int16(kafka.MessageSizeTooLarge)}
+	conn := newTestKafkaConnector(config.KafkaConnectorConfig{RequiredAcks: "one", Batch: config.KafkaBatchConfig{Timeout: time.Millisecond}, WriteTimeout: time.Second}, transport)
+	defer conn.Close()
+	if _, ok := conn.(AsyncConnector); ok {
+		t.Fatalf("Sync Kafka connector should not implement AsyncConnector")
+	}
+
+	if err := conn.Send(&events.Event{Text: "line"}); err == nil {
+		t.Errorf("Expected Send to fail when Kafka rejects the write")
+	}
+	if batches := transport.produced(); len(batches) == 0 || batches[0][0].acks != int16(kafka.RequireOne) {
+		t.Errorf("Expected messages written with one ack, got %v", batches)
+	}
+}
+
+// Asserts sync sends are written right away rather than after the batch timeout
+func TestKafkaSendLatency(t *testing.T) {
+
+	transport := &fakeKafkaTransport{partitions: 1}
+	conn := newTestKafkaConnector(config.KafkaConnectorConfig{Batch: config.KafkaBatchConfig{Timeout: 5 * time.Second}}, transport)
+	defer conn.Close()
+
+	start := time.Now()
+	if err := conn.Send(&events.Event{Text: "line"}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the sync send to return before the batch timeout, took %v", elapsed)
+	}
+}
+
+// Asserts message keys are rendered from event fields, defaulting to a stable hash of the event position
+func TestKafkaMessageKeys(t *testing.T) {
+
+	transport := &fakeKafkaTransport{partitions: 4}
+	conn := newTestKafkaConnector(config.KafkaConnectorConfig{KeyTemplate: "{code}", Batch: config.KafkaBatchConfig{Timeout: time.Millisecond}}, transport)
+	defer conn.Close()
+	for i := 0; i < 3; i++ {
+		e := &events.Event{Text: fmt.Sprintf("line-%d", i), Fields: map[string]string{"code": "009"}}
+		if err := conn.Send(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	batches := transport.produced()
+	for _, batch := range batches {
+		if batch[0].key != "009" || batch[0].partition != batches[0][0].partition {
+			t.Errorf("Expected messages keyed 009 on a single partition, got key %s on partition %d", batch[0].key, batch[0].partition)
+		}
+	}
+
+	defaultKeys := newTestKafkaConnector(config.KafkaConnectorConfig{}, transport).(KafkaConnector)
+	defer defaultKeys.Close()
+	first, _ := defaultKeys.buildMessage(&events.Event{Text: "line", Source: "/var/log/app.log", Offset: 42})
+	again, _ := defaultKeys.buildMessage(&events.Event{Text: "line", Source: "/var/log/app.log", Offset: 42})
+	next, _ := defaultKeys.buildMessage(&events.Event{Text: "line", Source: "/var/log/app.log", Offset: 47})
+	if len(first.Key) == 0 || string(first.Key) != string(again.Key) || string(first.Key) == string(next.Key) {
+		t.Errorf("Expected stable keys distinct per offset, got %s, %s and %s", first.Key, again.Key, next.Key)
+	}
+}
+
+// Asserts the field balancer writes events to the partition held by their partition field
+func TestKafkaFieldBalancer(t *testing.T) {
+
+	transport := &fakeKafkaTransport{partitions: 4}
+	conn := newTestKafkaConnector(config.KafkaConnectorConfig{Balancer: "field", PartitionField: "shard", Batch: config.KafkaBatchConfig{Timeout: time.Millisecond}}, transport)
+	defer conn.Close()
+	for _, shard := range []string{"2", "3"} {
+		if err := conn.Send(&events.Event{Text: "line", Fields: map[string]string{"shard": shard}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	batches := transport.produced()
+	if len(batches) != 2 || batches[0][0].partition != 2 || batches[1][0].partition != 3 {
+		t.Errorf("Expected messages written to partitions 2 and 3, got %v", batches)
+	}
+}
+
+// Writes a self-signed certificate and its key as PEM files to dir
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kafka"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+// Asserts TLS settings load the CA and client certificate, and SASL credentials are read from files and env
+func TestKafkaTLSAndSASL(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "kafka-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCertificate(t, dir)
+
+	tlsConfig, err := kafkaTLSConfig(config.KafkaTLSConfig{Enabled: true, CAFile: certFile, CertFile: certFile, KeyFile: keyFile, ServerName: "kafka"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.RootCAs == nil || len(tlsConfig.Certificates) != 1 || tlsConfig.ServerName != "kafka" {
+		t.Errorf("Unexpected TLS config: %+v", tlsConfig)
+	}
+	if tlsConfig, _ := kafkaTLSConfig(config.KafkaTLSConfig{}); tlsConfig != nil {
+		t.Errorf("Expected no TLS config when TLS is disabled")
+	}
+
+	passwordFile := filepath.Join(dir, "password")
+	ioutil.WriteFile(passwordFile, []byte("secret\n"), 0600)
+	os.Setenv("ISENGARD_TEST_KAFKA_USER", "isengard")
+	defer os.Unsetenv("ISENGARD_TEST_KAFKA_USER")
+
+	for _, mechanism := range []string{"PLAIN", "SCRAM-SHA-256", "SCRAM-SHA-512"} {
+		m, err := kafkaSASLMechanism(config.KafkaSASLConfig{Mechanism: mechanism, UsernameEnv: "ISENGARD_TEST_KAFKA_USER", PasswordFile: passwordFile})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Name() != mechanism {
+			t.Errorf("Unexpected SASL mechanism %s, want %s", m.Name(), mechanism)
+		}
+	}
+	m, _ := kafkaSASLMechanism(config.KafkaSASLConfig{Mechanism: "PLAIN", UsernameEnv: "ISENGARD_TEST_KAFKA_USER", PasswordFile: passwordFile})
+	if plainMechanism := m.(plain.Mechanism); plainMechanism.Username != "isengard" || plainMechanism.Password != "secret" {
+		t.Errorf("Unexpected SASL credentials %s/%s", plainMechanism.Username, plainMechanism.Password)
+	}
+}
+
+// Asserts the JSON codec serialises event fields with source, hostname and timestamps, and fields are sent as headers
+func TestKafkaJSONCodecAndHeaders(t *testing.T) {
+
+	transport := &fakeKafkaTransport{partitions: 1}
+	conn := newTestKafkaConnector(config.KafkaConnectorConfig{Codec: "json", Headers: []string{"level", "code", "source", "missing"}, Batch: config.KafkaBatchConfig{Timeout: time.Millisecond}}, transport)
+	defer conn.Close()
+
+	ts := time.Date(2020, 10, 7, 20, 56, 47, 0, time.UTC)
+	e := &events.Event{Text: "line", Source: "/var/log/app.log", Timestamp: ts, IngestTime: ts, Fields: map[string]string{"level": "WARN", "code": "009"}}
+	if err := conn.Send(e); err != nil {
+		t.Fatal(err)
+	}
+	msg := transport.produced()[0][0]
+
+	var payload map[string]interface{}
+	if err := json.Unmarshal([]byte(msg.value), &payload); err != nil {
+		t.Fatal(err)
+	}
+	fields, _ := payload["fields"].(map[string]interface{})
+	if fields["code"] != "009" || payload["source"] != "/var/log/app.log" || payload["level"] != "WARNING" || payload["hostname"] != hostname {
+		t.Errorf("Unexpected JSON payload %s", msg.value)
+	}
+	if payload["timestamp"] != "2020-10-07T20:56:47Z" || payload["ingestTime"] != "2020-10-07T20:56:47Z" {
+		t.Errorf("Unexpected JSON payload timestamps %s", msg.value)
+	}
+	want := map[string]string{"level": "WARNING", "code": "009", "source": "app.log"}
+	if fmt.Sprint(msg.headers) != fmt.Sprint(want) {
+		t.Errorf("Unexpected message headers %v, want %v", msg.headers, want)
+	}
+}
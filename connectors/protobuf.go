@@ -0,0 +1,191 @@
+package connectors
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/dimpogissou/isengard-server/events"
+)
+
+// Protobuf wire types
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+// Scalar Protobuf types supported in schemas
+var protoScalarTypes = []string{"string", "bytes", "bool", "int32", "int64", "uint32", "uint64", "sint32", "sint64", "double", "float"}
+
+var protoCommentRe = regexp.MustCompile(`(?s)//[^\n]*|/\*.*?\*/`)
+var protoMessageRe = regexp.MustCompile(`(?s)\bmessage\s+(\w+)\s*\{(.*?)\}`)
+var protoFieldRe = regexp.MustCompile(`^(repeated\s+|optional\s+)?(\w+)\s+(\w+)\s*=\s*(\d+)\s*(\[[^\]]*\])?$`)
+
+// Flat Protobuf message schema events are serialised with, made of scalar and repeated scalar fields
+type protoSchema struct {
+	header  string
+	name    string
+	fields  []protoField
+	sources map[string]string // Parsed field of each schema field, see schemaFieldNames
+}
+
+type protoField struct {
+	name     string
+	typ      string
+	number   int
+	repeated bool
+}
+
+// Derives a Protobuf message schema from the event properties and the schema field names of the parsed fields.
+// Timestamps are Unix milliseconds and parsed fields are strings.
+func deriveProtoSchema(names []string) *protoSchema {
+	schema := &protoSchema{
+		header: "syntax = \"proto3\";\npackage isengard;\n",
+		name:   "Event",
+		fields: []protoField{
+			{name: "text", typ: "string", number: 1},
+			{name: "source", typ: "string", number: 2},
+			{name: "offset", typ: "int64", number: 3},
+			{name: "timestamp", typ: "int64", number: 4},
+			{name: "ingestTime", typ: "int64", number: 5},
+			{name: "hostname", typ: "string", number: 6},
+			{name: "tags", typ: "string", number: 7, repeated: true},
+		},
+	}
+	for i, name := range names {
+		schema.fields = append(schema.fields, protoField{name: name, typ: "string", number: 8 + i})
+	}
+	return schema
+}
+
+// Returns the .proto definition of the schema
+func (s *protoSchema) String() string {
+	var b strings.Builder
+	b.WriteString(s.header)
+	b.WriteString(fmt.Sprintf("\nmessage %s {\n", s.name))
+	for _, f := range s.fields {
+		label := ""
+		if f.repeated {
+			label = "repeated "
+		}
+		b.WriteString(fmt.Sprintf("  %s%s %s = %d;\n", label, f.typ, f.name, f.number))
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// Parses the first message of a .proto definition, which may only have scalar fields
+func parseProtoSchema(text string) (*protoSchema, error) {
+
+	match := protoMessageRe.FindStringSubmatch(protoCommentRe.ReplaceAllString(text, ""))
+	if match == nil {
+		return nil, errors.New("No message found in Protobuf schema")
+	}
+	schema := &protoSchema{name: match[1]}
+	for _, statement := range strings.Split(match[2], ";") {
+		statement = strings.TrimSpace(statement)
+		if statement == "" || strings.HasPrefix(statement, "option ") || strings.HasPrefix(statement, "reserved ") {
+			continue
+		}
+		field := protoFieldRe.FindStringSubmatch(statement)
+		if field == nil || !stringInSlice(field[2], protoScalarTypes) {
+			return nil, errors.New(fmt.Sprintf("Unsupported Protobuf field '%s' in message %s, only scalar fields are supported", statement, schema.name))
+		}
+		number, _ := strconv.Atoi(field[4])
+		schema.fields = append(schema.fields, protoField{name: field[3], typ: field[2], number: number, repeated: strings.TrimSpace(field[1]) == "repeated"})
+	}
+	return schema, nil
+}
+
+// Serialises an event as a Protobuf message, each schema field taking the event value of the same name
+func (s *protoSchema) serialize(e *events.Event) ([]byte, error) {
+	buf := []byte{}
+	for _, f := range s.fields {
+		value := eventSchemaValue(e, f.name, s.sources)
+		if value == nil {
+			continue
+		}
+		values := []interface{}{value}
+		if f.repeated {
+			items, err := schemaStrings(value)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Invalid value for Protobuf field %s: %s", f.name, err))
+			}
+			values = values[:0]
+			for _, item := range items {
+				values = append(values, item)
+			}
+		}
+		for _, v := range values {
+			var err error
+			if buf, err = appendProtoField(buf, f, v); err != nil {
+				return nil, errors.New(fmt.Sprintf("Invalid value for Protobuf field %s: %s", f.name, err))
+			}
+		}
+	}
+	return buf, nil
+}
+
+// Appends the encoding of a field value, omitting proto3 default values of singular fields
+func appendProtoField(buf []byte, f protoField, value interface{}) ([]byte, error) {
+
+	key := func(wireType int) []byte {
+		return appendUvarint(buf, uint64(f.number)<<3|uint64(wireType))
+	}
+	switch f.typ {
+	case "string", "bytes":
+		s, err := schemaString(value)
+		if err != nil || (s == "" && !f.repeated) {
+			return buf, err
+		}
+		buf = appendUvarint(key(protoBytes), uint64(len(s)))
+		return append(buf, s...), nil
+	case "bool":
+		b, err := schemaBool(value)
+		if err != nil || !b {
+			return buf, err
+		}
+		return appendUvarint(key(protoVarint), 1), nil
+	case "int32", "int64", "uint32", "uint64", "sint32", "sint64":
+		i, err := schemaInt(value)
+		if err != nil || i == 0 {
+			return buf, err
+		}
+		if strings.HasPrefix(f.typ, "sint") {
+			return appendUvarint(key(protoVarint), uint64(i<<1)^uint64(i>>63)), nil
+		}
+		return appendUvarint(key(protoVarint), uint64(i)), nil
+	case "double":
+		d, err := schemaFloat(value)
+		if err != nil || d == 0 {
+			return buf, err
+		}
+		buf = key(protoFixed64)
+		var fixed [8]byte
+		binary.LittleEndian.PutUint64(fixed[:], math.Float64bits(d))
+		return append(buf, fixed[:]...), nil
+	case "float":
+		d, err := schemaFloat(value)
+		if err != nil || d == 0 {
+			return buf, err
+		}
+		buf = key(protoFixed32)
+		var fixed [4]byte
+		binary.LittleEndian.PutUint32(fixed[:], math.Float32bits(float32(d)))
+		return append(buf, fixed[:]...), nil
+	}
+	return buf, errors.New(fmt.Sprintf("Unsupported Protobuf type %s", f.typ))
+}
+
+// Appends the varint encoding of v
+func appendUvarint(buf []byte, v uint64) []byte {
+	var varint [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(varint[:], v)
+	return append(buf, varint[:n]...)
+}
@@ -1,24 +1,190 @@
 package connectors
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/dimpogissou/isengard-server/config"
+	"github.com/dimpogissou/isengard-server/events"
 	"github.com/dimpogissou/isengard-server/logger"
-	"github.com/hpcloud/tail"
+	uuid "github.com/nu7hatch/gouuid"
 )
 
-type RollbarConnector struct{ cfg config.RollbarConnectorConfig }
+// Rollbar item levels by normalised log level
+var rollbarLevels = map[string]string{
+	"DEBUG":    "debug",
+	"INFO":     "info",
+	"WARNING":  "warning",
+	"ERROR":    "error",
+	"CRITICAL": "critical",
+	"FATAL":    "critical",
+}
+
+// Delay before retrying when Rollbar rate limits us without telling for how long
+const defaultRollbarRetryAfter = time.Minute
+
+// RollbarConnector posts events as items to the Rollbar API
+type RollbarConnector struct {
+	cfg    config.RollbarConnectorConfig
+	token  string
+	client *http.Client
+}
+
+// Rollbar item as posted to the API, see https://docs.rollbar.com/reference#create-item
+type rollbarItem struct {
+	Data rollbarData `json:"data"`
+}
+
+type rollbarData struct {
+	Environment string            `json:"environment,omitempty"`
+	Body        rollbarBody       `json:"body"`
+	Level       string            `json:"level"`
+	Timestamp   int64             `json:"timestamp"`
+	CodeVersion string            `json:"code_version,omitempty"`
+	Platform    string            `json:"platform"`
+	Server      rollbarServer     `json:"server"`
+	Custom      map[string]string `json:"custom,omitempty"`
+	Fingerprint string            `json:"fingerprint,omitempty"`
+	UUID        string            `json:"uuid"`
+}
+
+type rollbarBody struct {
+	Message rollbarMessage `json:"message"`
+}
+
+type rollbarMessage struct {
+	Body string `json:"body"`
+}
+
+type rollbarServer struct {
+	Host string `json:"host"`
+}
+
+// Rollbar API response, Err is non zero on failure
+type rollbarResponse struct {
+	Err     int    `json:"err"`
+	Message string `json:"message"`
+}
+
+// RateLimitError is returned when Rollbar rejects items until its rate limit resets
+type RateLimitError struct {
+	Wait time.Duration
+}
+
+func (e RateLimitError) Error() string {
+	return fmt.Sprintf("Rollbar rate limit reached, retry in %v", e.Wait)
+}
+
+func (e RateLimitError) RetryAfter() time.Duration {
+	return e.Wait
+}
+
+// Creates a Rollbar connector, reading the access token from the config or the environment
+func NewRollbarConnector(cfg config.RollbarConnectorConfig) RollbarConnector {
+	cfg = cfg.WithDefaults()
+	return RollbarConnector{cfg: cfg, token: cfg.Token(), client: &http.Client{Timeout: cfg.Timeout}}
+}
 
 func (c RollbarConnector) GetName() string {
 	return c.cfg.Name
 }
 
+func (c RollbarConnector) GetLevels() []string {
+	return c.cfg.Levels
+}
+
+func (c RollbarConnector) GetDelivery() config.DeliveryConfig {
+	return c.cfg.Delivery
+}
+
 func (c RollbarConnector) Close() error {
 	return nil
 }
 
-func (c RollbarConnector) Send(line *tail.Line) error {
-	logger.Info(fmt.Sprintf("Sending line to Rollbar --> %v", line))
+// Builds the Rollbar item of an event.
+// The item UUID is derived from the event position so that Rollbar ignores items resent after a retry.
+func (c RollbarConnector) buildItem(e *events.Event) rollbarItem {
+
+	message := e.Field("message")
+	if message == "" {
+		message = e.Text
+	}
+	level, ok := rollbarLevels[e.Level()]
+	if !ok {
+		level = c.cfg.FallbackLevel
+	}
+	custom := map[string]string{}
+	for name, value := range e.Fields {
+		custom[name] = value
+	}
+	if e.Source != "" {
+		custom["source"] = e.Source
+	}
+	id, _ := uuid.NewV5(uuid.NamespaceURL, []byte(fmt.Sprintf("%s:%d:%s", e.Source, e.Offset, e.Text)))
+
+	return rollbarItem{Data: rollbarData{
+		Environment: c.cfg.Environment,
+		Body:        rollbarBody{Message: rollbarMessage{Body: message}},
+		Level:       level,
+		Timestamp:   e.Timestamp.Unix(),
+		CodeVersion: c.cfg.CodeVersion,
+		Platform:    "isengard",
+		Server:      rollbarServer{Host: hostname},
+		Custom:      custom,
+		Fingerprint: e.Field(c.cfg.FingerprintField),
+		UUID:        id.String(),
+	}}
+}
+
+// Returns how long Rollbar asks us to wait after a rate limited response
+func rollbarRetryAfter(resp *http.Response) time.Duration {
+	for _, header := range []string{"X-Rate-Limit-Remaining-Seconds", "Retry-After"} {
+		if seconds, err := strconv.Atoi(resp.Header.Get(header)); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return defaultRollbarRetryAfter
+}
+
+// Posts an event as a Rollbar item
+func (c RollbarConnector) Send(e *events.Event) error {
+
+	body, err := json.Marshal(c.buildItem(e))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.cfg.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Rollbar-Access-Token", c.token)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		err := RateLimitError{Wait: rollbarRetryAfter(resp)}
+		logger.Warn("RollbarRateLimited", fmt.Sprintf("Rollbar connector %s rate limited: %s", c.cfg.Name, err))
+		return err
+	}
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	var result rollbarResponse
+	json.Unmarshal(respBody, &result)
+	if resp.StatusCode/100 != 2 || result.Err != 0 {
+		if result.Message == "" {
+			result.Message = string(respBody)
+		}
+		return errors.New(fmt.Sprintf("Rollbar API responded %d: %s", resp.StatusCode, result.Message))
+	}
 	return nil
 }
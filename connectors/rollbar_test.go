@@ -0,0 +1,94 @@
+package connectors
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dimpogissou/isengard-server/config"
+	"github.com/dimpogissou/isengard-server/events"
+)
+
+// Creates a Rollbar connector posting to a local HTTP stand-in running the provided handler
+func newTestRollbarConnector(t *testing.T, handler http.HandlerFunc) RollbarConnector {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return NewRollbarConnector(config.RollbarConnectorConfig{
+		Name:        "testRollbarConnector",
+		Url:         server.URL,
+		AccessToken: "test-token",
+		Environment: "test",
+		CodeVersion: "1.2.3",
+	})
+}
+
+// Asserts events are posted as Rollbar items built from their fields
+func TestRollbarSendItem(t *testing.T) {
+
+	items := make(chan rollbarItem, 1)
+	connector := newTestRollbarConnector(t, func(w http.ResponseWriter, r *http.Request) {
+		if token := r.Header.Get("X-Rollbar-Access-Token"); token != "test-token" {
+			t.Errorf("Unexpected access token %s", token)
+		}
+		var item rollbarItem
+		if err := json.NewDecoder(r.Body).Decode(&item); err != nil {
+			t.Error(err)
+		}
+		items <- item
+		w.Write([]byte(`{"err": 0, "result": {"uuid": "some-uuid"}}`))
+	})
+
+	ts := time.Date(2020, 10, 7, 20, 56, 47, 0, time.UTC)
+	e := &events.Event{
+		Text:      "[2020-10-07 20:56:47][WARN][009] Disk almost full",
+		Source:    "/var/log/app.log",
+		Timestamp: ts,
+		Fields:    map[string]string{"level": "WARN", "code": "009", "message": "Disk almost full"},
+	}
+	if err := connector.Send(e); err != nil {
+		t.Fatal(err)
+	}
+
+	data := (<-items).Data
+	if data.Level != "warning" || data.Body.Message.Body != "Disk almost full" || data.Fingerprint != "009" {
+		t.Errorf("Unexpected item level %s, message %s and fingerprint %s", data.Level, data.Body.Message.Body, data.Fingerprint)
+	}
+	if data.Environment != "test" || data.CodeVersion != "1.2.3" || data.Timestamp != ts.Unix() {
+		t.Errorf("Unexpected item environment %s, code version %s and timestamp %d", data.Environment, data.CodeVersion, data.Timestamp)
+	}
+	if data.Custom["code"] != "009" || data.Custom["source"] != "/var/log/app.log" {
+		t.Errorf("Unexpected item custom fields %v", data.Custom)
+	}
+	if again := connector.buildItem(e).Data.UUID; again != data.UUID {
+		t.Errorf("Item UUID should be stable across retries, got %s and %s", data.UUID, again)
+	}
+	if level := connector.buildItem(&events.Event{Text: "Unleveled line"}).Data.Level; level != "info" {
+		t.Errorf("Expected events without a known level reported as info, got %s", level)
+	}
+}
+
+// Asserts rate limited and rejected items are reported as errors, telling how long to wait when rate limited
+func TestRollbarSendErrors(t *testing.T) {
+
+	connector := newTestRollbarConnector(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Rate-Limit-Remaining-Seconds", "42")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	err := connector.Send(&events.Event{Text: "line"})
+	var rateLimit RateLimitError
+	if !errors.As(err, &rateLimit) || rateLimit.RetryAfter() != 42*time.Second {
+		t.Errorf("Expected rate limit error with 42s wait, got %v", err)
+	}
+
+	connector = newTestRollbarConnector(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"err": 1, "message": "invalid access token"}`))
+	})
+	err = connector.Send(&events.Event{Text: "line"})
+	if err == nil || err.Error() != "Rollbar API responded 401: invalid access token" {
+		t.Errorf("Unexpected error for rejected item: %v", err)
+	}
+}
@@ -1,31 +1,60 @@
 package connectors
 
 import (
-	"errors"
+	"bytes"
+	"compress/gzip"
 	"fmt"
-	"regexp"
-	"strings"
+	"net/url"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/dimpogissou/isengard-server/config"
+	"github.com/dimpogissou/isengard-server/events"
 	"github.com/dimpogissou/isengard-server/logger"
-	"github.com/hpcloud/tail"
-	uuid "github.com/nu7hatch/gouuid"
+	"github.com/klauspost/compress/zstd"
 )
 
+// S3Connector archives events to S3. Events passed to SendAsync are buffered and written as one object per batch,
+// events passed to Send are written right away as their own object.
+// Events are batched by object key, so that every event of a batch matches the key template partitions.
 type S3Connector struct {
-	session *session.Session
-	client  *s3.S3
-	cfg     config.S3ConnectorConfig
+	session     *session.Session
+	client      *s3.S3
+	cfg         config.S3ConnectorConfig
+	keyTemplate config.Template
+	batches     *s3Batches
+}
+
+// Open batches by partition, i.e. object key rendered without its per-object placeholders
+type s3Batches struct {
+	mu   sync.Mutex
+	open map[string]*s3Batch
+}
+
+// Events buffered until they are written to S3 as a single object
+type s3Batch struct {
+	first *events.Event
+	lines [][]byte
+	size  int64
+	dones []func(error)
+	timer *time.Timer
 }
 
 func (c S3Connector) GetName() string {
 	return c.cfg.Name
 }
 
+func (c S3Connector) GetLevels() []string {
+	return c.cfg.Levels
+}
+
+func (c S3Connector) GetDelivery() config.DeliveryConfig {
+	return c.cfg.Delivery
+}
+
 // Sets up S3 client
 func SetupS3Client(cfg config.S3ConnectorConfig) (*session.Session, *s3.S3) {
 	sessionPtr := session.Must(session.NewSession(&aws.Config{
@@ -39,35 +68,146 @@ func SetupS3Client(cfg config.S3ConnectorConfig) (*session.Session, *s3.S3) {
 	return sessionPtr, client
 }
 
+// Creates an S3 connector batching events with the provided client, panics on an invalid key template
+func NewS3Connector(cfg config.S3ConnectorConfig, session *session.Session, client *s3.S3) S3Connector {
+	cfg.Object = cfg.ObjectWithDefaults()
+	cfg.Batch = cfg.Batch.WithDefaults()
+	keyTemplate, err := config.ParseTemplate(cfg.ObjectKeyTemplate())
+	if err != nil {
+		panic(fmt.Sprintf("Invalid key template for S3 connector %s: %v", cfg.Name, err))
+	}
+	return S3Connector{
+		cfg:         cfg,
+		session:     session,
+		client:      client,
+		keyTemplate: keyTemplate,
+		batches:     &s3Batches{open: map[string]*s3Batch{}},
+	}
+}
+
+// Writes the pending batches before closing
 func (c S3Connector) Close() error {
-	logger.Info("Closed S3 connector (no-op) ...")
-	return nil
-}
-
-// Parses a log line into a string map using the regex built from config
-func parseLine(l *tail.Line, re *regexp.Regexp) (map[string]string, error) {
-	match := re.FindStringSubmatch(l.Text)
-	if match == nil {
-		return make(map[string]string), errors.New("No match found in line, returning empty map")
-	} else {
-		paramsMap := make(map[string]string)
-		for i, name := range re.SubexpNames() {
-			if i > 0 && i <= len(match) {
-				paramsMap[name] = match[i]
+	var err error
+	if c.batches != nil {
+		c.batches.mu.Lock()
+		pending := []*s3Batch{}
+		for partition := range c.batches.open {
+			pending = append(pending, c.batches.take(partition))
+		}
+		c.batches.mu.Unlock()
+		for _, batch := range pending {
+			if writeErr := c.writeBatch(batch); writeErr != nil {
+				err = writeErr
 			}
 		}
-		return paramsMap, nil
 	}
+	logger.CheckErrAndLog(err, "S3FlushOnCloseError", fmt.Sprintf("Failed writing pending batches of S3 connector %s", c.cfg.Name))
+	logger.Info("Closed S3 connector ...")
+	return err
+}
+
+// Takes the batch of a partition out of the open batches, must be called with the lock held
+func (b *s3Batches) take(partition string) *s3Batch {
+	batch := b.open[partition]
+	if batch.timer != nil {
+		batch.timer.Stop()
+	}
+	delete(b.open, partition)
+	return batch
+}
+
+// Returns the partition of an event, i.e. its object key without the placeholders varying per object
+func (c S3Connector) partition(e *events.Event) string {
+	return c.keyTemplate.Render(func(name, arg string) string {
+		if name == "uuid" || name == "now" {
+			return ""
+		}
+		value, _ := eventTemplateValue(e, name, arg)
+		return value
+	})
+}
+
+// Encodes an event as a line of the configured format
+func (c S3Connector) encodeLine(e *events.Event) ([]byte, error) {
+	if c.cfg.Batch.Format == "ndjson" {
+		return encodePayload("json", e)
+	}
+	return encodePayload("raw", e)
+}
+
+// Builds the object body of a batch, compressed with the configured algorithm
+func (c S3Connector) encodeBatch(lines [][]byte) ([]byte, error) {
+
+	// Raw lines are joined by newlines, NDJSON lines are all newline terminated
+	body := bytes.Join(lines, []byte("\n"))
+	if c.cfg.Batch.Format == "ndjson" {
+		body = append(body, '\n')
+	}
+
+	var buf bytes.Buffer
+	switch c.cfg.Batch.Compression {
+	case "gzip":
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(body); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	case "zstd":
+		w, err := zstd.NewWriter(&buf)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(body); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		return body, nil
+	}
+	return buf.Bytes(), nil
+}
+
+// Returns a unique object key for a batch, rendered from its first event
+func (c S3Connector) objectKey(first *events.Event) string {
+	return renderEventTemplate(c.keyTemplate, first, "unknown")
 }
 
-// Puts a tailed line into the specified bucket
-func (c S3Connector) s3PutObject(bucket string, fileKey string, line *tail.Line) (*s3.PutObjectOutput, error) {
+// Puts an object body into the specified bucket with the configured object settings
+func (c S3Connector) s3PutObject(bucket string, fileKey string, body []byte) (*s3.PutObjectOutput, error) {
 
+	object := c.cfg.Object
 	p := s3.PutObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(fileKey),
-		ACL:    aws.String("public-read"),
-		Body:   strings.NewReader(line.Text),
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(fileKey),
+		ACL:         aws.String(object.ACL),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String(object.ContentType),
+	}
+	if object.ContentEncoding != "" {
+		p.ContentEncoding = aws.String(object.ContentEncoding)
+	}
+	if object.StorageClass != "" {
+		p.StorageClass = aws.String(object.StorageClass)
+	}
+	if object.ServerSideEncryption != "" {
+		p.ServerSideEncryption = aws.String(object.ServerSideEncryption)
+	}
+	if object.KMSKeyId != "" {
+		p.SSEKMSKeyId = aws.String(object.KMSKeyId)
+	}
+	if len(object.Metadata) > 0 {
+		p.Metadata = aws.StringMap(object.Metadata)
+	}
+	if len(object.Tags) > 0 {
+		tags := url.Values{}
+		for key, value := range object.Tags {
+			tags.Set(key, value)
+		}
+		p.Tagging = aws.String(tags.Encode())
 	}
 
 	r, err := c.client.PutObject(&p)
@@ -78,22 +218,80 @@ func (c S3Connector) s3PutObject(bucket string, fileKey string, line *tail.Line)
 	return r, nil
 }
 
-func (c S3Connector) Send(line *tail.Line) error {
-	t := time.Now()
-	uuid, err := uuid.NewV4()
-	if err != nil {
-		logger.Error("CreateUuidError", err.Error())
-		return err
+// Writes a batch as a single object and reports the result to each of its events
+func (c S3Connector) writeBatch(pending *s3Batch) error {
+	if pending == nil || len(pending.lines) == 0 {
+		return nil
+	}
+	body, err := c.encodeBatch(pending.lines)
+	fileName := c.objectKey(pending.first)
+	if err == nil {
+		logger.Info(fmt.Sprintf("Sending file '%s' with %d lines to S3 bucket '%s'", fileName, len(pending.lines), c.cfg.Bucket))
+		_, err = c.s3PutObject(c.cfg.Bucket, fileName, body)
 	}
-	fileName := fmt.Sprintf("%s/%d-%02d-%02dT%02d-%02d-%02d-%v",
-		c.cfg.KeyPrefix,
-		t.Year(), t.Month(), t.Day(),
-		t.Hour(), t.Minute(), t.Second(), uuid)
-	_, err = c.s3PutObject(c.cfg.Bucket, fileName, line)
-	logger.Info(fmt.Sprintf("Sending file '%s' to S3 bucket '%s'", fileName, c.cfg.Bucket))
 	if err != nil {
 		logger.Error("S3PutObjectError", err.Error())
+	}
+	for _, done := range pending.dones {
+		if done != nil {
+			done(err)
+		}
+	}
+	return err
+}
+
+// Writes the batch of a partition if it is still the one the expired timer was started for
+func (c S3Connector) flushExpired(partition string, batch *s3Batch) {
+	c.batches.mu.Lock()
+	if c.batches.open[partition] != batch {
+		c.batches.mu.Unlock()
+		return
+	}
+	c.batches.take(partition)
+	c.batches.mu.Unlock()
+	c.writeBatch(batch)
+}
+
+// Adds an event to the batch of its partition, which is written once it reaches its size, line count or age limit.
+// done is called once the batch containing the event was written.
+func (c S3Connector) SendAsync(e *events.Event, done func(error)) {
+	line, err := c.encodeLine(e)
+	if err != nil {
+		done(err)
+		return
+	}
+
+	partition := c.partition(e)
+	c.batches.mu.Lock()
+	batch, ok := c.batches.open[partition]
+	if !ok {
+		batch = &s3Batch{first: e}
+		batch.timer = time.AfterFunc(c.cfg.Batch.MaxAge, func() { c.flushExpired(partition, batch) })
+		c.batches.open[partition] = batch
+	}
+	batch.lines = append(batch.lines, line)
+	batch.dones = append(batch.dones, done)
+	batch.size += int64(len(line)) + 1
+
+	var pending *s3Batch
+	if batch.size >= c.cfg.Batch.MaxBytes || len(batch.lines) >= c.cfg.Batch.MaxLines {
+		pending = c.batches.take(partition)
+	}
+	c.batches.mu.Unlock()
+
+	c.writeBatch(pending)
+}
+
+// Returns the number of events a batch may hold
+func (c S3Connector) MaxPending() int {
+	return c.cfg.Batch.MaxLines
+}
+
+// Writes a single event as its own object
+func (c S3Connector) Send(e *events.Event) error {
+	line, err := c.encodeLine(e)
+	if err != nil {
 		return err
 	}
-	return nil
+	return c.writeBatch(&s3Batch{first: e, lines: [][]byte{line}})
 }
@@ -1,16 +1,27 @@
 package connectors
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/dimpogissou/isengard-server/config"
+	"github.com/dimpogissou/isengard-server/events"
 	"github.com/dimpogissou/isengard-server/logger"
-	"github.com/hpcloud/tail"
+	"github.com/klauspost/compress/zstd"
 )
 
 // Util function creating S3 bucket for integration test,
@@ -125,7 +136,7 @@ func TestWriteToS3(t *testing.T) {
 		Levels:    []string{"INFO", "DEBUG", "WARN", "ERROR"},
 	}
 	session, client := SetupS3Client(cfg)
-	connector := S3Connector{cfg: cfg, session: session, client: client}
+	connector := NewS3Connector(cfg, session, client)
 	defer connector.Close()
 
 	// Create test S3 bucket and defer its deletion
@@ -133,9 +144,9 @@ func TestWriteToS3(t *testing.T) {
 	defer deleteFilesAndBucket(connector.client, testBucket, testKeyPrefix)
 
 	// Send lines to test s3 bucket
-	line := tail.Line{Text: testString}
+	e := events.Event{Text: testString}
 	for i := 0; i < nFiles; i++ {
-		if connector.Send(&line) != nil {
+		if connector.Send(&e) != nil {
 			t.Errorf("S3 connector Send function failed")
 		}
 	}
@@ -156,3 +167,211 @@ func TestWriteToS3(t *testing.T) {
 	}
 
 }
+
+// Object written to the S3 stand-in
+type putObject struct {
+	key    string
+	header http.Header
+	body   []byte
+}
+
+// Creates an S3 connector writing to a local HTTP stand-in, returning the channel of written objects
+func newTestS3Connector(t *testing.T, cfg config.S3ConnectorConfig) (S3Connector, chan putObject) {
+
+	objects := make(chan putObject, 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		objects <- putObject{key: r.URL.Path, header: r.Header, body: body}
+	}))
+	t.Cleanup(server.Close)
+
+	cfg.Name, cfg.Endpoint, cfg.KeyPrefix, cfg.Bucket, cfg.Region = "testS3Connector", server.URL, "prefix", "bucket", "us-east-1"
+	session := session.Must(session.NewSession(&aws.Config{
+		S3ForcePathStyle: aws.Bool(true),
+		Region:           aws.String(cfg.Region),
+		Endpoint:         aws.String(cfg.Endpoint),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+	}))
+	return NewS3Connector(cfg, session, s3.New(session)), objects
+}
+
+// Asserts events are written as one object once the batch reaches its line count, and reported as sent
+func TestS3BatchFlushesOnMaxLines(t *testing.T) {
+
+	connector, objects := newTestS3Connector(t, config.S3ConnectorConfig{Batch: config.S3BatchConfig{MaxLines: 3, MaxAge: time.Hour}})
+
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		connector.SendAsync(&events.Event{Text: fmt.Sprintf("line-%d", i)}, func(err error) { errs <- err })
+	}
+
+	select {
+	case o := <-objects:
+		if want := "line-0\nline-1\nline-2"; string(o.body) != want {
+			t.Errorf("Unexpected batch content, got %q, want %q", o.body, want)
+		}
+		if !strings.HasPrefix(o.key, "/bucket/prefix/") {
+			t.Errorf("Unexpected object key %s", o.key)
+		}
+	default:
+		t.Fatalf("Batch not written after reaching its line limit")
+	}
+	for i := 0; i < 3; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Unexpected send error: %v", err)
+		}
+	}
+}
+
+// Asserts a partial batch is written once it reaches its max age, and on Close
+func TestS3BatchFlushesOnMaxAgeAndClose(t *testing.T) {
+
+	connector, objects := newTestS3Connector(t, config.S3ConnectorConfig{Batch: config.S3BatchConfig{MaxAge: 50 * time.Millisecond}})
+
+	connector.SendAsync(&events.Event{Text: "aged"}, func(error) {})
+	select {
+	case o := <-objects:
+		if string(o.body) != "aged" {
+			t.Errorf("Unexpected batch content, got %q, want %q", o.body, "aged")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Batch not written after reaching its max age")
+	}
+
+	connector, objects = newTestS3Connector(t, config.S3ConnectorConfig{Batch: config.S3BatchConfig{MaxAge: time.Hour}})
+	connector.SendAsync(&events.Event{Text: "pending"}, func(error) {})
+	if err := connector.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case o := <-objects:
+		if string(o.body) != "pending" {
+			t.Errorf("Unexpected batch content, got %q, want %q", o.body, "pending")
+		}
+	default:
+		t.Fatalf("Pending batch not written on Close")
+	}
+}
+
+// Asserts NDJSON batches are compressed with the configured algorithm and named accordingly
+func TestS3BatchCompression(t *testing.T) {
+
+	cases := []struct {
+		compression string
+		extension   string
+		decompress  func([]byte) ([]byte, error)
+	}{
+		{"gzip", ".ndjson.gz", func(b []byte) ([]byte, error) {
+			r, err := gzip.NewReader(bytes.NewReader(b))
+			if err != nil {
+				return nil, err
+			}
+			return ioutil.ReadAll(r)
+		}},
+		{"zstd", ".ndjson.zst", func(b []byte) ([]byte, error) {
+			r, err := zstd.NewReader(bytes.NewReader(b))
+			if err != nil {
+				return nil, err
+			}
+			defer r.Close()
+			return ioutil.ReadAll(r)
+		}},
+	}
+	for _, c := range cases {
+		connector, objects := newTestS3Connector(t, config.S3ConnectorConfig{Batch: config.S3BatchConfig{MaxLines: 2, Format: "ndjson", Compression: c.compression}})
+		connector.SendAsync(&events.Event{Text: "first", Fields: map[string]string{"level": "INFO"}}, func(error) {})
+		connector.SendAsync(&events.Event{Text: "second"}, func(error) {})
+
+		o := <-objects
+		if !strings.HasSuffix(o.key, c.extension) {
+			t.Errorf("Compression %s: object key %s missing extension %s", c.compression, o.key, c.extension)
+		}
+		body, err := c.decompress(o.body)
+		if err != nil {
+			t.Fatalf("Compression %s: %v", c.compression, err)
+		}
+		lines := strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+		if len(lines) != 2 {
+			t.Fatalf("Compression %s: got %d lines, want 2", c.compression, len(lines))
+		}
+		var e events.Event
+		if err := json.Unmarshal([]byte(lines[0]), &e); err != nil || e.Text != "first" || e.Field("level") != "INFO" {
+			t.Errorf("Compression %s: unexpected first event %s (%v)", c.compression, lines[0], err)
+		}
+	}
+}
+
+// Asserts object keys are rendered from the event fields, and events only batched with events of the same partition
+func TestS3KeyTemplatePartitions(t *testing.T) {
+
+	connector, objects := newTestS3Connector(t, config.S3ConnectorConfig{KeyTemplate: "app/{level}/dt={ts:2006-01-02}/hour={ts:15}/{source}-{code}-{uuid}.log", Batch: config.S3BatchConfig{MaxLines: 2, MaxAge: time.Hour}})
+
+	ts := time.Date(2020, 10, 7, 20, 56, 47, 0, time.UTC)
+	send := func(level string, text string) {
+		e := &events.Event{Text: text, Source: "/var/log/app.log", Timestamp: ts, Fields: map[string]string{"level": level, "code": "009"}}
+		connector.SendAsync(e, func(error) {})
+	}
+	send("INFO", "info-1")
+	send("ERROR", "error-1")
+	send("INFO", "info-2")
+
+	select {
+	case o := <-objects:
+		if !strings.HasPrefix(o.key, "/bucket/app/INFO/dt=2020-10-07/hour=20/app.log-009-") || !strings.HasSuffix(o.key, ".log") {
+			t.Errorf("Unexpected object key %s", o.key)
+		}
+		if want := "info-1\ninfo-2"; string(o.body) != want {
+			t.Errorf("Unexpected batch content, got %q, want %q", o.body, want)
+		}
+	default:
+		t.Fatalf("Partition batch not written after reaching its line limit")
+	}
+
+	connector.Close()
+	o := <-objects
+	if !strings.HasPrefix(o.key, "/bucket/app/ERROR/") || string(o.body) != "error-1" {
+		t.Errorf("Unexpected object %s written on Close with content %q", o.key, o.body)
+	}
+}
+
+// Asserts objects are private by default and written with the configured storage class, encryption, metadata and tags
+func TestS3ObjectSettings(t *testing.T) {
+
+	connector, objects := newTestS3Connector(t, config.S3ConnectorConfig{Batch: config.S3BatchConfig{Format: "ndjson", Compression: "gzip"}})
+	if err := connector.Send(&events.Event{Text: "line"}); err != nil {
+		t.Fatal(err)
+	}
+	o := <-objects
+	for header, want := range map[string]string{"X-Amz-Acl": "private", "Content-Type": "application/x-ndjson", "Content-Encoding": "gzip"} {
+		if got := o.header.Get(header); got != want {
+			t.Errorf("Default object header %s: got %s, want %s", header, got, want)
+		}
+	}
+
+	connector, objects = newTestS3Connector(t, config.S3ConnectorConfig{Object: config.S3ObjectConfig{
+		ACL:                  "bucket-owner-full-control",
+		StorageClass:         "STANDARD_IA",
+		ServerSideEncryption: "aws:kms",
+		KMSKeyId:             "some-key",
+		ContentType:          "text/x-log",
+		Metadata:             map[string]string{"service": "api"},
+		Tags:                 map[string]string{"env": "prod"},
+	}})
+	if err := connector.Send(&events.Event{Text: "line"}); err != nil {
+		t.Fatal(err)
+	}
+	o = <-objects
+	for header, want := range map[string]string{
+		"X-Amz-Acl":                                   "bucket-owner-full-control",
+		"X-Amz-Storage-Class":                         "STANDARD_IA",
+		"X-Amz-Server-Side-Encryption":                "aws:kms",
+		"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id": "some-key",
+		"Content-Type":                                "text/x-log",
+		"X-Amz-Meta-Service":                          "api",
+		"X-Amz-Tagging":                               "env=prod",
+	} {
+		if got := o.header.Get(header); got != want {
+			t.Errorf("Object header %s: got %s, want %s", header, got, want)
+		}
+	}
+}
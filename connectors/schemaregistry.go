@@ -0,0 +1,97 @@
+package connectors
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dimpogissou/isengard-server/config"
+)
+
+const schemaRegistryContentType = "application/vnd.schemaregistry.v1+json"
+const schemaRegistryTimeout = 10 * time.Second
+
+// Client of the Confluent schema registry REST API
+type schemaRegistry struct {
+	url      string
+	username string
+	password string
+	client   *http.Client
+}
+
+// Schema as sent to the registry, SchemaType is empty for Avro
+type registrySchema struct {
+	Schema     string `json:"schema"`
+	SchemaType string `json:"schemaType,omitempty"`
+}
+
+// Registry responses, Id is set on success and ErrorCode/Message on failure
+type registryResponse struct {
+	Id        int32  `json:"id"`
+	ErrorCode int    `json:"error_code"`
+	Message   string `json:"message"`
+}
+
+// Creates a schema registry client
+func newSchemaRegistry(cfg config.KafkaSchemaRegistryConfig) (*schemaRegistry, error) {
+	password, err := cfg.GetPassword()
+	if err != nil {
+		return nil, err
+	}
+	return &schemaRegistry{
+		url:      strings.TrimSuffix(cfg.Url, "/"),
+		username: cfg.Username,
+		password: password,
+		client:   &http.Client{Timeout: schemaRegistryTimeout},
+	}, nil
+}
+
+// Posts a schema to a registry endpoint, returning the schema ID from the response
+func (r *schemaRegistry) post(path string, schema registrySchema) (int32, error) {
+
+	body, err := json.Marshal(schema)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest(http.MethodPost, r.url+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", schemaRegistryContentType)
+	req.Header.Set("Accept", schemaRegistryContentType)
+	if r.username != "" {
+		req.SetBasicAuth(r.username, r.password)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	var result registryResponse
+	json.Unmarshal(respBody, &result)
+	if resp.StatusCode/100 != 2 {
+		if result.Message == "" {
+			result.Message = string(respBody)
+		}
+		return 0, errors.New(fmt.Sprintf("Schema registry responded %d to %s: %s", resp.StatusCode, path, result.Message))
+	}
+	return result.Id, nil
+}
+
+// Registers a schema under a subject, returning its ID. Registering an existing schema returns its current ID.
+func (r *schemaRegistry) register(subject string, schema registrySchema) (int32, error) {
+	return r.post(fmt.Sprintf("/subjects/%s/versions", url.PathEscape(subject)), schema)
+}
+
+// Looks up the ID of a schema already registered under a subject
+func (r *schemaRegistry) lookup(subject string, schema registrySchema) (int32, error) {
+	return r.post(fmt.Sprintf("/subjects/%s", url.PathEscape(subject)), schema)
+}
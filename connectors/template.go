@@ -0,0 +1,77 @@
+package connectors
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/dimpogissou/isengard-server/config"
+	"github.com/dimpogissou/isengard-server/events"
+	"github.com/dimpogissou/isengard-server/logger"
+	uuid "github.com/nu7hatch/gouuid"
+)
+
+// Host name resolved once for all templates
+var hostname = func() string {
+	name, err := os.Hostname()
+	if err != nil {
+		logger.Error("HostnameError", err.Error())
+		return "unknown"
+	}
+	return name
+}()
+
+// Returns a stable hash of the event position, identifying the event across retries and restarts
+func eventHash(e *events.Event) string {
+	h := fnv.New64a()
+	h.Write([]byte(fmt.Sprintf("%s:%d", e.Source, e.Offset)))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// Returns the value of a template placeholder for an event and whether the event has one.
+// {ts:layout} formats the event time and {now:layout} the current time, both in UTC.
+// {hash} is a stable hash of the event source path and offset.
+func eventTemplateValue(e *events.Event, name, arg string) (string, bool) {
+	switch name {
+	case "ts":
+		return e.Timestamp.UTC().Format(arg), true
+	case "now":
+		return time.Now().UTC().Format(arg), true
+	case "level":
+		level := e.Level()
+		return level, level != ""
+	case "source":
+		if e.Source == "" {
+			return "", false
+		}
+		return filepath.Base(e.Source), true
+	case "hostname":
+		return hostname, true
+	case "offset":
+		return strconv.FormatInt(e.Offset, 10), true
+	case "hash":
+		return eventHash(e), true
+	case "uuid":
+		id, err := uuid.NewV4()
+		if err != nil {
+			logger.Error("CreateUuidError", err.Error())
+			return "", false
+		}
+		return id.String(), true
+	}
+	value, ok := e.Fields[name]
+	return value, ok && value != ""
+}
+
+// Renders a template for an event, replacing placeholders without a value by missing
+func renderEventTemplate(t config.Template, e *events.Event, missing string) string {
+	return t.Render(func(name, arg string) string {
+		if value, ok := eventTemplateValue(e, name, arg); ok {
+			return value
+		}
+		return missing
+	})
+}
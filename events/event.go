@@ -0,0 +1,98 @@
+package events
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/dimpogissou/isengard-server/config"
+	"github.com/dimpogissou/isengard-server/logger"
+)
+
+// Event is a log record built once by the tailer and shared by all connectors
+type Event struct {
+	Text       string                 `json:"text"`             // Raw text of the line
+	Fields     map[string]string      `json:"fields"`           // Fields parsed from the line by the input parser
+	Values     map[string]interface{} `json:"values,omitempty"` // Typed values of the fields with a type
+	Matched    bool                   `json:"matched"`          // Whether the line matched the configured LogPattern
+	Source     string                 `json:"source"`           // Path of the file the line was read from
+	Offset     int64                  `json:"offset"`           // Byte offset of the start of the line in Source
+	IngestTime time.Time              `json:"ingestTime"`       // Time at which the line was read
+	Timestamp  time.Time              `json:"timestamp"`        // Parsed log timestamp, IngestTime if it could not be parsed
+	Tags       []string               `json:"tags"`             // Free-form tags attached to the event
+
+	pendingAcks int32
+	onAck       func()
+}
+
+// Builds an event from a raw line, parsing its fields with the provided parser if not nil.
+// Fields with a type which cannot be converted are kept as text only and reported in a warning.
+// The event time is the typed timestamp field, or the timestamp field parsed with the known layouts.
+func New(text string, source string, offset int64, parser config.Parser) *Event {
+
+	now := time.Now()
+	e := Event{
+		Text:       text,
+		Fields:     make(map[string]string),
+		Source:     source,
+		Offset:     offset,
+		IngestTime: now,
+		Timestamp:  now,
+	}
+
+	if parser != nil {
+		fields, err := parser.Parse(text)
+		if err == nil {
+			e.Fields = fields
+			e.Matched = true
+			var errs []error
+			e.Values, errs = config.ConvertFields(fields, parser.Types())
+			if len(errs) > 0 {
+				logger.Warn("FieldConversionError", fmt.Sprintf("Line at offset %d of %s -> %v", offset, source, errs))
+			}
+		}
+	}
+
+	if ts, ok := e.Values["timestamp"].(time.Time); ok {
+		e.Timestamp = ts
+	} else if ts, ok := config.ParseTimestamp(e.Fields["timestamp"]); ok {
+		e.Timestamp = ts
+	}
+
+	return &e
+}
+
+// Returns the value of a parsed field, or an empty string if missing
+func (e *Event) Field(name string) string {
+	return e.Fields[name]
+}
+
+// Returns the normalised level of the event, or an empty string if the line has no level
+func (e *Event) Level() string {
+	return config.NormaliseLevel(e.Fields["level"])
+}
+
+// Returns the byte offset right after the end of the line in Source
+func (e *Event) EndOffset() int64 {
+	return e.Offset + int64(len(e.Text)) + 1
+}
+
+// Registers the callback run once every delivery of the event has been acknowledged
+func (e *Event) OnAcknowledged(f func()) {
+	e.onAck = f
+}
+
+// Sets the number of deliveries to acknowledge, running the callback right away if there are none
+func (e *Event) ExpectAcks(n int) {
+	atomic.StoreInt32(&e.pendingAcks, int32(n))
+	if n == 0 && e.onAck != nil {
+		e.onAck()
+	}
+}
+
+// Acknowledges one delivery of the event
+func (e *Event) Ack() {
+	if atomic.AddInt32(&e.pendingAcks, -1) == 0 && e.onAck != nil {
+		e.onAck()
+	}
+}
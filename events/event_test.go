@@ -0,0 +1,117 @@
+package events
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/dimpogissou/isengard-server/config"
+)
+
+// Tests an event is built with parsed fields, timestamp and offsets from a matching line
+func TestNewEvent(t *testing.T) {
+
+	re := regexp.MustCompile("\\[(?P<timestamp>[^\\]]+)\\]\\[(?P<level>[A-Z]+)\\]\\[(?P<code>[0-9]+)\\]\\s(?P<message>.*)")
+	const text = "[2020-10-07 20:56:47.375586 UTC][WARN][009] Log message"
+
+	e := New(text, "/var/log/app.log", 100, config.NewRegexParser(re))
+
+	if !e.Matched {
+		t.Fatalf("Event not matching pattern for line %s", text)
+	}
+	if e.Field("code") != "009" || e.Field("message") != "Log message" {
+		t.Errorf("Unexpected parsed fields, got %v", e.Fields)
+	}
+	if e.Level() != "WARNING" {
+		t.Errorf("Unexpected event level, got %s, want WARNING", e.Level())
+	}
+	want := time.Date(2020, 10, 7, 20, 56, 47, 375586000, time.UTC)
+	if !e.Timestamp.Equal(want) {
+		t.Errorf("Unexpected event timestamp, got %v, want %v", e.Timestamp, want)
+	}
+	if e.Source != "/var/log/app.log" || e.EndOffset() != 100+int64(len(text))+1 {
+		t.Errorf("Unexpected event source or end offset, got %s and %d", e.Source, e.EndOffset())
+	}
+}
+
+// Tests a line not matching the pattern has no fields and falls back to the ingest time
+func TestNewUnmatchedEvent(t *testing.T) {
+
+	re := regexp.MustCompile("\\[(?P<level>[A-Z]+)\\]\\s(?P<message>.*)")
+	e := New("Unmatched line", "app.log", 0, config.NewRegexParser(re))
+
+	if e.Matched || len(e.Fields) != 0 || e.Level() != "" {
+		t.Errorf("Unexpected parsing of unmatched line, got matched = %v, fields = %v", e.Matched, e.Fields)
+	}
+	if !e.Timestamp.Equal(e.IngestTime) {
+		t.Errorf("Unmatched event timestamp should equal ingest time, got %v and %v", e.Timestamp, e.IngestTime)
+	}
+}
+
+// Tests typed grok captures are converted to typed values alongside the text fields
+func TestNewTypedEvent(t *testing.T) {
+
+	parser, err := config.BuildInputParser(config.InputConfig{LogPattern: "^%{LOGLEVEL:level} %{NUMBER:code:int} %{NUMBER:latency:float}"})
+	if err != nil {
+		t.Fatalf("Cannot build parser: %v", err)
+	}
+
+	e := New("ERROR 503 1.5", "app.log", 0, parser)
+
+	if e.Field("code") != "503" {
+		t.Errorf("Unexpected code field, got %s, want 503", e.Field("code"))
+	}
+	if e.Values["code"] != int64(503) || e.Values["latency"] != 1.5 {
+		t.Errorf("Unexpected typed values, got %v", e.Values)
+	}
+}
+
+// Tests a JSON line gives the same timestamp, level and fields as a line parsed with a log pattern
+func TestNewJSONEvent(t *testing.T) {
+
+	parser := config.NewJSONParser(config.ParserConfig{Type: "json", TimestampKey: "time", LevelKey: "severity"})
+	const text = `{"time":"2020-10-07T20:56:47.375586Z","severity":"warn","message":"Log message","http":{"status":503}}`
+
+	e := New(text, "app.log", 0, parser)
+
+	if !e.Matched || e.Field("message") != "Log message" || e.Field("http.status") != "503" {
+		t.Errorf("Unexpected parsed fields, got %v", e.Fields)
+	}
+	if e.Level() != "WARNING" {
+		t.Errorf("Unexpected event level, got %s, want WARNING", e.Level())
+	}
+	for level, want := range map[string]string{"fatal": "ERROR", "err": "ERROR", "information": "INFO"} {
+		if got := New(`{"severity":"`+level+`"}`, "app.log", 0, parser).Level(); got != want {
+			t.Errorf("Unexpected level of JSON event with severity %s, got %s, want %s", level, got, want)
+		}
+	}
+	want := time.Date(2020, 10, 7, 20, 56, 47, 375586000, time.UTC)
+	if !e.Timestamp.Equal(want) {
+		t.Errorf("Unexpected event timestamp, got %v, want %v", e.Timestamp, want)
+	}
+}
+
+// Tests a typed timestamp field gives the event time in its configured timezone
+func TestNewEventTypedTimestamp(t *testing.T) {
+
+	parser, err := config.BuildInputParser(config.InputConfig{
+		LogPattern:  "^(?P<timestamp>%{Date}) %{GREEDYDATA:message}",
+		Definitions: []config.PatternConfig{{Name: "Date", Pattern: "\\S+ \\S+", Type: "timestamp", Format: "%Y/%m/%d %H:%M:%S", Timezone: "Europe/Paris"}},
+	})
+	if err != nil {
+		t.Fatalf("Cannot build parser: %v", err)
+	}
+
+	e := New("2020/10/07 20:56:47 Log message", "app.log", 0, parser)
+
+	want := time.Date(2020, 10, 7, 18, 56, 47, 0, time.UTC)
+	if !e.Timestamp.Equal(want) {
+		t.Errorf("Unexpected event timestamp, got %v, want %v", e.Timestamp, want)
+	}
+
+	e = New("2020/13/07 20:56:47 Log message", "app.log", 0, parser)
+
+	if !e.Matched || e.Timestamp != e.IngestTime || e.Field("timestamp") != "2020/13/07 20:56:47" {
+		t.Errorf("Unexpected event with invalid timestamp, got %v at %v", e.Fields, e.Timestamp)
+	}
+}
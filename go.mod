@@ -5,6 +5,8 @@ go 1.15
 require (
 	github.com/aws/aws-sdk-go v1.35.7
 	github.com/hpcloud/tail v1.0.0
+	github.com/klauspost/compress v1.9.8
+	github.com/linkedin/goavro/v2 v2.9.8
 	github.com/nu7hatch/gouuid v0.0.0-20131221200532-179d4d0c4d8d
 	github.com/op/go-logging v0.0.0-20160315200505-970db520ece7
 	github.com/segmentio/kafka-go v0.4.5
@@ -2,16 +2,18 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/dimpogissou/isengard-server/checkpoint"
 	"github.com/dimpogissou/isengard-server/config"
 	"github.com/dimpogissou/isengard-server/connectors"
 	"github.com/dimpogissou/isengard-server/logger"
 	"github.com/dimpogissou/isengard-server/observer"
 	"github.com/dimpogissou/isengard-server/tailing"
-	"github.com/hpcloud/tail"
 	"gopkg.in/fsnotify.v1"
 )
 
@@ -31,44 +33,123 @@ func main() {
 	// Validate and loads config, panics if error
 	cfg := config.ValidateAndLoadConfig(configPtr)
 
+	// Open checkpoint store if configured, positions are flushed on exit after tails and connectors are closed
+	var store *checkpoint.Store
+	if cfg.CheckpointFile != "" {
+		var err error
+		store, err = checkpoint.Open(cfg.CheckpointFile, cfg.CheckpointInterval)
+		logger.CheckErrAndPanic(err, "FailedOpeningCheckpoints", fmt.Sprintf("Failed opening checkpoint file %s", cfg.CheckpointFile))
+		defer store.Close()
+	}
+
 	// Create signal channel listening to interrupt and termination signals
-	sigChannel := make(chan os.Signal)
+	sigChannel := make(chan os.Signal, 1)
 	defer close(sigChannel)
 	signal.Notify(sigChannel, os.Interrupt, os.Kill, syscall.SIGTERM)
 
-	// Create logs publisher
-	logsPublisher := observer.Publisher{}
-
 	// Create FS events watcher detecting new files
 	watcher, err := fsnotify.NewWatcher()
 	logger.CheckErrAndPanic(err, "FailedCreatingWatcher", "Failed creating filesystem events watcher")
 	defer watcher.Close()
-	err = watcher.Add(cfg.Directory)
-	logger.CheckErrAndPanic(err, "FailedWatchingDirectory", "Failed adding directory to watcher")
 
 	// Start all configured connectors
 	conns := connectors.CreateConnectors(cfg)
 
-	// Subscribe to logsPublisher for each connector
-	for _, conn := range conns {
-		ch := make(chan *tail.Line)
-		defer close(ch)
-		defer conn.Close()
-		subscriber := observer.Subscriber{
-			Channel:   ch,
-			Connector: conn,
-		}
-		logsPublisher.Subscribe(subscriber.Channel)
+	// Create a subscriber for each connector, closing a subscriber closes its connector before its queues
+	subscribers, err := observer.NewSubscribers(conns)
+	logger.CheckErrAndPanic(err, "FailedCreatingSubscribers", "Failed creating connector subscribers")
+	for _, subscriber := range subscribers {
+		defer subscriber.Close()
 		go subscriber.ListenToChannel()
 	}
 
-	// Publish lines for each file in a separate thread
-	tails := tailing.InitTailsFromDir(cfg.Directory)
+	// Create inputs parsing lines into events, each with a publisher routing events to the input connectors
+	// based on their parsed level
+	inputs := []*tailing.Input{}
+	for _, inputCfg := range cfg.GetInputs() {
+		logsPublisher := &observer.Publisher{}
+		for _, subscriber := range subscribers {
+			if inputCfg.RoutesTo(subscriber.Connector.GetName()) {
+				logsPublisher.Subscribe(subscriber)
+			}
+		}
+		input, err := tailing.NewInput(inputCfg, logsPublisher)
+		logger.CheckErrAndPanic(err, "FailedCreatingInput", fmt.Sprintf("Failed creating input %s", inputCfg.Name))
+		defer input.Unmatched.Close()
+		// Lines failing parsing are routed to the unmatched connector whatever its levels
+		for _, subscriber := range subscribers {
+			if input.Unmatched.Publisher != nil && subscriber.Connector.GetName() == inputCfg.Unmatched.Connector {
+				input.Unmatched.Publisher.SubscribeAll(subscriber)
+			}
+		}
+		inputs = append(inputs, input)
+	}
+
+	// Publish lines for each selected file in a separate thread, watching directories for new files
+	tails := tailing.InitTails(inputs, watcher, store)
 	for _, t := range tails {
 		defer t.Stop()
-		go tailing.TailAndPublish(t.Lines, logsPublisher)
 	}
 
+	// Report events dropped because of full connector buffers and lines which failed parsing periodically
+	stopReports, reportsDone := make(chan struct{}), make(chan struct{})
+	go reportPeriodically(cfg.ReportInterval, stopReports, reportsDone, dropsReporter(subscribers), unmatchedReporter(inputs))
+
 	// Watch for new files added and start tailing them, return on interruption signal to execute deferred calls
-	tailing.TailNewFiles(watcher, logsPublisher, sigChannel)
+	tailing.TailNewFiles(watcher, inputs, store, sigChannel)
+
+	// Report dropped events and unmatched lines a last time before exiting
+	close(stopReports)
+	<-reportsDone
+}
+
+// Returns a function logging the number of events each connector dropped because its buffer was full, when it increased
+func dropsReporter(subscribers []*observer.Subscriber) func() {
+	reported := map[*observer.Subscriber]uint64{}
+	return func() {
+		for _, subscriber := range subscribers {
+			if dropped := subscriber.Dropped(); dropped > reported[subscriber] {
+				logger.Warn("EventsDropped", fmt.Sprintf("Connector %s dropped %d events because its buffer was full", subscriber.Connector.GetName(), dropped))
+				reported[subscriber] = dropped
+			}
+		}
+	}
+}
+
+// Returns a function logging the number of lines of each file which failed parsing, when it increased
+func unmatchedReporter(inputs []*tailing.Input) func() {
+	reported := map[*tailing.Input]map[string]uint64{}
+	return func() {
+		for _, input := range inputs {
+			if reported[input] == nil {
+				reported[input] = map[string]uint64{}
+			}
+			for source, count := range input.Unmatched.Counts() {
+				if count > reported[input][source] {
+					logger.Warn("UnmatchedLines", fmt.Sprintf("Input %s read %d lines not matching its parser in %s", input.Name, count, source))
+					reported[input][source] = count
+				}
+			}
+		}
+	}
+}
+
+// Calls the reports every interval and a last time once stop is closed, then closes done
+func reportPeriodically(interval time.Duration, stop chan struct{}, done chan struct{}, reports ...func()) {
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, report := range reports {
+				report()
+			}
+		case <-stop:
+			for _, report := range reports {
+				report()
+			}
+			return
+		}
+	}
 }
@@ -0,0 +1,258 @@
+package observer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dimpogissou/isengard-server/config"
+	"github.com/dimpogissou/isengard-server/connectors"
+	"github.com/dimpogissou/isengard-server/events"
+	"github.com/dimpogissou/isengard-server/logger"
+	"github.com/dimpogissou/isengard-server/queue"
+)
+
+var errStopped = errors.New("Subscriber stopped while retrying")
+
+// DeadLetterSink receives events that could not be delivered to a connector
+type DeadLetterSink interface {
+	Write(e *events.Event, connector string, attempts int, failure error) error
+	Close() error
+}
+
+// Record written to dead letter files, one JSON object per line
+type deadLetterRecord struct {
+	Event     *events.Event `json:"event"`
+	Connector string        `json:"connector"`
+	Attempts  int           `json:"attempts"`
+	Error     string        `json:"error"`
+	Time      time.Time     `json:"time"`
+}
+
+// Dead letter sink appending records to a local NDJSON file
+type fileDeadLetterSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// Dead letter sink forwarding events to the subscriber of another connector, with error metadata added as fields.
+// Dead letters go through the buffer, queue and retry policy of that subscriber.
+type connectorDeadLetterSink struct {
+	subscriber *Subscriber
+}
+
+// Creates the dead letter sink described by the config, or nil if none is configured.
+// The subscriber of a dead letter connector is looked up by connector name in subscribers.
+func newDeadLetterSink(cfg config.DeadLetterConfig, subscribers []*Subscriber) (DeadLetterSink, error) {
+	if cfg.File != "" {
+		return NewFileDeadLetterSink(cfg.File)
+	}
+	if cfg.Connector != "" {
+		for _, subscriber := range subscribers {
+			if subscriber.Connector.GetName() == cfg.Connector {
+				return connectorDeadLetterSink{subscriber: subscriber}, nil
+			}
+		}
+		return nil, errors.New(fmt.Sprintf("Dead letter connector %s not found", cfg.Connector))
+	}
+	return nil, nil
+}
+
+// Creates a dead letter sink appending records to the file at path, created if missing
+func NewFileDeadLetterSink(path string) (DeadLetterSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileDeadLetterSink{file: f}, nil
+}
+
+func (s *fileDeadLetterSink) Write(e *events.Event, connector string, attempts int, failure error) error {
+	data, err := json.Marshal(deadLetterRecord{Event: e, Connector: connector, Attempts: attempts, Error: failure.Error(), Time: time.Now()})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.file.Write(append(data, '\n'))
+	return err
+}
+
+func (s *fileDeadLetterSink) Close() error {
+	return s.file.Close()
+}
+
+func (s connectorDeadLetterSink) Write(e *events.Event, connector string, attempts int, failure error) error {
+	annotated := *e
+	annotated.Fields = make(map[string]string, len(e.Fields)+3)
+	for k, v := range e.Fields {
+		annotated.Fields[k] = v
+	}
+	annotated.Fields["_dead_letter_connector"] = connector
+	annotated.Fields["_dead_letter_attempts"] = strconv.Itoa(attempts)
+	annotated.Fields["_dead_letter_error"] = failure.Error()
+	annotated.Tags = append(append([]string{}, e.Tags...), "dead_letter")
+
+	// The original event is handled once its dead letter is handed to the subscriber, which acknowledges the copy only
+	annotated.OnAcknowledged(nil)
+	annotated.ExpectAcks(1)
+	select {
+	case <-s.subscriber.stop:
+		return errors.New(fmt.Sprintf("Dead letter connector %s stopped", s.subscriber.Connector.GetName()))
+	default:
+	}
+	s.subscriber.offer(&annotated)
+	return nil
+}
+
+func (s connectorDeadLetterSink) Close() error {
+	return nil
+}
+
+// Returns true if the error matches the RetryOn patterns, or if there are none
+func (s *Subscriber) retryable(err error) bool {
+	if len(s.retryOn) == 0 {
+		return true
+	}
+	for _, re := range s.retryOn {
+		if re.MatchString(err.Error()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the delay before the provided retry, growing exponentially from the base delay up to the max delay.
+// A Jitter fraction of the delay is randomised to spread retries of concurrent subscribers.
+func backoff(policy config.RetryConfig, retry int) time.Duration {
+	delay := policy.BaseDelay
+	for i := 1; i < retry && delay < policy.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > policy.MaxDelay {
+		delay = policy.MaxDelay
+	}
+	if policy.Jitter > 0 {
+		spread := float64(delay) * policy.Jitter
+		delay = time.Duration(float64(delay) - spread + rand.Float64()*spread)
+	}
+	return delay
+}
+
+// Returns the delay before retrying a failed send, at least as long as the connector asked for
+func retryDelay(policy config.RetryConfig, retry int, err error) time.Duration {
+	delay := backoff(policy, retry)
+	var throttled connectors.RetryAfter
+	if errors.As(err, &throttled) && throttled.RetryAfter() > delay {
+		delay = throttled.RetryAfter()
+	}
+	return delay
+}
+
+// Sends an event until it succeeds, the error is not retryable or attempts are exhausted.
+// Returns the number of attempts made and the last error, or errStopped if the subscriber was closed meanwhile.
+func (s *Subscriber) sendWithRetry(e *events.Event) (int, error) {
+	policy := s.Retry.WithDefaults()
+	for attempt := 1; ; attempt++ {
+		err := s.Connector.Send(e)
+		if err == nil {
+			return attempt, nil
+		}
+		if !s.retryable(err) || (policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts) {
+			return attempt, err
+		}
+		delay := retryDelay(policy, attempt, err)
+		logger.CheckWarnAndLog(err, "ConnectorSendError", fmt.Sprintf("Connector %s failed sending event (attempt %d), retrying in %v", s.Connector.GetName(), attempt, delay))
+		select {
+		case <-time.After(delay):
+		case <-s.stop:
+			return attempt, errStopped
+		}
+	}
+}
+
+// Sends an event to an asynchronous connector, retrying from the acknowledgement callback until it succeeds,
+// the error is not retryable or attempts are exhausted. handled is not called if the subscriber stops while waiting to retry.
+func (s *Subscriber) sendAsyncWithRetry(conn connectors.AsyncConnector, e *events.Event, attempt int, handled func()) {
+	policy := s.Retry.WithDefaults()
+	conn.SendAsync(e, func(err error) {
+		if err == nil {
+			handled()
+			return
+		}
+		if !s.retryable(err) || (policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts) {
+			s.deadLetter(e, attempt, err)
+			handled()
+			return
+		}
+		delay := retryDelay(policy, attempt, err)
+		logger.CheckWarnAndLog(err, "ConnectorSendError", fmt.Sprintf("Connector %s failed sending event (attempt %d), retrying in %v", s.Connector.GetName(), attempt, delay))
+		go func() {
+			select {
+			case <-time.After(delay):
+				s.sendAsyncWithRetry(conn, e, attempt+1, handled)
+			case <-s.stop:
+			}
+		}()
+	})
+}
+
+// Commits queue records in order as their events are handled, events being possibly handled out of order
+type commitWindow struct {
+	queue   *queue.Queue
+	mu      sync.Mutex
+	base    uint64
+	pending []windowRecord
+}
+
+type windowRecord struct {
+	record queue.Record
+	done   bool
+}
+
+// Registers a record read from the queue and returns the function marking it as handled
+func (w *commitWindow) track(r queue.Record) func() {
+	w.mu.Lock()
+	seq := w.base + uint64(len(w.pending))
+	w.pending = append(w.pending, windowRecord{record: r})
+	w.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { w.handled(seq) })
+	}
+}
+
+func (w *commitWindow) handled(seq uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.pending[seq-w.base].done = true
+	i := 0
+	for ; i < len(w.pending) && w.pending[i].done; i++ {
+	}
+	if i > 0 {
+		last := w.pending[i-1].record
+		w.pending = w.pending[i:]
+		w.base += uint64(i)
+		logger.CheckErrAndLog(w.queue.Commit(last), "QueueCommitError", "Failed committing handled queue records")
+	}
+}
+
+// Hands an undeliverable event to the dead letter sink, or logs it as dropped if there is none
+func (s *Subscriber) deadLetter(e *events.Event, attempts int, failure error) {
+	name := s.Connector.GetName()
+	if s.DeadLetter == nil {
+		logger.CheckErrAndLog(failure, "EventDropped", fmt.Sprintf("Connector %s dropped event from %s after %d attempt(s)", name, e.Source, attempts))
+		return
+	}
+	logger.CheckWarnAndLog(failure, "EventDeadLettered", fmt.Sprintf("Connector %s dead-lettering event from %s after %d attempt(s)", name, e.Source, attempts))
+	if err := s.DeadLetter.Write(e, name, attempts, failure); err != nil {
+		logger.CheckErrAndLog(err, "DeadLetterWriteError", fmt.Sprintf("Connector %s dropped event from %s, dead letter write failed", name, e.Source))
+	}
+}
@@ -0,0 +1,210 @@
+package observer
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dimpogissou/isengard-server/config"
+	"github.com/dimpogissou/isengard-server/connectors"
+	"github.com/dimpogissou/isengard-server/events"
+)
+
+// Connector always failing with the provided error and counting send attempts
+type failingConnector struct {
+	err      error
+	attempts int
+}
+
+func (c *failingConnector) GetName() string                    { return "failingConnector" }
+func (c *failingConnector) GetLevels() []string                { return nil }
+func (c *failingConnector) GetDelivery() config.DeliveryConfig { return config.DeliveryConfig{} }
+func (c *failingConnector) Close() error                       { return nil }
+func (c *failingConnector) Send(e *events.Event) error {
+	c.attempts++
+	return c.err
+}
+
+// Tests delays grow exponentially up to the max delay, and stay within the jitter spread
+func TestBackoff(t *testing.T) {
+
+	policy := config.RetryConfig{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	cases := []struct {
+		retry int
+		want  time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{50, time.Second},
+	}
+	for _, c := range cases {
+		if got := backoff(policy, c.retry); got != c.want {
+			t.Errorf("backoff(%v, %d) == %v, want %v", policy, c.retry, got, c.want)
+		}
+	}
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := backoff(policy, 2); got < 100*time.Millisecond || got > 200*time.Millisecond {
+			t.Errorf("backoff with jitter %v out of expected range, got %v", policy.Jitter, got)
+		}
+	}
+}
+
+// Error asking to wait before retrying
+type throttledError struct{ wait time.Duration }
+
+func (e throttledError) Error() string             { return "throttled" }
+func (e throttledError) RetryAfter() time.Duration { return e.wait }
+
+// Asserts retries wait at least as long as the connector asked for
+func TestRetryDelay(t *testing.T) {
+
+	policy := config.RetryConfig{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	if got := retryDelay(policy, 1, errors.New("failure")); got != 100*time.Millisecond {
+		t.Errorf("retryDelay for plain errors == %v, want %v", got, 100*time.Millisecond)
+	}
+	if got := retryDelay(policy, 1, throttledError{wait: time.Minute}); got != time.Minute {
+		t.Errorf("retryDelay for throttled errors == %v, want %v", got, time.Minute)
+	}
+}
+
+// Tests failed events are retried up to MaxAttempts, non retryable errors are not retried,
+// and exhausted events are written to the dead letter file
+func TestRetryAndDeadLetterFile(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "deadletters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	deadLetterFile := filepath.Join(dir, "deadletters.ndjson")
+
+	sink, err := newDeadLetterSink(config.DeadLetterConfig{File: deadLetterFile}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		err          error
+		wantAttempts int
+	}{
+		{errors.New("connection refused"), 3},
+		{errors.New("access denied"), 1},
+	}
+	for _, c := range cases {
+		conn := &failingConnector{err: c.err}
+		s := Subscriber{
+			Connector:  conn,
+			Retry:      config.RetryConfig{MaxAttempts: 3, BaseDelay: time.Millisecond},
+			retryOn:    []*regexp.Regexp{regexp.MustCompile("connection refused|timeout")},
+			DeadLetter: sink,
+		}
+		handled := false
+		if !s.dispatch(&events.Event{Text: "Log message"}, func() { handled = true }) || !handled {
+			t.Fatalf("Event not handled by subscriber")
+		}
+		if conn.attempts != c.wantAttempts {
+			t.Errorf("Unexpected send attempts for error %v, got %d, want %d", c.err, conn.attempts, c.wantAttempts)
+		}
+	}
+	sink.Close()
+
+	f, err := os.Open(deadLetterFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records := []deadLetterRecord{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		record := deadLetterRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 2 || records[0].Attempts != 3 || records[0].Error != "connection refused" || records[1].Event.Text != "Log message" {
+		t.Errorf("Unexpected dead letter records, got %+v", records)
+	}
+}
+
+// Connector failing its first failures sends, then handing events to sent
+type flakyConnector struct {
+	name     string
+	delivery config.DeliveryConfig
+	failures int
+	mu       sync.Mutex
+	attempts int
+	sent     chan *events.Event
+}
+
+func (c *flakyConnector) GetName() string                    { return c.name }
+func (c *flakyConnector) GetLevels() []string                { return nil }
+func (c *flakyConnector) GetDelivery() config.DeliveryConfig { return c.delivery }
+func (c *flakyConnector) Close() error                       { return nil }
+func (c *flakyConnector) Send(e *events.Event) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.attempts++
+	if c.attempts <= c.failures {
+		return errors.New("connection refused")
+	}
+	c.sent <- e
+	return nil
+}
+
+// Asserts dead letters are delivered through the subscriber of the dead letter connector, with its retry policy,
+// and that dead letter connectors forming a cycle are rejected
+func TestDeadLetterConnector(t *testing.T) {
+
+	primary := &flakyConnector{name: "primary", failures: 100, delivery: config.DeliveryConfig{
+		Retry: config.RetryConfig{MaxAttempts: 1}, DeadLetter: config.DeadLetterConfig{Connector: "backup"}}}
+	backup := &flakyConnector{name: "backup", failures: 1, sent: make(chan *events.Event, 1), delivery: config.DeliveryConfig{
+		Retry: config.RetryConfig{MaxAttempts: 3, BaseDelay: time.Millisecond}}}
+	subscribers, err := NewSubscribers([]connectors.ConnectorInterface{primary, backup})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logsPublisher := &Publisher{}
+	for _, s := range subscribers {
+		defer s.Close()
+		go s.ListenToChannel()
+		if s.Connector.GetName() == "primary" {
+			logsPublisher.Subscribe(s)
+		}
+	}
+
+	acked := make(chan bool, 1)
+	e := events.New("Log message", "app.log", 0, nil)
+	e.OnAcknowledged(func() { acked <- true })
+	logsPublisher.Publish(e)
+
+	select {
+	case got := <-backup.sent:
+		if got.Text != "Log message" || got.Field("_dead_letter_connector") != "primary" || backup.attempts != 2 {
+			t.Errorf("Unexpected dead letter %v after %d attempts", got.Fields, backup.attempts)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Dead letter not delivered to backup connector")
+	}
+	select {
+	case <-acked:
+	case <-time.After(time.Second):
+		t.Fatalf("Dead-lettered event not acknowledged")
+	}
+
+	backup.delivery.DeadLetter.Connector = "primary"
+	if _, err := NewSubscribers([]connectors.ConnectorInterface{primary, backup}); err == nil || err.Error() != "Dead letter connectors form a cycle" {
+		t.Errorf("NewSubscribers with a dead letter cycle == %v, want cycle error", err)
+	}
+}
@@ -1,31 +1,82 @@
 package observer
 
 import (
-	"github.com/dimpogissou/isengard-server/connectors"
-	"github.com/hpcloud/tail"
+	"sync"
+
+	"github.com/dimpogissou/isengard-server/config"
+	"github.com/dimpogissou/isengard-server/events"
 )
 
+// Publisher routes events to subscribers based on their connector levels, it is safe for concurrent use.
+// Events without a level (lines not matching the log pattern) are only routed to subscribers without a levels filter.
 type Publisher struct {
-	listeners []chan *tail.Line
+	mu          sync.RWMutex
+	subscribers []subscription
+}
+
+type subscription struct {
+	subscriber *Subscriber
+	levels     []string
+}
+
+// Subscribes a subscriber to events with one of its connector levels, or to all events if it has no levels
+func (p *Publisher) Subscribe(s *Subscriber) {
+	levels := s.Connector.GetLevels()
+	normalised := make([]string, len(levels))
+	for i, level := range levels {
+		normalised[i] = config.NormaliseLevel(level)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.subscribers = append(p.subscribers, subscription{subscriber: s, levels: normalised})
 }
 
-type Subscriber struct {
-	Channel   chan *tail.Line
-	Connector connectors.ConnectorInterface
+// Subscribes a subscriber to all events, whatever its connector levels
+func (p *Publisher) SubscribeAll(s *Subscriber) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.subscribers = append(p.subscribers, subscription{subscriber: s})
 }
 
-func (p *Publisher) Subscribe(c chan *tail.Line) {
-	p.listeners = append(p.listeners, c)
+// Returns true if a subscription accepts events of the provided level
+func (s subscription) accepts(level string) bool {
+	if len(s.levels) == 0 {
+		return true
+	}
+	for _, l := range s.levels {
+		if l == level {
+			return true
+		}
+	}
+	return false
 }
 
-func (p *Publisher) Publish(m *tail.Line) {
-	for _, c := range p.listeners {
-		c <- m
+// Hands an event to every subscriber accepting its level, applying each subscriber overflow policy if its buffer is full
+func (p *Publisher) Publish(e *events.Event) {
+	level := e.Level()
+	routed := []*Subscriber{}
+	p.mu.RLock()
+	for _, s := range p.subscribers {
+		if s.accepts(level) {
+			routed = append(routed, s.subscriber)
+		}
+	}
+	p.mu.RUnlock()
+
+	// Expected acknowledgements must be set before any subscriber can acknowledge the event
+	e.ExpectAcks(len(routed))
+	for _, s := range routed {
+		s.offer(e)
 	}
 }
 
-func (s *Subscriber) ListenToChannel() {
-	for data := range s.Channel {
-		s.Connector.Send(data)
+// Returns the number of events dropped by each subscriber because its buffer was full, by connector name
+func (p *Publisher) Dropped() map[string]uint64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	dropped := make(map[string]uint64)
+	for _, s := range p.subscribers {
+		dropped[s.subscriber.Connector.GetName()] += s.subscriber.Dropped()
 	}
+	return dropped
 }
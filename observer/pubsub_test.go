@@ -1,12 +1,22 @@
 package observer_test
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/dimpogissou/isengard-server/config"
+	"github.com/dimpogissou/isengard-server/events"
 	"github.com/dimpogissou/isengard-server/logger"
 	"github.com/dimpogissou/isengard-server/observer"
+	"github.com/dimpogissou/isengard-server/queue"
 	"github.com/dimpogissou/isengard-server/testutils"
-	"github.com/hpcloud/tail"
 )
 
 func TestPubSub(t *testing.T) {
@@ -19,28 +29,28 @@ func TestPubSub(t *testing.T) {
 
 	// Create publisher/subscribers with mockConnector
 	logger.Info("Creating publisher and subscribers ...")
-	logsPublisher := observer.Publisher{}
+	logsPublisher := &observer.Publisher{}
 
-	ch1 := make(chan *tail.Line)
+	ch1 := make(chan *events.Event)
 	conn1 := testutils.MockConnector{}
 	defer close(ch1)
-	subscriber1 := observer.Subscriber{
+	subscriber1 := &observer.Subscriber{
 		Channel:   ch1,
 		Connector: conn1,
 	}
 
-	ch2 := make(chan *tail.Line)
+	ch2 := make(chan *events.Event)
 	conn2 := testutils.MockConnector{}
 	defer close(ch2)
-	subscriber2 := observer.Subscriber{
+	subscriber2 := &observer.Subscriber{
 		Channel:   ch2,
 		Connector: conn2,
 	}
-	logsPublisher.Subscribe(subscriber1.Channel)
-	logsPublisher.Subscribe(subscriber2.Channel)
+	logsPublisher.Subscribe(subscriber1)
+	logsPublisher.Subscribe(subscriber2)
 
-	// Create test log line
-	testLine := tail.Line{Text: "logMessage", Err: nil}
+	// Create test event
+	testLine := events.Event{Text: "logMessage"}
 
 	// Write to publisher and assert both subscribers received it
 	logger.Info("Publishing log line ...")
@@ -54,3 +64,357 @@ func TestPubSub(t *testing.T) {
 	}
 
 }
+
+// Asserts events are only routed to subscribers accepting their level, and unmatched lines only to unfiltered subscribers
+func TestLevelRouting(t *testing.T) {
+
+	parser, err := config.BuildInputParser(config.InputConfig{
+		LogPattern: "\\[(?P<timestamp>%s)\\]\\[(?P<level>%s)\\]\\s(?P<message>%s)",
+		Definitions: []config.PatternConfig{
+			config.PatternConfig{Name: "DatePattern", Pattern: "[^\\]]+"},
+			config.PatternConfig{Name: "LogLevelPattern", Pattern: "ERROR|WARN|WARNING|INFO|DEBUG"},
+			config.PatternConfig{Name: "LogMsgPattern", Pattern: ".*"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logsPublisher := &observer.Publisher{}
+
+	errorsCh := make(chan *events.Event, 10)
+	warningsCh := make(chan *events.Event, 10)
+	allCh := make(chan *events.Event, 10)
+	logsPublisher.Subscribe(&observer.Subscriber{Channel: errorsCh, Connector: testutils.MockConnector{Levels: []string{"ERROR"}}})
+	logsPublisher.Subscribe(&observer.Subscriber{Channel: warningsCh, Connector: testutils.MockConnector{Levels: []string{"WARNING"}}})
+	logsPublisher.Subscribe(&observer.Subscriber{Channel: allCh, Connector: testutils.MockConnector{}})
+
+	logsPublisher.Publish(events.New("[2020-10-07 20:56:47][INFO] Info message", "test.log", 0, parser))
+	logsPublisher.Publish(events.New("[2020-10-07 20:56:47][ERROR] Error message", "test.log", 0, parser))
+	logsPublisher.Publish(events.New("[2020-10-07 20:56:47][WARN] Warn message", "test.log", 0, parser))
+	logsPublisher.Publish(events.New("Unmatched line", "test.log", 0, parser))
+
+	cases := []struct {
+		name string
+		ch   chan *events.Event
+		want int
+	}{
+		{"errors", errorsCh, 1},
+		{"warnings", warningsCh, 1},
+		{"all", allCh, 4},
+	}
+	for _, c := range cases {
+		if len(c.ch) != c.want {
+			t.Errorf("Subscriber %s received %d lines, want %d", c.name, len(c.ch), c.want)
+		}
+	}
+}
+
+// Connector failing a fixed number of sends before succeeding, forwarding sent events to a channel
+type flakyConnector struct {
+	testutils.MockConnector
+	failures int
+	sent     chan *events.Event
+}
+
+func (c *flakyConnector) Send(e *events.Event) error {
+	if c.failures > 0 {
+		c.failures--
+		return errors.New("Connector unavailable")
+	}
+	c.sent <- e
+	return nil
+}
+
+// Asserts events are acknowledged once queued, and kept in the queue until the connector accepts them
+func TestQueuedSubscriber(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "queues")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conn := &flakyConnector{
+		MockConnector: testutils.MockConnector{Delivery: config.DeliveryConfig{Queue: config.QueueConfig{Directory: dir}}},
+		failures:      1,
+		sent:          make(chan *events.Event, 1),
+	}
+	subscriber, err := observer.NewSubscriber(conn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+	logsPublisher := &observer.Publisher{}
+	logsPublisher.Subscribe(subscriber)
+	go subscriber.ListenToChannel()
+
+	acked := make(chan bool, 1)
+	e := events.New("Log message", "test.log", 0, nil)
+	e.OnAcknowledged(func() { acked <- true })
+	logsPublisher.Publish(e)
+
+	select {
+	case <-acked:
+	case <-time.After(time.Second):
+		t.Fatalf("Event not acknowledged after being queued")
+	}
+
+	select {
+	case sent := <-conn.sent:
+		if sent.Text != e.Text {
+			t.Errorf("Unexpected event sent from queue, got %s, want %s", sent.Text, e.Text)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Queued event not sent after connector recovered")
+	}
+}
+
+// Asserts overflow policies drop the expected events and count them when a subscriber buffer is full
+func TestOverflowPolicies(t *testing.T) {
+
+	cases := []struct {
+		overflow    string
+		wantTexts   []string
+		wantDropped uint64
+	}{
+		{"drop_newest", []string{"line-0", "line-1"}, 2},
+		{"drop_oldest", []string{"line-2", "line-3"}, 2},
+	}
+	for _, c := range cases {
+		conn := testutils.MockConnector{Delivery: config.DeliveryConfig{Buffer: config.BufferConfig{Size: 2, Overflow: c.overflow}}}
+		subscriber, err := observer.NewSubscriber(conn, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logsPublisher := &observer.Publisher{}
+		logsPublisher.Subscribe(subscriber)
+
+		// Subscriber is not listening, publishing must not block once the buffer is full
+		acked := 0
+		for i := 0; i < 4; i++ {
+			e := events.New(fmt.Sprintf("line-%d", i), "test.log", 0, nil)
+			e.OnAcknowledged(func() { acked++ })
+			logsPublisher.Publish(e)
+		}
+
+		texts := []string{}
+		for len(subscriber.Channel) > 0 {
+			texts = append(texts, (<-subscriber.Channel).Text)
+		}
+		if fmt.Sprint(texts) != fmt.Sprint(c.wantTexts) {
+			t.Errorf("Policy %s: buffered events %v, want %v", c.overflow, texts, c.wantTexts)
+		}
+		if dropped := logsPublisher.Dropped()[conn.GetName()]; dropped != c.wantDropped || uint64(acked) != c.wantDropped {
+			t.Errorf("Policy %s: dropped %d events and acknowledged %d, want %d", c.overflow, dropped, acked, c.wantDropped)
+		}
+		subscriber.Close()
+	}
+}
+
+// Asserts events overflowing to disk are acknowledged and delivered in order once the subscriber catches up
+func TestSpillOverflow(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conn := &flakyConnector{
+		MockConnector: testutils.MockConnector{Delivery: config.DeliveryConfig{Buffer: config.BufferConfig{Size: 1, Overflow: "spill", SpillDirectory: dir}}},
+		sent:          make(chan *events.Event, 10),
+	}
+	subscriber, err := observer.NewSubscriber(conn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+	logsPublisher := &observer.Publisher{}
+	logsPublisher.Subscribe(subscriber)
+
+	for i := 0; i < 5; i++ {
+		logsPublisher.Publish(events.New(fmt.Sprintf("line-%d", i), "test.log", 0, nil))
+	}
+	go subscriber.ListenToChannel()
+
+	for i := 0; i < 5; i++ {
+		select {
+		case e := <-conn.sent:
+			if want := fmt.Sprintf("line-%d", i); e.Text != want {
+				t.Errorf("Unexpected spilled event order, got %s, want %s", e.Text, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for spilled event %d", i)
+		}
+	}
+	if subscriber.Dropped() != 0 {
+		t.Errorf("Spill policy should not drop events, dropped %d", subscriber.Dropped())
+	}
+}
+
+// Asserts events are dropped once the spill reaches its maximum size
+func TestSpillFull(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The spill only holds a single event
+	data, err := json.Marshal(events.New("line-0", "test.log", 0, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer := config.BufferConfig{Size: 1, Overflow: "spill", SpillDirectory: dir, SpillMaxSize: int64(len(data) + 8)}
+	conn := &flakyConnector{
+		MockConnector: testutils.MockConnector{Delivery: config.DeliveryConfig{Buffer: buffer}},
+		sent:          make(chan *events.Event, 10),
+	}
+	subscriber, err := observer.NewSubscriber(conn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+	logsPublisher := &observer.Publisher{}
+	logsPublisher.Subscribe(subscriber)
+
+	for i := 0; i < 4; i++ {
+		logsPublisher.Publish(events.New(fmt.Sprintf("line-%d", i), "test.log", 0, nil))
+	}
+	if subscriber.Dropped() != 2 {
+		t.Errorf("Expected 2 events dropped once the spill is full, dropped %d", subscriber.Dropped())
+	}
+	go subscriber.ListenToChannel()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-conn.sent:
+			if want := fmt.Sprintf("line-%d", i); e.Text != want {
+				t.Errorf("Unexpected spilled event order, got %s, want %s", e.Text, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for event %d", i)
+		}
+	}
+}
+
+// Connector holding events until completed by the test
+type asyncConnector struct {
+	testutils.MockConnector
+	pending chan func(error)
+}
+
+func (c *asyncConnector) SendAsync(e *events.Event, done func(error)) {
+	c.pending <- done
+}
+
+func (c *asyncConnector) MaxPending() int {
+	return 2
+}
+
+// Asserts events sent to async connectors are only acknowledged once the connector completes them
+func TestAsyncConnectorAcknowledgement(t *testing.T) {
+
+	conn := &asyncConnector{pending: make(chan func(error), 2)}
+	subscriber, err := observer.NewSubscriber(conn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+	logsPublisher := &observer.Publisher{}
+	logsPublisher.Subscribe(subscriber)
+	go subscriber.ListenToChannel()
+
+	acked := make(chan string, 2)
+	for i := 0; i < 2; i++ {
+		e := events.New(fmt.Sprintf("line-%d", i), "test.log", 0, nil)
+		e.OnAcknowledged(func() { acked <- e.Text })
+		logsPublisher.Publish(e)
+	}
+
+	dones := []func(error){<-conn.pending, <-conn.pending}
+	if len(acked) != 0 {
+		t.Fatalf("Events acknowledged before the connector completed them")
+	}
+	dones[1](nil)
+	dones[0](nil)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-acked:
+		case <-time.After(time.Second):
+			t.Fatalf("Event not acknowledged after the connector completed it")
+		}
+	}
+}
+
+// Connector holding events in a batch until it is closed
+type batchingConnector struct {
+	testutils.MockConnector
+	mu    sync.Mutex
+	dones []func(error)
+}
+
+func (c *batchingConnector) SendAsync(e *events.Event, done func(error)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dones = append(c.dones, done)
+}
+
+func (c *batchingConnector) MaxPending() int {
+	return 0
+}
+
+func (c *batchingConnector) batched() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.dones)
+}
+
+func (c *batchingConnector) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, done := range c.dones {
+		done(nil)
+	}
+	c.dones = nil
+	return nil
+}
+
+// Asserts batches flushed when closing the subscriber are committed to its queue
+func TestCloseFlushesConnectorBeforeQueue(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "queues")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conn := &batchingConnector{MockConnector: testutils.MockConnector{Delivery: config.DeliveryConfig{Queue: config.QueueConfig{Directory: dir}}}}
+	subscriber, err := observer.NewSubscriber(conn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logsPublisher := &observer.Publisher{}
+	logsPublisher.Subscribe(subscriber)
+	go subscriber.ListenToChannel()
+
+	for i := 0; i < 2; i++ {
+		logsPublisher.Publish(events.New(fmt.Sprintf("line-%d", i), "test.log", 0, nil))
+	}
+	for deadline := time.Now().Add(time.Second); conn.batched() < 2; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for queued events to be batched")
+		}
+	}
+	subscriber.Close()
+
+	q, err := queue.Open(filepath.Join(dir, conn.GetName()), config.QueueConfig{Directory: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if !q.Empty() {
+		t.Errorf("Events flushed on close should have been committed to the queue")
+	}
+}
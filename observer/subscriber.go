@@ -0,0 +1,340 @@
+package observer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dimpogissou/isengard-server/config"
+	"github.com/dimpogissou/isengard-server/connectors"
+	"github.com/dimpogissou/isengard-server/events"
+	"github.com/dimpogissou/isengard-server/logger"
+	"github.com/dimpogissou/isengard-server/queue"
+)
+
+// Subscriber delivers events received on Channel to Connector, retrying failed sends with the Retry policy
+// and handing events that exhausted their retries to DeadLetter.
+// If Queue is set, events are first persisted to it and sent to the connector from the queue.
+// Events are offered to Channel with the Buffer overflow policy when it is full.
+type Subscriber struct {
+	dropped    uint64 // First field to guarantee 64-bit alignment for atomic operations
+	Channel    chan *events.Event
+	Connector  connectors.ConnectorInterface
+	Queue      *queue.Queue
+	Retry      config.RetryConfig
+	DeadLetter DeadLetterSink
+	Buffer     config.BufferConfig
+	retryOn    []*regexp.Regexp
+	spill      *queue.Queue
+	spilling   bool
+	inflight   chan struct{}
+	mu         sync.Mutex
+	stop       chan struct{}
+}
+
+// Creates the subscribers of connectors, subscribers being created after the subscribers of their dead letter connectors
+func NewSubscribers(conns []connectors.ConnectorInterface) ([]*Subscriber, error) {
+	subscribers := []*Subscriber{}
+	created := map[string]bool{}
+	for len(subscribers) < len(conns) {
+		progress := false
+		for _, conn := range conns {
+			deadLetter := conn.GetDelivery().DeadLetter.Connector
+			if created[conn.GetName()] || (deadLetter != "" && !created[deadLetter]) {
+				continue
+			}
+			subscriber, err := NewSubscriber(conn, subscribers)
+			if err != nil {
+				for _, s := range subscribers {
+					s.Close()
+				}
+				return nil, err
+			}
+			subscribers = append(subscribers, subscriber)
+			created[conn.GetName()] = true
+			progress = true
+		}
+		if !progress {
+			for _, s := range subscribers {
+				s.Close()
+			}
+			return nil, errors.New("Dead letter connectors form a cycle")
+		}
+	}
+	return subscribers, nil
+}
+
+// Creates a subscriber for the connector from its delivery settings.
+// Subscribers are looked up by connector name in subscribers when the dead letter destination is another connector.
+func NewSubscriber(conn connectors.ConnectorInterface, subscribers []*Subscriber) (*Subscriber, error) {
+
+	delivery := conn.GetDelivery()
+	retryOn, err := delivery.Retry.RetryOnRegexes()
+	if err != nil {
+		return nil, err
+	}
+	buffer := delivery.Buffer.WithDefaults()
+
+	// Async connectors must be able to fill a whole batch before the first of its events completes
+	inflight := buffer.Size
+	if async, ok := conn.(connectors.AsyncConnector); ok && async.MaxPending() > inflight {
+		inflight = async.MaxPending()
+	}
+	s := Subscriber{
+		Channel:   make(chan *events.Event, buffer.Size),
+		Connector: conn,
+		Retry:     delivery.Retry,
+		Buffer:    buffer,
+		retryOn:   retryOn,
+		inflight:  make(chan struct{}, inflight),
+		stop:      make(chan struct{}),
+	}
+
+	s.DeadLetter, err = newDeadLetterSink(delivery.DeadLetter, subscribers)
+	if err != nil {
+		return nil, err
+	}
+
+	if delivery.Queue.Directory != "" {
+		q, err := queue.Open(filepath.Join(delivery.Queue.Directory, conn.GetName()), delivery.Queue)
+		if err != nil {
+			return nil, err
+		}
+		s.Queue = q
+	}
+
+	// Events spilled before a restart were already acknowledged and must be sent first
+	if buffer.Overflow == "spill" {
+		spill, err := queue.Open(filepath.Join(buffer.SpillDirectory, conn.GetName()), buffer.SpillQueue())
+		if err != nil {
+			return nil, err
+		}
+		s.spill = spill
+		s.spilling = !spill.Empty()
+	}
+	return &s, nil
+}
+
+// Sends received events to the connector, or to its queue if any, and acknowledges handled events.
+// Events not handled because the subscriber stopped are not acknowledged so that the file checkpoint does not move past them.
+func (s *Subscriber) ListenToChannel() {
+	if s.Queue != nil {
+		go s.consumeQueue()
+	}
+	if s.spill != nil {
+		go s.drainSpill()
+	}
+	for {
+		select {
+		case data, ok := <-s.Channel:
+			if !ok {
+				return
+			}
+			s.handle(data)
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *Subscriber) handle(e *events.Event) {
+	if s.Queue == nil {
+		s.dispatch(e, e.Ack)
+		return
+	}
+	if err := s.enqueue(e); err != nil {
+		logger.CheckErrAndLog(err, "QueueWriteError", fmt.Sprintf("Connector %s failed queuing event from %s", s.Connector.GetName(), e.Source))
+		return
+	}
+	e.Ack()
+}
+
+// Hands an event to the subscriber channel, applying the overflow policy if the channel buffer is full
+func (s *Subscriber) offer(e *events.Event) {
+	switch s.Buffer.Overflow {
+	case "drop_newest":
+		select {
+		case s.Channel <- e:
+		default:
+			s.drop(e)
+		}
+	case "drop_oldest":
+		for {
+			select {
+			case s.Channel <- e:
+				return
+			default:
+			}
+			select {
+			case oldest := <-s.Channel:
+				s.drop(oldest)
+			default:
+			}
+		}
+	case "spill":
+		// Once spilling, events keep going to disk until the spill is drained to preserve ordering,
+		// they are dropped while the spill is at its maximum size
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if !s.spilling {
+			select {
+			case s.Channel <- e:
+				return
+			default:
+				s.spilling = true
+			}
+		}
+		data, err := json.Marshal(e)
+		if err == nil {
+			err = s.spill.TryAppend(data)
+		}
+		if err == queue.ErrFull {
+			s.drop(e)
+			return
+		}
+		if err != nil {
+			logger.CheckErrAndLog(err, "SpillWriteError", fmt.Sprintf("Connector %s failed spilling event to disk", s.Connector.GetName()))
+			s.drop(e)
+			return
+		}
+		e.Ack()
+	default:
+		select {
+		case s.Channel <- e:
+		case <-s.stop:
+		}
+	}
+}
+
+// Counts and acknowledges an event dropped because the buffer was full
+func (s *Subscriber) drop(e *events.Event) {
+	dropped := atomic.AddUint64(&s.dropped, 1)
+	logger.Debug(fmt.Sprintf("Connector %s buffer full, dropped event from %s (%d dropped so far)", s.Connector.GetName(), e.Source, dropped))
+	e.Ack()
+}
+
+// Returns the number of events dropped because the buffer was full
+func (s *Subscriber) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Moves spilled events back to the subscriber channel in order, stops spilling once the spill is empty
+func (s *Subscriber) drainSpill() {
+	for {
+		record, err := s.spill.Next()
+		if err == queue.ErrClosed {
+			return
+		} else if err != nil {
+			logger.CheckErrAndLog(err, "SpillReadError", fmt.Sprintf("Connector %s failed reading spilled events", s.Connector.GetName()))
+			return
+		}
+
+		e := events.Event{}
+		if err := json.Unmarshal(record.Data, &e); err != nil {
+			logger.CheckErrAndLog(err, "SpillDecodeError", fmt.Sprintf("Connector %s skipping undecodable spilled event", s.Connector.GetName()))
+		} else {
+			select {
+			case s.Channel <- &e:
+			case <-s.stop:
+				return
+			}
+		}
+
+		logger.CheckErrAndLog(s.spill.Commit(record), "SpillCommitError", fmt.Sprintf("Connector %s failed committing spilled events", s.Connector.GetName()))
+		s.mu.Lock()
+		if s.spill.Empty() {
+			s.spilling = false
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Persists an event to the subscriber queue
+func (s *Subscriber) enqueue(e *events.Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.Queue.Append(data)
+}
+
+// Sends queued events to the connector in order, committing records once their events were delivered or dead-lettered
+func (s *Subscriber) consumeQueue() {
+	window := commitWindow{queue: s.Queue}
+	for {
+		record, err := s.Queue.Next()
+		if err == queue.ErrClosed {
+			return
+		} else if err != nil {
+			logger.CheckErrAndLog(err, "QueueReadError", fmt.Sprintf("Connector %s failed reading from its queue", s.Connector.GetName()))
+			return
+		}
+
+		handled := window.track(record)
+		e := events.Event{}
+		if err := json.Unmarshal(record.Data, &e); err != nil {
+			logger.CheckErrAndLog(err, "QueueDecodeError", fmt.Sprintf("Connector %s skipping undecodable queued event", s.Connector.GetName()))
+			handled()
+		} else if !s.dispatch(&e, handled) {
+			return
+		}
+	}
+}
+
+// Delivers an event to the connector and calls handled once it was sent or dead-lettered,
+// asynchronously if the connector acknowledges events after sending them.
+// Returns false if the subscriber was stopped before the event could be handled.
+func (s *Subscriber) dispatch(e *events.Event, handled func()) bool {
+	async, ok := s.Connector.(connectors.AsyncConnector)
+	if !ok {
+		attempts, err := s.sendWithRetry(e)
+		if err == errStopped {
+			return false
+		}
+		if err != nil {
+			s.deadLetter(e, attempts, err)
+		}
+		handled()
+		return true
+	}
+
+	// Bound the number of events awaiting acknowledgement from the connector
+	if s.inflight != nil {
+		select {
+		case s.inflight <- struct{}{}:
+		case <-s.stop:
+			return false
+		}
+		release := handled
+		handled = func() {
+			<-s.inflight
+			release()
+		}
+	}
+	s.sendAsyncWithRetry(async, e, 1, handled)
+	return true
+}
+
+// Stops the subscriber, closes its connector so that pending batches are flushed and their events committed,
+// then closes its queues. Events queued or spilled but not yet sent are kept for the next start.
+// Buffered events are not acknowledged and will be read again from their files after a restart.
+func (s *Subscriber) Close() error {
+	if s.stop != nil {
+		close(s.stop)
+	}
+	logger.CheckErrAndLog(s.Connector.Close(), "ConnectorCloseError", fmt.Sprintf("Connector %s failed closing", s.Connector.GetName()))
+	if s.DeadLetter != nil {
+		logger.CheckErrAndLog(s.DeadLetter.Close(), "DeadLetterCloseError", fmt.Sprintf("Connector %s failed closing its dead letter sink", s.Connector.GetName()))
+	}
+	if s.spill != nil {
+		logger.CheckErrAndLog(s.spill.Close(), "SpillCloseError", fmt.Sprintf("Connector %s failed closing its spill", s.Connector.GetName()))
+	}
+	if s.Queue != nil {
+		return s.Queue.Close()
+	}
+	return nil
+}
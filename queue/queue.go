@@ -0,0 +1,448 @@
+package queue
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dimpogissou/isengard-server/config"
+	"github.com/dimpogissou/isengard-server/logger"
+)
+
+var ErrClosed = errors.New("Queue closed")
+var ErrFull = errors.New("Queue full")
+
+// Each record is stored as a 4 bytes length and a 4 bytes CRC32 checksum followed by its payload
+const recordHeaderSize = 8
+const segmentSuffix = ".seg"
+const positionFileName = "position"
+
+// Location of a record in the queue: segment index and byte offset in that segment
+type position struct {
+	segment uint64
+	offset  int64
+}
+
+// Record read from the queue, committing it also commits every record read before it
+type Record struct {
+	Data []byte
+	end  position
+}
+
+// Queue is a durable FIFO of records stored in segment files, used by a single writer and a single reader.
+// Records returned by Next are redelivered after a restart until they are committed.
+type Queue struct {
+	dir          string
+	cfg          config.QueueConfig
+	mu           sync.Mutex
+	cond         *sync.Cond
+	closed       bool
+	writer       *os.File
+	reader       *os.File
+	positionFile *os.File
+	write        position // End of the last appended record
+	read         position // End of the last record returned by Next
+	committed    position // End of the last committed record
+	size         int64    // Total size of segments on disk
+	stop         chan struct{}
+	done         chan struct{}
+}
+
+func segmentPath(dir string, segment uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", segment, segmentSuffix))
+}
+
+// Lists segment indexes present in dir in ascending order
+func listSegments(dir string) ([]uint64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	segments := []uint64{}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), segmentSuffix) {
+			continue
+		}
+		segment, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+// Opens the queue stored in dir, creating it if needed, and recovers records written before a crash
+func Open(dir string, cfg config.QueueConfig) (*Queue, error) {
+
+	q := Queue{dir: dir, cfg: cfg.WithDefaults(), stop: make(chan struct{}), done: make(chan struct{})}
+	q.cond = sync.NewCond(&q.mu)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	q.positionFile, err = os.OpenFile(filepath.Join(dir, positionFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = q.loadPosition(segments); err != nil {
+		q.positionFile.Close()
+		return nil, err
+	}
+
+	// Remove segments fully consumed before the last shutdown, sum sizes of remaining ones
+	last := q.committed.segment
+	for _, segment := range segments {
+		if segment < q.committed.segment {
+			os.Remove(segmentPath(dir, segment))
+			continue
+		}
+		info, err := os.Stat(segmentPath(dir, segment))
+		if err != nil {
+			q.positionFile.Close()
+			return nil, err
+		}
+		q.size += info.Size()
+		last = segment
+	}
+
+	if err = q.openWriter(last); err != nil {
+		q.positionFile.Close()
+		return nil, err
+	}
+	if q.committed.segment == q.write.segment && q.committed.offset > q.write.offset {
+		q.committed.offset = q.write.offset
+	}
+	q.reader, err = os.OpenFile(segmentPath(dir, q.committed.segment), os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		q.writer.Close()
+		q.positionFile.Close()
+		return nil, err
+	}
+	q.read = q.committed
+
+	go q.syncPeriodically()
+
+	return &q, nil
+}
+
+// Reads the committed position, defaulting to the start of the first segment
+func (q *Queue) loadPosition(segments []uint64) error {
+	buf := make([]byte, 16)
+	n, err := q.positionFile.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if n == len(buf) {
+		q.committed = position{segment: binary.BigEndian.Uint64(buf[:8]), offset: int64(binary.BigEndian.Uint64(buf[8:]))}
+	} else if len(segments) > 0 {
+		q.committed = position{segment: segments[0]}
+	}
+	return nil
+}
+
+// Opens the last segment for appending, truncating any partially written record left by a crash
+func (q *Queue) openWriter(segment uint64) error {
+	f, err := os.OpenFile(segmentPath(q.dir, segment), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	valid := int64(0)
+	for valid < info.Size() {
+		_, n, err := readRecord(f, valid)
+		if err != nil {
+			break
+		}
+		valid += n
+	}
+	if valid < info.Size() {
+		logger.Warn("QueueRecovery", fmt.Sprintf("Truncating %d bytes of partially written records in %s", info.Size()-valid, f.Name()))
+		if err = f.Truncate(valid); err != nil {
+			f.Close()
+			return err
+		}
+		q.size -= info.Size() - valid
+	}
+	if _, err = f.Seek(valid, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	q.writer = f
+	q.write = position{segment: segment, offset: valid}
+	return nil
+}
+
+// Reads the record at offset, returning its payload and total size on disk
+func readRecord(f *os.File, offset int64) ([]byte, int64, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := f.ReadAt(header, offset); err != nil {
+		return nil, 0, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	data := make([]byte, length)
+	if _, err := f.ReadAt(data, offset+recordHeaderSize); err != nil {
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, 0, errors.New(fmt.Sprintf("Checksum mismatch for record at offset %d of %s", offset, f.Name()))
+	}
+	return data, recordHeaderSize + int64(length), nil
+}
+
+// Appends a record to the queue, blocking while the queue is at its maximum size
+func (q *Queue) Append(data []byte) error {
+	return q.append(data, true)
+}
+
+// Appends a record without waiting for space, returning ErrFull if the queue would exceed its MaxSize
+func (q *Queue) TryAppend(data []byte) error {
+	return q.append(data, false)
+}
+
+func (q *Queue) append(data []byte, wait bool) error {
+
+	record := make([]byte, recordHeaderSize+len(data))
+	binary.BigEndian.PutUint32(record[:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(data))
+	copy(record[recordHeaderSize:], data)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// Only wait if committing records can free space, i.e. if older segments exist
+	for wait && !q.closed && q.cfg.MaxSize > 0 && q.size+int64(len(record)) > q.cfg.MaxSize && q.committed.segment < q.write.segment {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return ErrClosed
+	}
+	if !wait && q.cfg.MaxSize > 0 && q.size+int64(len(record)) > q.cfg.MaxSize {
+		return ErrFull
+	}
+
+	if q.write.offset > 0 && q.write.offset+int64(len(record)) > q.cfg.SegmentSize {
+		if err := q.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := q.writer.Write(record); err != nil {
+		return err
+	}
+	q.write.offset += int64(len(record))
+	q.size += int64(len(record))
+	if q.cfg.Fsync == "always" {
+		if err := q.writer.Sync(); err != nil {
+			return err
+		}
+	}
+	q.cond.Broadcast()
+	return nil
+}
+
+// Closes the current segment and starts writing to a new one
+func (q *Queue) rotate() error {
+	if q.cfg.Fsync != "never" {
+		if err := q.writer.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := q.writer.Close(); err != nil {
+		return err
+	}
+	segment := q.write.segment + 1
+	f, err := os.OpenFile(segmentPath(q.dir, segment), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	q.writer = f
+	q.write = position{segment: segment}
+	return nil
+}
+
+// Returns the next record, blocking until one is available or the queue is closed
+func (q *Queue) Next() (Record, error) {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		if q.closed {
+			return Record{}, ErrClosed
+		}
+		if q.read.segment == q.write.segment && q.read.offset >= q.write.offset {
+			q.cond.Wait()
+			continue
+		}
+		if q.read.segment < q.write.segment {
+			info, err := q.reader.Stat()
+			if err != nil {
+				return Record{}, err
+			}
+			if q.read.offset >= info.Size() {
+				if err := q.nextReaderSegment(); err != nil {
+					return Record{}, err
+				}
+				continue
+			}
+		}
+		data, n, err := readRecord(q.reader, q.read.offset)
+		if err != nil {
+			// Skip the rest of a corrupted segment rather than blocking the queue forever
+			logger.Error("QueueCorruptedRecord", fmt.Sprintf("Skipping rest of segment %s -> %s", q.reader.Name(), err))
+			if q.read.segment == q.write.segment {
+				q.read.offset = q.write.offset
+			} else if err := q.nextReaderSegment(); err != nil {
+				return Record{}, err
+			}
+			continue
+		}
+		q.read.offset += n
+		return Record{Data: data, end: q.read}, nil
+	}
+}
+
+// Returns true if every appended record was returned by Next
+func (q *Queue) Empty() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.read.segment == q.write.segment {
+		return q.read.offset >= q.write.offset
+	}
+	// The reader may sit at the end of the segment preceding an empty write segment
+	if q.read.segment+1 == q.write.segment && q.write.offset == 0 {
+		info, err := q.reader.Stat()
+		return err == nil && q.read.offset >= info.Size()
+	}
+	return false
+}
+
+func (q *Queue) nextReaderSegment() error {
+	q.reader.Close()
+	segment := q.read.segment + 1
+	f, err := os.Open(segmentPath(q.dir, segment))
+	if err != nil {
+		return err
+	}
+	q.reader = f
+	q.read = position{segment: segment}
+	return nil
+}
+
+// Acknowledges a record returned by Next and every record before it, deleting segments that were fully consumed
+func (q *Queue) Commit(r Record) error {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	end := r.end
+	if end.segment < q.committed.segment || (end.segment == q.committed.segment && end.offset <= q.committed.offset) {
+		return nil
+	}
+
+	// A record ending a segment that is no longer written to commits the whole segment
+	if end.segment < q.write.segment {
+		info, err := os.Stat(segmentPath(q.dir, end.segment))
+		if err != nil {
+			return err
+		}
+		if end.offset >= info.Size() {
+			end = position{segment: end.segment + 1}
+		}
+	}
+
+	for segment := q.committed.segment; segment < end.segment; segment++ {
+		path := segmentPath(q.dir, segment)
+		if info, err := os.Stat(path); err == nil {
+			q.size -= info.Size()
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	q.committed = end
+
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf[:8], q.committed.segment)
+	binary.BigEndian.PutUint64(buf[8:], uint64(q.committed.offset))
+	if _, err := q.positionFile.WriteAt(buf, 0); err != nil {
+		return err
+	}
+	if q.cfg.Fsync == "always" {
+		if err := q.positionFile.Sync(); err != nil {
+			return err
+		}
+	}
+	q.cond.Broadcast()
+	return nil
+}
+
+// Syncs files to disk at the configured interval if the fsync policy is 'interval'
+func (q *Queue) syncPeriodically() {
+	defer close(q.done)
+	if q.cfg.Fsync != "interval" {
+		<-q.stop
+		return
+	}
+	ticker := time.NewTicker(q.cfg.FsyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			q.mu.Lock()
+			logger.CheckErrAndLog(q.writer.Sync(), "QueueSyncError", fmt.Sprintf("Failed syncing queue segment in %s", q.dir))
+			logger.CheckErrAndLog(q.positionFile.Sync(), "QueueSyncError", fmt.Sprintf("Failed syncing queue position in %s", q.dir))
+			q.mu.Unlock()
+		case <-q.stop:
+			return
+		}
+	}
+}
+
+// Closes the queue, unblocking pending Append and Next calls
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return nil
+	}
+	q.closed = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+
+	close(q.stop)
+	<-q.done
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	err := q.writer.Sync()
+	if syncErr := q.positionFile.Sync(); err == nil {
+		err = syncErr
+	}
+	q.writer.Close()
+	q.reader.Close()
+	q.positionFile.Close()
+	return err
+}
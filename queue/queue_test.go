@@ -0,0 +1,149 @@
+package queue
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dimpogissou/isengard-server/config"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+// Reads n records from the queue, asserts they match the expected sequence starting at first and returns the last one
+func assertNextRecords(t *testing.T, q *Queue, first int, n int) Record {
+	var r Record
+	var err error
+	for i := first; i < first+n; i++ {
+		r, err = q.Next()
+		check(err)
+		if want := fmt.Sprintf("record-%d", i); string(r.Data) != want {
+			t.Errorf("Unexpected queue record, got %s, want %s", r.Data, want)
+		}
+	}
+	return r
+}
+
+// Tests records are read in order and uncommitted records are redelivered after reopening the queue
+func TestQueueRedeliversUncommittedRecords(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "queue")
+	check(err)
+	defer os.RemoveAll(dir)
+
+	cfg := config.QueueConfig{Directory: dir, SegmentSize: 64, Fsync: "always"}
+	q, err := Open(dir, cfg)
+	check(err)
+	for i := 0; i < 10; i++ {
+		check(q.Append([]byte(fmt.Sprintf("record-%d", i))))
+	}
+	r := assertNextRecords(t, q, 0, 4)
+	check(q.Commit(r))
+	assertNextRecords(t, q, 4, 2)
+	check(q.Close())
+
+	q, err = Open(dir, cfg)
+	check(err)
+	defer q.Close()
+	check(q.Commit(assertNextRecords(t, q, 4, 6)))
+
+	segments, err := listSegments(dir)
+	check(err)
+	if len(segments) != 1 {
+		t.Errorf("Consumed segments should be deleted after commit, got %d segments", len(segments))
+	}
+}
+
+// Tests a partially written record left by a crash is discarded when reopening the queue
+func TestQueueRecoversTornWrite(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "queue")
+	check(err)
+	defer os.RemoveAll(dir)
+
+	cfg := config.QueueConfig{Directory: dir, Fsync: "never"}
+	q, err := Open(dir, cfg)
+	check(err)
+	check(q.Append([]byte("record-0")))
+	check(q.Close())
+
+	// Simulate a crash in the middle of writing a record
+	f, err := os.OpenFile(segmentPath(dir, 0), os.O_WRONLY|os.O_APPEND, 0644)
+	check(err)
+	_, err = f.Write([]byte{0, 0, 0, 42, 1, 2})
+	check(err)
+	check(f.Close())
+
+	q, err = Open(dir, cfg)
+	check(err)
+	defer q.Close()
+	check(q.Append([]byte("record-1")))
+	assertNextRecords(t, q, 0, 2)
+}
+
+// Tests Append blocks while the queue is full and resumes once records are committed
+func TestQueueBlocksWhenFull(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "queue")
+	check(err)
+	defer os.RemoveAll(dir)
+
+	// Each record takes 16 bytes, segments hold 2 records and the queue 4
+	cfg := config.QueueConfig{Directory: dir, SegmentSize: 32, MaxSize: 64, Fsync: "never"}
+	q, err := Open(dir, cfg)
+	check(err)
+	defer q.Close()
+	for i := 0; i < 4; i++ {
+		check(q.Append([]byte(fmt.Sprintf("record-%d", i))))
+	}
+
+	appended := make(chan error)
+	go func() { appended <- q.Append([]byte("record-4")) }()
+
+	select {
+	case <-appended:
+		t.Fatalf("Append should block while the queue is full")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	check(q.Commit(assertNextRecords(t, q, 0, 2)))
+
+	select {
+	case err := <-appended:
+		check(err)
+	case <-time.After(time.Second):
+		t.Fatalf("Append should resume once records are committed")
+	}
+	assertNextRecords(t, q, 2, 3)
+}
+
+// Tests TryAppend fails without blocking while the queue is full
+func TestQueueTryAppendWhenFull(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "queue")
+	check(err)
+	defer os.RemoveAll(dir)
+
+	// Each record takes 16 bytes, segments hold 2 records and the queue 4
+	cfg := config.QueueConfig{Directory: dir, SegmentSize: 32, MaxSize: 64, Fsync: "never"}
+	q, err := Open(dir, cfg)
+	check(err)
+	defer q.Close()
+	for i := 0; i < 4; i++ {
+		check(q.TryAppend([]byte(fmt.Sprintf("record-%d", i))))
+	}
+
+	if err := q.TryAppend([]byte("record-4")); err != ErrFull {
+		t.Fatalf("TryAppend should fail with ErrFull while the queue is full, got %v", err)
+	}
+
+	check(q.Commit(assertNextRecords(t, q, 0, 2)))
+	check(q.TryAppend([]byte("record-4")))
+	assertNextRecords(t, q, 2, 3)
+}
@@ -0,0 +1,172 @@
+package tailing
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/dimpogissou/isengard-server/config"
+	"github.com/dimpogissou/isengard-server/logger"
+	"github.com/hpcloud/tail"
+)
+
+// FileSet selects the files tailed under a logs directory and keeps track of the tailed files
+type FileSet struct {
+	Dir       string
+	include   []string
+	exclude   []string
+	recursive bool
+	maxFiles  int
+
+	mu     sync.Mutex
+	tailed map[string]*tail.Tail
+}
+
+// Creates the set of files tailed under a directory from the files configuration
+func NewFileSet(dir string, cfg config.FilesConfig) *FileSet {
+	include, exclude := cfg.Patterns()
+	return &FileSet{
+		Dir:       filepath.Clean(dir),
+		include:   include,
+		exclude:   exclude,
+		recursive: cfg.Recursive,
+		maxFiles:  cfg.MaxFiles,
+		tailed:    map[string]*tail.Tail{},
+	}
+}
+
+// Returns true if a glob pattern matches the path, patterns without separator are matched against the file name
+func globMatches(pattern string, relPath string) bool {
+	name := relPath
+	if !strings.Contains(pattern, "/") {
+		name = filepath.Base(relPath)
+	}
+	matched, _ := filepath.Match(pattern, name)
+	return matched
+}
+
+// Returns the path relative to the directory of the set, false if the path is outside of it
+func (s *FileSet) relative(path string) (string, bool) {
+	relPath, err := filepath.Rel(s.Dir, path)
+	if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(relPath), true
+}
+
+// Returns true if the path is under the directory of the set
+func (s *FileSet) contains(path string) bool {
+	_, ok := s.relative(path)
+	return ok
+}
+
+// Returns true if the file at path is selected by the include and exclude patterns
+func (s *FileSet) Matches(path string) bool {
+	relPath, ok := s.relative(path)
+	if !ok {
+		return false
+	}
+	if !s.recursive && strings.Contains(relPath, "/") {
+		return false
+	}
+	for _, pattern := range s.exclude {
+		if globMatches(pattern, relPath) {
+			return false
+		}
+	}
+	if len(s.include) == 0 {
+		return true
+	}
+	for _, pattern := range s.include {
+		if globMatches(pattern, relPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// Marks a selected file as tailed, returns false if it is excluded, already tailed, or the MaxFiles cap is reached
+func (s *FileSet) Add(path string) bool {
+	if !s.Matches(path) {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tailed[path]; ok {
+		return false
+	}
+	if s.maxFiles > 0 && len(s.tailed) >= s.maxFiles {
+		logger.Warn("MaxFilesReached", fmt.Sprintf("Not tailing %s, already tailing the maximum of %d files", path, s.maxFiles))
+		return false
+	}
+	s.tailed[path] = nil
+	return true
+}
+
+// Records the tail of a file added to the set
+func (s *FileSet) started(path string, t *tail.Tail) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tailed[path]; ok {
+		s.tailed[path] = t
+	}
+}
+
+// Releases a file which could not be tailed or was removed
+func (s *FileSet) Remove(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tailed, path)
+}
+
+// Releases the tailed files at path or under it if it is a directory, returns their tails
+func (s *FileSet) release(path string) []*tail.Tail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tails := []*tail.Tail{}
+	prefix := strings.TrimSuffix(path, string(filepath.Separator)) + string(filepath.Separator)
+	for tailedPath, t := range s.tailed {
+		if tailedPath != path && !strings.HasPrefix(tailedPath, prefix) {
+			continue
+		}
+		delete(s.tailed, tailedPath)
+		if t != nil {
+			tails = append(tails, t)
+		}
+	}
+	return tails
+}
+
+// Returns the number of tailed files
+func (s *FileSet) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.tailed)
+}
+
+// Lists the directories to watch and the regular files found under dir, descending into nested directories if recursive
+func (s *FileSet) walk(dir string) ([]string, []string) {
+	dirs := []string{}
+	files := []string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			logger.CheckWarnAndLog(err, "FailedRetrievingFiles", fmt.Sprintf("Could not read %s", path))
+			return nil
+		}
+		if info.IsDir() {
+			if path != dir && !s.recursive {
+				return filepath.SkipDir
+			}
+			dirs = append(dirs, path)
+		} else if info.Mode().IsRegular() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Error("FailedRetrievingFiles", fmt.Sprintf("Could not get files from directory %s due to -> %s", dir, err))
+	}
+	return dirs, files
+}
@@ -0,0 +1,113 @@
+package tailing
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/dimpogissou/isengard-server/config"
+	"github.com/dimpogissou/isengard-server/events"
+	"github.com/dimpogissou/isengard-server/observer"
+	"github.com/dimpogissou/isengard-server/testutils"
+	"gopkg.in/fsnotify.v1"
+)
+
+// Asserts files are selected by include and exclude globs, and nested files only when recursive
+func TestFileSetMatches(t *testing.T) {
+
+	cases := []struct {
+		cfg  config.FilesConfig
+		path string
+		want bool
+	}{
+		{config.FilesConfig{}, "/logs/app.txt", true},
+		{config.FilesConfig{}, "/logs/app/app.log", false},
+		{config.FilesConfig{}, "/other/app.log", false},
+		{config.FilesConfig{Include: []string{"*.log"}}, "/logs/app.log", true},
+		{config.FilesConfig{Include: []string{"*.log"}}, "/logs/app.txt", false},
+		{config.FilesConfig{Include: []string{"*.log*", "!*.gz"}}, "/logs/app.log.1", true},
+		{config.FilesConfig{Include: []string{"*.log*", "!*.gz"}}, "/logs/app.log.1.gz", false},
+		{config.FilesConfig{Exclude: []string{"*.gz"}}, "/logs/app.log.gz", false},
+		{config.FilesConfig{Include: []string{"*.log"}, Recursive: true}, "/logs/app/nested/app.log", true},
+		{config.FilesConfig{Include: []string{"app/*.log"}, Recursive: true}, "/logs/app/app.log", true},
+		{config.FilesConfig{Include: []string{"app/*.log"}, Recursive: true}, "/logs/web/app.log", false},
+	}
+	for _, c := range cases {
+		if got := NewFileSet("/logs/", c.cfg).Matches(c.path); got != c.want {
+			t.Errorf("FileSet(%+v).Matches(%s) == %v, want %v", c.cfg, c.path, got, c.want)
+		}
+	}
+}
+
+// Asserts no more than MaxFiles files are tailed, and files are only tailed once
+func TestFileSetMaxFiles(t *testing.T) {
+
+	files := NewFileSet("/logs", config.FilesConfig{MaxFiles: 2})
+	for _, c := range []struct {
+		path string
+		want bool
+	}{{"/logs/a.log", true}, {"/logs/a.log", false}, {"/logs/b.log", true}, {"/logs/c.log", false}} {
+		if got := files.Add(c.path); got != c.want {
+			t.Errorf("Add(%s) == %v, want %v", c.path, got, c.want)
+		}
+	}
+	files.Remove("/logs/b.log")
+	if !files.Add("/logs/c.log") || files.Len() != 2 {
+		t.Errorf("Expected a released file to free a slot for another file")
+	}
+}
+
+// Asserts files in nested directories are tailed, including directories created after startup, and excluded files are not
+func TestTailNestedDirectories(t *testing.T) {
+
+	const testLogLine = "[2020-10-07 20:56:47.375586 UTC][INFO][009] Log message"
+
+	dir, err := ioutil.TempDir("", "nested")
+	check(err)
+	defer os.RemoveAll(dir)
+	check(os.Mkdir(filepath.Join(dir, "existing"), 0755))
+	check(ioutil.WriteFile(filepath.Join(dir, "existing", "app.log"), []byte{}, 0644))
+
+	watcher, err := fsnotify.NewWatcher()
+	check(err)
+	defer watcher.Close()
+
+	logsPublisher := &observer.Publisher{}
+	subscriber := &observer.Subscriber{Channel: make(chan *events.Event, 10), Connector: testutils.MockConnector{}}
+	logsPublisher.Subscribe(subscriber)
+	sigCh := make(chan os.Signal)
+	defer close(sigCh)
+
+	files := NewFileSet(dir, config.FilesConfig{Include: []string{"*.log"}, Recursive: true})
+	inputs := []*Input{&Input{Files: files, Publisher: logsPublisher}}
+	tails := InitTails(inputs, watcher, nil)
+	for _, tl := range tails {
+		defer tl.Stop()
+	}
+	if len(tails) != 1 {
+		t.Fatalf("Expected the nested existing file to be tailed, got %d tails", len(tails))
+	}
+	go TailNewFiles(watcher, inputs, nil, sigCh)
+
+	newDir := filepath.Join(dir, "new", "nested")
+	check(os.MkdirAll(newDir, 0755))
+	time.Sleep(200 * time.Millisecond)
+	check(ioutil.WriteFile(filepath.Join(newDir, "app.log.gz"), []byte("excluded\n"), 0644))
+	check(ioutil.WriteFile(filepath.Join(newDir, "app.log"), []byte(testLogLine+"\n"), 0644))
+
+	select {
+	case e := <-subscriber.Channel:
+		if e.Text != testLogLine || e.Source != filepath.Join(newDir, "app.log") {
+			t.Errorf("Unexpected event %q from %s", e.Text, e.Source)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Timed out waiting for line written in new nested directory")
+	}
+	sigCh <- syscall.SIGINT
+	if files.Len() != 2 {
+		t.Errorf("Expected 2 tailed files, got %d", files.Len())
+	}
+}
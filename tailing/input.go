@@ -0,0 +1,85 @@
+package tailing
+
+import (
+	"regexp"
+
+	"github.com/dimpogissou/isengard-server/config"
+	"github.com/dimpogissou/isengard-server/events"
+	"github.com/dimpogissou/isengard-server/observer"
+)
+
+// Input tails the files of a configured input, parses their lines and publishes events to the input connectors
+type Input struct {
+	Name       string
+	Files      *FileSet
+	Parser     config.Parser
+	Multiline  *Multiline
+	Unmatched  *Unmatched
+	Processors []Processor
+	Tags       []string
+	Publisher  *observer.Publisher
+}
+
+// Creates an input from its configuration, publishing events to the provided publisher
+func NewInput(cfg config.InputConfig, publisher *observer.Publisher) (*Input, error) {
+	parser, err := config.BuildInputParser(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var re *regexp.Regexp
+	if regexParser, ok := parser.(*config.RegexParser); ok {
+		re = regexParser.Regex
+	}
+	multiline, err := NewMultiline(cfg.Multiline, re)
+	if err != nil {
+		return nil, err
+	}
+	processors, err := NewProcessors(cfg.Processors)
+	if err != nil {
+		return nil, err
+	}
+	unmatched, err := NewUnmatched(cfg.Unmatched)
+	if err != nil {
+		return nil, err
+	}
+	return &Input{
+		Name:       cfg.Name,
+		Files:      NewFileSet(cfg.Directory, cfg.Files),
+		Parser:     parser,
+		Multiline:  multiline,
+		Unmatched:  unmatched,
+		Processors: processors,
+		Tags:       cfg.Tags,
+		Publisher:  publisher,
+	}, nil
+}
+
+// Builds an event from the text of a line read at offset in source, tagged with the input tags
+// and transformed by the input processors
+func (input *Input) newEvent(text string, source string, offset int64) *events.Event {
+	e := events.New(text, source, offset, input.Parser)
+	if len(input.Tags) > 0 {
+		e.Tags = append([]string{}, input.Tags...)
+	}
+	for _, process := range input.Processors {
+		process(e)
+	}
+	return e
+}
+
+// Publishes an event to the input connectors, or with the unmatched policy if its line failed parsing
+func (input *Input) publish(e *events.Event) {
+	if e.Matched || input.Parser == nil || input.Unmatched == nil || input.Unmatched.handle(input.Name, e) {
+		input.Publisher.Publish(e)
+	}
+}
+
+// Returns the first input selecting the file at path, nil if none does
+func owner(inputs []*Input, path string) *Input {
+	for _, input := range inputs {
+		if input.Files.Matches(path) {
+			return input
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package tailing
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dimpogissou/isengard-server/config"
+	"github.com/dimpogissou/isengard-server/events"
+	"github.com/dimpogissou/isengard-server/observer"
+	"github.com/dimpogissou/isengard-server/testutils"
+)
+
+// Asserts each input tails its own files, parses them with its own pattern, tags events and publishes them to its own connectors
+func TestInputs(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "inputs")
+	check(err)
+	defer os.RemoveAll(dir)
+	apiLog := testutils.CreateTestFile(dir, "api.log")
+	accessLog := testutils.CreateTestFile(dir, "access.log")
+
+	cfgs := []config.InputConfig{
+		config.InputConfig{Name: "api", Directory: dir, Files: config.FilesConfig{Include: []string{"api.log"}},
+			LogPattern: `^\[(?P<level>%s)\] (?P<message>.*)`, Definitions: []config.PatternConfig{{Name: "LogLevelPattern", Pattern: "[A-Z]+"}}, Tags: []string{"api"}},
+		config.InputConfig{Name: "access", Directory: dir,
+			LogPattern: `^(?P<method>[A-Z]+) (?P<path>\S+) (?P<status>\d+)`, Tags: []string{"access", "http"}},
+	}
+	channels := []chan *events.Event{}
+	inputs := []*Input{}
+	for _, cfg := range cfgs {
+		ch := make(chan *events.Event, 10)
+		logsPublisher := &observer.Publisher{}
+		logsPublisher.Subscribe(&observer.Subscriber{Channel: ch, Connector: testutils.MockConnector{}})
+		input, err := NewInput(cfg, logsPublisher)
+		check(err)
+		channels = append(channels, ch)
+		inputs = append(inputs, input)
+	}
+	for _, tl := range InitTails(inputs, nil, nil) {
+		defer tl.Stop()
+	}
+	go testutils.SleepThenWriteToFile(apiLog, 500*time.Millisecond, 1, "[ERROR] Timeout")
+	go testutils.SleepThenWriteToFile(accessLog, 500*time.Millisecond, 1, "GET /health 200")
+
+	want := []string{
+		"api.log [api] map[level:ERROR message:Timeout]",
+		"access.log [access http] map[method:GET path:/health status:200]",
+	}
+	for i, ch := range channels {
+		select {
+		case e := <-ch:
+			if got := fmt.Sprintf("%s %v %v", filepath.Base(e.Source), e.Tags, e.Fields); got != want[i] {
+				t.Errorf("Input %s published %s, want %s", inputs[i].Name, got, want[i])
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timed out waiting for event of input %s", inputs[i].Name)
+		}
+	}
+	if len(channels[0])+len(channels[1]) != 0 {
+		t.Errorf("Expected each file to be published by a single input")
+	}
+}
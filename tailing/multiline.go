@@ -0,0 +1,61 @@
+package tailing
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/dimpogissou/isengard-server/config"
+)
+
+// Multiline assembly settings of a tail, lines not matching Start are appended to the current event
+type Multiline struct {
+	Start    *regexp.Regexp
+	MaxLines int
+	Timeout  time.Duration
+}
+
+// Builds the multiline settings from config, returns nil if multiline assembly is disabled
+func NewMultiline(cfg config.MultilineConfig, logRegex *regexp.Regexp) (*Multiline, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	cfg = cfg.WithDefaults()
+	start, err := cfg.StartRegex(logRegex)
+	if err != nil {
+		return nil, err
+	}
+	return &Multiline{Start: start, MaxLines: cfg.MaxLines, Timeout: cfg.Timeout}, nil
+}
+
+// Assembles consecutive lines into the text of multiline events
+type assembler struct {
+	multiline *Multiline
+	lines     []string
+}
+
+// Adds a line, returning the text of the events it completes: the pending event if the line starts a new one,
+// and the new event if it reached its maximum line count
+func (a *assembler) add(line string) []string {
+	completed := []string{}
+	if len(a.lines) > 0 && (a.multiline.Start == nil || a.multiline.Start.MatchString(line)) {
+		completed = append(completed, a.flush())
+	}
+	a.lines = append(a.lines, line)
+	if len(a.lines) >= a.multiline.MaxLines {
+		completed = append(completed, a.flush())
+	}
+	return completed
+}
+
+// Returns whether lines are waiting for the pending event to complete
+func (a *assembler) pending() bool {
+	return len(a.lines) > 0
+}
+
+// Returns the text of the pending event and starts a new one
+func (a *assembler) flush() string {
+	text := strings.Join(a.lines, "\n")
+	a.lines = nil
+	return text
+}
@@ -0,0 +1,83 @@
+package tailing
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/dimpogissou/isengard-server/config"
+	"github.com/dimpogissou/isengard-server/events"
+	"github.com/dimpogissou/isengard-server/observer"
+	"github.com/dimpogissou/isengard-server/testutils"
+)
+
+// Asserts continuation lines are appended to the event started before them, until the next start or max lines
+func TestMultilineAssembler(t *testing.T) {
+
+	lines := assembler{multiline: &Multiline{Start: regexp.MustCompile(`^\[`), MaxLines: 3}}
+	cases := []struct {
+		line string
+		want []string
+	}{
+		{"  orphan continuation", []string{}},
+		{"[ERROR] Exception", []string{"  orphan continuation"}},
+		{"  at Foo.bar()", []string{}},
+		{"[INFO] Next", []string{"[ERROR] Exception\n  at Foo.bar()"}},
+		{"  line 2", []string{}},
+		{"  line 3", []string{"[INFO] Next\n  line 2\n  line 3"}},
+		{"  line 4", []string{}},
+	}
+	for _, c := range cases {
+		if got := lines.add(c.line); fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Errorf("add(%q) == %q, want %q", c.line, got, c.want)
+		}
+	}
+	if !lines.pending() || lines.flush() != "  line 4" || lines.pending() {
+		t.Errorf("Expected the last line to be pending until flushed")
+	}
+}
+
+// Asserts a stack trace is published as one parsed event, flushed once no line was read for the timeout
+func TestTailMultiline(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "multiline")
+	check(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	lines := "[ERROR] Unhandled exception\njava.lang.NullPointerException\n\tat Foo.bar(Foo.java:42)\n[INFO] Recovered\n"
+	check(ioutil.WriteFile(path, []byte(lines), 0644))
+
+	re := regexp.MustCompile(`(?s)^\[(?P<level>[A-Z]+)\] (?P<message>.*)`)
+	multiline, err := NewMultiline(config.MultilineConfig{Enabled: true, Timeout: 200 * time.Millisecond}, re)
+	check(err)
+
+	logsPublisher := &observer.Publisher{}
+	subscriber := &observer.Subscriber{Channel: make(chan *events.Event, 10), Connector: testutils.MockConnector{}}
+	logsPublisher.Subscribe(subscriber)
+	tl, err := createTail(path, 0)
+	check(err)
+	defer tl.Stop()
+	go TailAndPublish(tl, &Input{Parser: config.NewRegexParser(re), Multiline: multiline, Publisher: logsPublisher}, nil)
+
+	want := []struct {
+		message string
+		offset  int64
+	}{
+		{"Unhandled exception\njava.lang.NullPointerException\n\tat Foo.bar(Foo.java:42)", 0},
+		{"Recovered", 84},
+	}
+	for _, w := range want {
+		select {
+		case e := <-subscriber.Channel:
+			if e.Field("message") != w.message || e.Offset != w.offset {
+				t.Errorf("Unexpected event message %q at offset %d, want %q at offset %d", e.Field("message"), e.Offset, w.message, w.offset)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timed out waiting for multiline event %q", w.message)
+		}
+	}
+}
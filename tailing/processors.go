@@ -0,0 +1,106 @@
+package tailing
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/dimpogissou/isengard-server/config"
+	"github.com/dimpogissou/isengard-server/events"
+)
+
+// Processor transforms an event between parsing and publishing
+type Processor func(e *events.Event)
+
+// Creates the processors of an input from their configuration, in order
+func NewProcessors(cfgs []config.ProcessorConfig) ([]Processor, error) {
+	processors := []Processor{}
+	for _, cfg := range cfgs {
+		processor, err := newProcessor(cfg)
+		if err != nil {
+			return nil, err
+		}
+		processors = append(processors, processor)
+	}
+	return processors, nil
+}
+
+func newProcessor(cfg config.ProcessorConfig) (Processor, error) {
+	switch {
+	case len(cfg.Rename) > 0:
+		// Renames are applied in a stable order, so that chained renames such as a to b and b to c are deterministic
+		names := make([]string, 0, len(cfg.Rename))
+		for name := range cfg.Rename {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return func(e *events.Event) {
+			for _, name := range names {
+				if value, ok := e.Fields[name]; ok {
+					delete(e.Fields, name)
+					e.Fields[cfg.Rename[name]] = value
+				}
+				if value, ok := e.Values[name]; ok {
+					delete(e.Values, name)
+					e.Values[cfg.Rename[name]] = value
+				}
+			}
+		}, nil
+	case len(cfg.Drop) > 0:
+		return func(e *events.Event) {
+			for _, name := range cfg.Drop {
+				delete(e.Fields, name)
+				delete(e.Values, name)
+			}
+		}, nil
+	case len(cfg.Add) > 0:
+		return func(e *events.Event) {
+			for name, value := range cfg.Add {
+				setField(e, name, value)
+			}
+		}, nil
+	case len(cfg.Tags) > 0:
+		return func(e *events.Event) {
+			e.Tags = append(e.Tags, cfg.Tags...)
+		}, nil
+	case cfg.Hostname != "":
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		return func(e *events.Event) {
+			setField(e, cfg.Hostname, hostname)
+		}, nil
+	case cfg.Source != "":
+		return func(e *events.Event) {
+			setField(e, cfg.Source, e.Source)
+		}, nil
+	case cfg.Basename != "":
+		return func(e *events.Event) {
+			setField(e, cfg.Basename, filepath.Base(e.Source))
+		}, nil
+	case cfg.Copy != nil:
+		re, err := regexp.Compile(cfg.Copy.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		return func(e *events.Event) {
+			value, ok := e.Fields[cfg.Copy.From]
+			if !ok {
+				return
+			}
+			if cfg.Copy.Pattern != "" {
+				value = re.ReplaceAllString(value, cfg.Copy.Replacement)
+			}
+			setField(e, cfg.Copy.To, value)
+		}, nil
+	}
+	return func(e *events.Event) {}, nil
+}
+
+// Sets the text of a field, removing the typed value it may have had
+func setField(e *events.Event, name string, value string) {
+	e.Fields[name] = value
+	delete(e.Values, name)
+}
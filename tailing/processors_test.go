@@ -0,0 +1,53 @@
+package tailing
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/dimpogissou/isengard-server/config"
+	"github.com/dimpogissou/isengard-server/events"
+	"github.com/dimpogissou/isengard-server/observer"
+	"github.com/dimpogissou/isengard-server/testutils"
+)
+
+// Asserts the processors of an input transform events in order before they are published
+func TestProcessors(t *testing.T) {
+
+	ch := make(chan *events.Event, 10)
+	logsPublisher := &observer.Publisher{}
+	logsPublisher.Subscribe(&observer.Subscriber{Channel: ch, Connector: testutils.MockConnector{Levels: []string{"ERROR"}}})
+	input, err := NewInput(config.InputConfig{
+		Name:       "api",
+		Directory:  "./",
+		LogPattern: `^%{WORD:severity} %{NUMBER:code:int} %{NUMBER:pid} %{GREEDYDATA:msg}`,
+		Processors: []config.ProcessorConfig{
+			{Rename: map[string]string{"severity": "level", "code": "status"}},
+			{Drop: []string{"pid"}},
+			{Add: map[string]string{"env": "prod", "service": "api"}},
+			{Tags: []string{"prod"}},
+			{Hostname: "host"},
+			{Source: "path"},
+			{Basename: "file"},
+			{Copy: &config.CopyConfig{From: "msg", To: "user", Pattern: `^.*user=(\w+).*$`, Replacement: "$1"}},
+		},
+	}, logsPublisher)
+	check(err)
+
+	e := input.newEvent("ERROR 500 4242 Request failed for user=alice", "/var/log/api/server.log", 0)
+	input.publish(e)
+
+	hostname, _ := os.Hostname()
+	want := fmt.Sprintf("map[env:prod file:server.log host:%s level:ERROR msg:Request failed for user=alice path:/var/log/api/server.log service:api status:500 user:alice]", hostname)
+	select {
+	case got := <-ch:
+		if fmt.Sprint(got.Fields) != want {
+			t.Errorf("Unexpected processed fields, got %v, want %s", got.Fields, want)
+		}
+		if fmt.Sprint(got.Values) != "map[status:500]" || fmt.Sprint(got.Tags) != "[prod]" {
+			t.Errorf("Unexpected processed values or tags, got %v and %v", got.Values, got.Tags)
+		}
+	default:
+		t.Fatalf("Processed event with renamed level not published to connector filtering levels")
+	}
+}
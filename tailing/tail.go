@@ -4,64 +4,220 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"log"
 	"os"
+	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/dimpogissou/isengard-server/checkpoint"
 	"github.com/dimpogissou/isengard-server/logger"
-	"github.com/dimpogissou/isengard-server/observer"
 	"github.com/hpcloud/tail"
 	"gopkg.in/fsnotify.v1"
 )
 
-// Collects file names in provided directory as an array of strings
-func getFileNamesInDir(dir string) []string {
-	files, err := ioutil.ReadDir(dir)
-	if err != nil {
-		logger.Error("FailedRetrievingFiles", fmt.Sprintf("Could not get files from directory %s due to -> %s", dir, err))
-	}
-	paths := []string{}
-	for _, f := range files {
-		paths = append(paths, f.Name())
-	}
-	return paths
+// Starts tailing a file at provided path from the provided byte offset
+func createTail(path string, offset int64) (*tail.Tail, error) {
+
+	logger.Info(fmt.Sprintf("Start tailing file %s at offset %d", path, offset))
+
+	t, err := tail.TailFile(path, tail.Config{Follow: true, MustExist: true, Location: &tail.SeekInfo{Offset: offset, Whence: io.SeekStart}, ReOpen: true, Poll: true,
+		Logger: log.New(&reopenLog{}, "", 0)})
+
+	return t, err
 }
 
-// Starts tailing a file at provided path, from start if whence = 0, from the end if whence = 2
-func createTail(path string, whence int) (*tail.Tail, error) {
+// Log of a tail, recording when the tail reopened its file after a rotation or truncation.
+// The tail logs it before sending the first line of the reopened file.
+type reopenLog struct {
+	reopened int32
+}
 
-	logger.Info(fmt.Sprintf("Start tailing file %s", path))
+func (l *reopenLog) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	if strings.HasPrefix(msg, "Successfully reopened") {
+		atomic.StoreInt32(&l.reopened, 1)
+	}
+	logger.Debug(msg)
+	return len(p), nil
+}
 
-	t, err := tail.TailFile(path, tail.Config{Follow: true, MustExist: true, Location: &tail.SeekInfo{Offset: 0, Whence: whence}, ReOpen: true, Poll: true})
+// Returns true if the tail reopened its file since the last call
+func reopened(t *tail.Tail) bool {
+	tailLog, ok := t.Logger.(*log.Logger)
+	if !ok {
+		return false
+	}
+	l, ok := tailLog.Writer().(*reopenLog)
+	return ok && atomic.SwapInt32(&l.reopened, 0) == 1
+}
 
-	return t, err
+// Returns the offset to start tailing a file from: its checkpoint if any,
+// otherwise its end if fromEnd is true (files existing at startup) or its start (new files)
+func startOffset(path string, store *checkpoint.Store, fromEnd bool) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	if offset, ok := store.Resume(path, info); ok {
+		return offset, nil
+	}
+	if fromEnd {
+		return info.Size(), nil
+	}
+	return 0, nil
+}
+
+// Starts tailing and publishing the selected files of every input, resuming from their checkpoints if available.
+// Directories are added to the watcher if not nil, so that new files are detected.
+// Returns the started tails, to be stopped by the caller.
+func InitTails(inputs []*Input, watcher *fsnotify.Watcher, store *checkpoint.Store) []*tail.Tail {
+	var tails = make([]*tail.Tail, 0)
+	for _, input := range inputs {
+		tails = append(tails, tailDir(inputs, input, input.Files.Dir, watcher, store, true)...)
+	}
+	return tails
 }
 
-// Starts tailing all files in provided directory
-func InitTailsFromDir(dir string) []*tail.Tail {
+// Watches the directories and tails the files of an input found under dir, from their end if fromEnd is true
+func tailDir(inputs []*Input, input *Input, dir string, watcher *fsnotify.Watcher, store *checkpoint.Store, fromEnd bool) []*tail.Tail {
 
-	var files = getFileNamesInDir(dir)
+	dirs, paths := input.Files.walk(dir)
+	if watcher != nil {
+		for _, d := range dirs {
+			if err := watcher.Add(d); err != nil {
+				logger.Error("FailedWatchingDirectory", fmt.Sprintf("Could not watch directory [%s] due to -> %s", d, err))
+			}
+		}
+	}
 	var tails = make([]*tail.Tail, 0)
-	for _, fileName := range files {
-		filePath := fmt.Sprintf("%s/%s", dir, fileName)
-		t, err := createTail(filePath, io.SeekEnd)
-		if err != nil {
-			logger.Error("FailedTailingFile", fmt.Sprintf("Could not tail file [%s] due to -> %s", filePath, err))
-		} else {
+	for _, filePath := range paths {
+		if owner(inputs, filePath) != input {
+			continue
+		}
+		if t, ok := tailFile(input, filePath, store, fromEnd); ok {
 			tails = append(tails, t)
 		}
 	}
 	return tails
 }
 
-// Routine tailing a file and sending lines to logs channel
-func TailAndPublish(lines chan *tail.Line, publisher observer.Publisher) {
-	for line := range lines {
-		publisher.Publish(line)
+// Starts tailing and publishing a file of an input from its checkpoint if any, from its end if fromEnd is true,
+// from its start otherwise
+func tailFile(input *Input, filePath string, store *checkpoint.Store, fromEnd bool) (*tail.Tail, bool) {
+	if !input.Files.Add(filePath) {
+		return nil, false
+	}
+	offset, err := startOffset(filePath, store, fromEnd)
+	if err != nil {
+		logger.Error("FailedTailingFile", fmt.Sprintf("Could not stat file [%s] due to -> %s", filePath, err))
+		input.Files.Remove(filePath)
+		return nil, false
+	}
+	t, err := createTail(filePath, offset)
+	if err != nil {
+		logger.Error("FailedTailingFile", fmt.Sprintf("Could not tail file [%s] due to -> %s", filePath, err))
+		input.Files.Remove(filePath)
+		return nil, false
+	}
+	input.Files.started(filePath, t)
+	go TailAndPublish(t, input, store)
+	return t, true
+}
+
+// Returns a cursor committing acknowledged offsets of the tailed file to the store
+func tailCursor(t *tail.Tail, store *checkpoint.Store) *checkpoint.Cursor {
+	info, err := os.Stat(t.Filename)
+	if err != nil {
+		logger.CheckWarnAndLog(err, "FailedStatingTailedFile", fmt.Sprintf("Checkpoints disabled for %s", t.Filename))
+		return nil
+	}
+	return store.Cursor(t.Filename, checkpoint.Inode(info))
+}
+
+// Routine tailing a file, building an event for each line and publishing it.
+// With multiline assembly, consecutive lines are published as a single event once the next event starts,
+// the event reaches its maximum line count, or no line was read for the multiline timeout.
+// Offsets are committed to the checkpoint store once all connectors acknowledged the line.
+// When the tail reopens a rotated or truncated file, offsets restart from 0 and are committed for the new file.
+func TailAndPublish(t *tail.Tail, input *Input, store *checkpoint.Store) {
+	offset := t.Location.Offset
+	cursor := tailCursor(t, store)
+	publish := func(text string) {
+		e := input.newEvent(text, t.Filename, offset)
+		offset = e.EndOffset()
+		e.OnAcknowledged(cursor.Track(offset))
+		input.publish(e)
+	}
+	restart := func() {
+		logger.Info(fmt.Sprintf("Restarting offsets of reopened file %s", t.Filename))
+		cursor.Stop()
+		offset = 0
+		cursor = tailCursor(t, store)
+	}
+	multiline := input.Multiline
+
+	if multiline == nil {
+		for line := range t.Lines {
+			if line.Err != nil {
+				logger.CheckWarnAndLog(line.Err, "TailLineError", fmt.Sprintf("Skipping line received from tail of %s", t.Filename))
+				continue
+			}
+			if reopened(t) {
+				restart()
+			}
+			publish(line.Text)
+		}
+		return
+	}
+
+	lines := assembler{multiline: multiline}
+	timer := time.NewTimer(multiline.Timeout)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		select {
+		case line, ok := <-t.Lines:
+			if !ok {
+				if lines.pending() {
+					publish(lines.flush())
+				}
+				return
+			}
+			if line.Err != nil {
+				logger.CheckWarnAndLog(line.Err, "TailLineError", fmt.Sprintf("Skipping line received from tail of %s", t.Filename))
+				continue
+			}
+			if reopened(t) {
+				if lines.pending() {
+					publish(lines.flush())
+				}
+				restart()
+			}
+			for _, text := range lines.add(line.Text) {
+				publish(text)
+			}
+			// Restart the timeout of the pending event from its last line
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			if lines.pending() {
+				timer.Reset(multiline.Timeout)
+			}
+		case <-timer.C:
+			if lines.pending() {
+				publish(lines.flush())
+			}
+		}
 	}
 }
 
-// Monitors and tails new files, returns on signal interruption
-func TailNewFiles(watcher *fsnotify.Watcher, logsPublisher observer.Publisher, sigChan chan os.Signal) {
+// Monitors and tails new files of the inputs, and new nested directories of recursive inputs,
+// stops tailing files once they are removed or renamed, returns on signal interruption
+func TailNewFiles(watcher *fsnotify.Watcher, inputs []*Input, store *checkpoint.Store, sigChan chan os.Signal) {
 
 	for {
 		select {
@@ -71,13 +227,37 @@ func TailNewFiles(watcher *fsnotify.Watcher, logsPublisher observer.Publisher, s
 				return
 			}
 			if event.Op&fsnotify.Create == fsnotify.Create {
-				// Tail new file from beginning of file
-				t, err := createTail(event.Name, io.SeekStart)
-				defer t.Stop()
+				info, err := os.Stat(event.Name)
 				if err != nil {
-					logger.CheckErrAndLog(err, "FailedTailingNewFile", fmt.Sprintf("Error occured at tail creation for %s", event.Name))
-				} else {
-					go TailAndPublish(t.Lines, logsPublisher)
+					logger.CheckErrAndLog(err, "FailedTailingNewFile", fmt.Sprintf("Could not stat new file %s", event.Name))
+					continue
+				}
+				// Watch new nested directories and tail the files already created in them from their beginning,
+				// tail new files from their checkpoint if any, from their beginning otherwise
+				var tails []*tail.Tail
+				if info.IsDir() {
+					for _, input := range inputs {
+						if input.Files.recursive && input.Files.contains(event.Name) {
+							tails = append(tails, tailDir(inputs, input, event.Name, watcher, store, false)...)
+						}
+					}
+				} else if input := owner(inputs, event.Name); input != nil {
+					if t, ok := tailFile(input, event.Name, store, false); ok {
+						tails = append(tails, t)
+					}
+				}
+				for _, t := range tails {
+					defer t.Stop()
+				}
+			}
+			// Lines written before a file was removed or renamed are still published, a file created again
+			// at the same path is tailed from its beginning on its Create event
+			if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+				for _, input := range inputs {
+					for _, t := range input.Files.release(event.Name) {
+						logger.Info(fmt.Sprintf("Stop tailing removed file %s", t.Filename))
+						go t.StopAtEOF()
+					}
 				}
 			}
 		case err, ok := <-watcher.Errors:
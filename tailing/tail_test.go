@@ -1,14 +1,19 @@
 package tailing
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"syscall"
 	"testing"
 	"time"
 
+	"github.com/dimpogissou/isengard-server/checkpoint"
+	"github.com/dimpogissou/isengard-server/config"
+	"github.com/dimpogissou/isengard-server/events"
 	"github.com/dimpogissou/isengard-server/observer"
 	"github.com/dimpogissou/isengard-server/testutils"
-	"github.com/hpcloud/tail"
 	"gopkg.in/fsnotify.v1"
 )
 
@@ -53,18 +58,18 @@ func TestTailDirectory(t *testing.T) {
 	defer close(sigCh)
 
 	// Create publisher/subscriber with mockConnector
-	logsPublisher := observer.Publisher{}
-	logsCh := make(chan *tail.Line)
-	subscriber := observer.Subscriber{
+	logsPublisher := &observer.Publisher{}
+	logsCh := make(chan *events.Event)
+	subscriber := &observer.Subscriber{
 		Channel:   logsCh,
 		Connector: testutils.MockConnector{},
 	}
-	logsPublisher.Subscribe(subscriber.Channel)
+	logsPublisher.Subscribe(subscriber)
 
 	// Create tail goroutines
-	tails := InitTailsFromDir(testDir)
+	input := &Input{Files: NewFileSet(testDir, config.FilesConfig{}), Publisher: logsPublisher}
+	tails := InitTails([]*Input{input}, nil, nil)
 	for _, t := range tails {
-		go TailAndPublish(t.Lines, logsPublisher)
 		defer t.Stop()
 	}
 
@@ -109,20 +114,21 @@ func TestTailNewFiles(t *testing.T) {
 	check(err)
 
 	// Create publisher/subscriber with mockConnector
-	logsPublisher := observer.Publisher{}
-	logsCh := make(chan *tail.Line)
-	subscriber := observer.Subscriber{
+	logsPublisher := &observer.Publisher{}
+	logsCh := make(chan *events.Event)
+	subscriber := &observer.Subscriber{
 		Channel:   logsCh,
 		Connector: testutils.MockConnector{},
 	}
-	logsPublisher.Subscribe(subscriber.Channel)
+	logsPublisher.Subscribe(subscriber)
 
 	// Create signal channel
 	sigCh := make(chan os.Signal)
 	defer close(sigCh)
 
 	// Add new file and ensure watcher picks it up and starts tailing it from start
-	go TailNewFiles(watcher, logsPublisher, sigCh)
+	input := &Input{Files: NewFileSet(testDir, config.FilesConfig{}), Publisher: logsPublisher}
+	go TailNewFiles(watcher, []*Input{input}, nil, sigCh)
 	testFile2 := testutils.CreateTestFile(testDir, fileName)
 	testutils.SleepThenWriteToFile(testFile2, 1*time.Second, nLines, testLogLine)
 	go testutils.ReadAndAssertLines(t, subscriber, testLogLine, nLines, done)
@@ -135,3 +141,107 @@ func TestTailNewFiles(t *testing.T) {
 	}
 
 }
+
+// Asserts removed files are released and stop being tailed, and a file created again at the same path is tailed from its start
+func TestTailRemovedFiles(t *testing.T) {
+
+	const testDir = "./config_test_files"
+
+	err := os.Mkdir(testDir, 0755)
+	check(err)
+	defer testTeardown(testDir)
+	file := testutils.CreateTestFile(testDir, "test_file_3.txt")
+	file.Close()
+
+	watcher, err := fsnotify.NewWatcher()
+	check(err)
+	defer watcher.Close()
+
+	logsPublisher := &observer.Publisher{}
+	logsCh := make(chan *events.Event, 10)
+	logsPublisher.Subscribe(&observer.Subscriber{Channel: logsCh, Connector: testutils.MockConnector{}})
+	input := &Input{Files: NewFileSet(testDir, config.FilesConfig{}), Publisher: logsPublisher}
+	for _, tail := range InitTails([]*Input{input}, watcher, nil) {
+		defer tail.Stop()
+	}
+
+	sigCh := make(chan os.Signal)
+	defer close(sigCh)
+	go TailNewFiles(watcher, []*Input{input}, nil, sigCh)
+	defer func() { sigCh <- syscall.SIGINT }()
+
+	waitForFiles := func(n int) {
+		for deadline := time.Now().Add(3 * time.Second); input.Files.Len() != n; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %d tailed files, got %d", n, input.Files.Len())
+			}
+		}
+	}
+	waitForFiles(1)
+	check(os.Remove(file.Name()))
+	waitForFiles(0)
+
+	file = testutils.CreateTestFile(testDir, "test_file_3.txt")
+	waitForFiles(1)
+	testutils.SleepThenWriteToFile(file, 500*time.Millisecond, 1, "recreated")
+	select {
+	case e := <-logsCh:
+		if e.Text != "recreated" || e.Offset != 0 {
+			t.Errorf("Expected the recreated file to be tailed from its start, got %q at offset %d", e.Text, e.Offset)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Timed out waiting for line of the recreated file")
+	}
+}
+
+// Asserts offsets restart from 0 and are checkpointed for the new file once a rotated file is reopened
+func TestTailReopenedFile(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "reopen")
+	check(err)
+	defer os.RemoveAll(dir)
+	store, err := checkpoint.Open(filepath.Join(dir, "checkpoints.json"), time.Hour)
+	check(err)
+	defer store.Close()
+	path := filepath.Join(dir, "app.log")
+	check(ioutil.WriteFile(path, []byte("old line 1\nold line 2\n"), 0644))
+
+	logsPublisher := &observer.Publisher{}
+	logsCh := make(chan *events.Event, 10)
+	logsPublisher.Subscribe(&observer.Subscriber{Channel: logsCh, Connector: testutils.MockConnector{}})
+	tl, err := createTail(path, 0)
+	check(err)
+	defer tl.Stop()
+	go TailAndPublish(tl, &Input{Publisher: logsPublisher}, store)
+
+	receive := func() *events.Event {
+		select {
+		case e := <-logsCh:
+			e.Ack()
+			return e
+		case <-time.After(3 * time.Second):
+			t.Fatalf("Timed out waiting for tailed line")
+		}
+		return nil
+	}
+	receive()
+	if e := receive(); e.Offset != 11 {
+		t.Errorf("Unexpected offset of second line, got %d, want 11", e.Offset)
+	}
+
+	// Let the tail wait for changes of the file it read to the end before rotating it
+	time.Sleep(500 * time.Millisecond)
+	check(os.Rename(path, path+".1"))
+	check(ioutil.WriteFile(path, []byte("new line 1\nnew line 2\n"), 0644))
+
+	for i, want := range []int64{0, 11} {
+		if e := receive(); e.Text != fmt.Sprintf("new line %d", i+1) || e.Offset != want {
+			t.Errorf("Unexpected line of reopened file, got %s at %d, want offset %d", e.Text, e.Offset, want)
+		}
+	}
+	info, err := os.Stat(path)
+	check(err)
+	if offset, ok := store.Resume(path, info); !ok || offset != 22 {
+		t.Errorf("Unexpected checkpoint of reopened file, got %d, %v, want 22", offset, ok)
+	}
+}
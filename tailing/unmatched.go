@@ -0,0 +1,91 @@
+package tailing
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/dimpogissou/isengard-server/config"
+	"github.com/dimpogissou/isengard-server/events"
+	"github.com/dimpogissou/isengard-server/logger"
+	"github.com/dimpogissou/isengard-server/observer"
+)
+
+// Unmatched handles the events of lines failing parsing with the unmatched policy of an input,
+// counting them by file to spot changes of log formats
+type Unmatched struct {
+	Policy     string
+	Publisher  *observer.Publisher     // Publisher of the unmatched connector, with the connector policy
+	DeadLetter observer.DeadLetterSink // Sink of the unmatched file, with the file policy
+
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+// Creates the unmatched lines handler of an input, the subscriber of the unmatched connector is to be subscribed
+// to Publisher with the connector policy
+func NewUnmatched(cfg config.UnmatchedConfig) (*Unmatched, error) {
+	cfg = cfg.WithDefaults()
+	u := Unmatched{Policy: cfg.Policy, counts: make(map[string]uint64)}
+	switch cfg.Policy {
+	case "connector":
+		u.Publisher = &observer.Publisher{}
+	case "file":
+		sink, err := observer.NewFileDeadLetterSink(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		u.DeadLetter = sink
+	}
+	return &u, nil
+}
+
+// Handles an unmatched event of an input, returns true if it is to be published to the input connectors
+func (u *Unmatched) handle(input string, e *events.Event) bool {
+	u.count(input, e.Source)
+	e.Tags = append(e.Tags, config.ParseErrorTag)
+
+	switch u.Policy {
+	case "drop":
+		e.ExpectAcks(0)
+	case "connector":
+		u.Publisher.Publish(e)
+	case "file":
+		failure := errors.New(fmt.Sprintf("Line not matching the parser of input %s", input))
+		logger.CheckErrAndLog(u.DeadLetter.Write(e, "", 0, failure), "UnmatchedWriteError", fmt.Sprintf("Input %s dropped unmatched line from %s", input, e.Source))
+		e.ExpectAcks(0)
+	default:
+		return true
+	}
+	return false
+}
+
+// Counts an unmatched line of a file, warning on the first one
+func (u *Unmatched) count(input string, source string) {
+	u.mu.Lock()
+	u.counts[source]++
+	first := u.counts[source] == 1
+	u.mu.Unlock()
+	if first {
+		logger.Warn("UnmatchedLine", fmt.Sprintf("Input %s read a line not matching its parser in %s, handled with policy %s", input, source, u.Policy))
+	}
+}
+
+// Returns the number of unmatched lines by file
+func (u *Unmatched) Counts() map[string]uint64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	counts := make(map[string]uint64, len(u.counts))
+	for source, count := range u.counts {
+		counts[source] = count
+	}
+	return counts
+}
+
+// Closes the unmatched file, if any
+func (u *Unmatched) Close() error {
+	if u.DeadLetter != nil {
+		return u.DeadLetter.Close()
+	}
+	return nil
+}
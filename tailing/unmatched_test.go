@@ -0,0 +1,87 @@
+package tailing
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dimpogissou/isengard-server/config"
+	"github.com/dimpogissou/isengard-server/events"
+	"github.com/dimpogissou/isengard-server/observer"
+	"github.com/dimpogissou/isengard-server/testutils"
+)
+
+// Asserts lines failing parsing are forwarded tagged, dropped, routed to the unmatched connector or written to the
+// unmatched file depending on the input policy, and counted by file
+func TestUnmatchedPolicies(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "unmatched")
+	check(err)
+	defer os.RemoveAll(dir)
+	unmatchedFile := filepath.Join(dir, "unmatched.ndjson")
+
+	cases := []struct {
+		cfg       config.UnmatchedConfig
+		published string
+		routed    string
+	}{
+		{config.UnmatchedConfig{}, "[api _parse_error]", ""},
+		{config.UnmatchedConfig{Policy: "drop"}, "", ""},
+		{config.UnmatchedConfig{Policy: "connector", Connector: "errors"}, "", "[api _parse_error]"},
+		{config.UnmatchedConfig{Policy: "file", File: unmatchedFile}, "", ""},
+	}
+	for _, c := range cases {
+		ch := make(chan *events.Event, 10)
+		logsPublisher := &observer.Publisher{}
+		logsPublisher.Subscribe(&observer.Subscriber{Channel: ch, Connector: testutils.MockConnector{}})
+		input, err := NewInput(config.InputConfig{Name: "api", Directory: dir, LogPattern: `^\[(?P<level>[A-Z]+)\] (?P<message>.*)`,
+			Tags: []string{"api"}, Unmatched: c.cfg}, logsPublisher)
+		check(err)
+		routed := make(chan *events.Event, 10)
+		if input.Unmatched.Publisher != nil {
+			input.Unmatched.Publisher.SubscribeAll(&observer.Subscriber{Channel: routed, Connector: testutils.MockConnector{Levels: []string{"ERROR"}}})
+		}
+
+		acked := 0
+		for i, text := range []string{"[INFO] Started", "Unexpected format", "another unexpected format"} {
+			e := input.newEvent(text, filepath.Join(dir, "api.log"), int64(i))
+			e.OnAcknowledged(func() { acked++ })
+			input.publish(e)
+		}
+		input.Unmatched.Close()
+
+		if got := tagsOf(ch); got != "[api]"+c.published+c.published {
+			t.Errorf("Policy %s published events tagged %s, want [api]%s%s", c.cfg.Policy, got, c.published, c.published)
+		}
+		if got := tagsOf(routed); got != c.routed+c.routed {
+			t.Errorf("Policy %s routed events tagged %s, want %s%s", c.cfg.Policy, got, c.routed, c.routed)
+		}
+		if c.cfg.Policy == "drop" || c.cfg.Policy == "file" {
+			if acked != 2 {
+				t.Errorf("Policy %s acknowledged %d unmatched events, want 2", c.cfg.Policy, acked)
+			}
+		}
+		if got := fmt.Sprint(input.Unmatched.Counts()); got != fmt.Sprintf("map[%s:2]", filepath.Join(dir, "api.log")) {
+			t.Errorf("Policy %s counted unmatched lines %s", c.cfg.Policy, got)
+		}
+	}
+
+	data, err := ioutil.ReadFile(unmatchedFile)
+	check(err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"text":"Unexpected format"`) || !strings.Contains(lines[0], "_parse_error") {
+		t.Errorf("Unexpected unmatched file records:\n%s", data)
+	}
+}
+
+// Returns the concatenated tags of the events buffered in a channel
+func tagsOf(ch chan *events.Event) string {
+	tags := ""
+	for len(ch) > 0 {
+		tags += fmt.Sprint((<-ch).Tags)
+	}
+	return tags
+}
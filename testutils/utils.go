@@ -6,17 +6,23 @@ import (
 	"testing"
 	"time"
 
+	"github.com/dimpogissou/isengard-server/config"
+	"github.com/dimpogissou/isengard-server/events"
 	"github.com/dimpogissou/isengard-server/logger"
 	"github.com/dimpogissou/isengard-server/observer"
-	"github.com/hpcloud/tail"
 )
 
 // Mock Connector implementing ConnectorInterface
-type MockConnector struct{}
+type MockConnector struct {
+	Levels   []string
+	Delivery config.DeliveryConfig
+}
 
-func (c MockConnector) GetName() string         { return "mockConnector" }
-func (c MockConnector) Send(t *tail.Line) error { return nil }
-func (c MockConnector) Close() error            { return nil }
+func (c MockConnector) GetName() string                    { return "mockConnector" }
+func (c MockConnector) GetLevels() []string                { return c.Levels }
+func (c MockConnector) GetDelivery() config.DeliveryConfig { return c.Delivery }
+func (c MockConnector) Send(e *events.Event) error         { return nil }
+func (c MockConnector) Close() error                       { return nil }
 
 // Create test file
 func CreateTestFile(dir string, fileName string) *os.File {
@@ -39,12 +45,12 @@ func SleepThenWriteToFile(file *os.File, duration time.Duration, nLines int, tes
 
 // Reads lines from subscriber channel, asserts correct number, then sends true to bool channel.
 // Should be used with timeout as it will just hang if not enough records are received.
-func ReadAndAssertLines(t *testing.T, subscriber observer.Subscriber, logLine string, nLines int, done chan bool) {
+func ReadAndAssertLines(t *testing.T, subscriber *observer.Subscriber, logLine string, nLines int, done chan bool) {
 	i := 0
-	for line := range subscriber.Channel {
+	for e := range subscriber.Channel {
 		i += 1
-		if line.Text != logLine {
-			t.Errorf("Log line tailing failed, got [%v], want [%v]", line.Text, logLine)
+		if e.Text != logLine {
+			t.Errorf("Log line tailing failed, got [%v], want [%v]", e.Text, logLine)
 		}
 		if i == nLines {
 			done <- true